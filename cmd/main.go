@@ -2,56 +2,266 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
-	"netmonitor/internal/geoip"
-	"netmonitor/internal/iptables"
-	"netmonitor/internal/logger"
-	"netmonitor/internal/nfqueue"
+	"github.com/lonelysadness/netmonitor/internal/apiserver"
+	"github.com/lonelysadness/netmonitor/internal/config"
+	"github.com/lonelysadness/netmonitor/internal/dns"
+	"github.com/lonelysadness/netmonitor/internal/geoip"
+	"github.com/lonelysadness/netmonitor/internal/history"
+	"github.com/lonelysadness/netmonitor/internal/iplist"
+	"github.com/lonelysadness/netmonitor/internal/iptables"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/nfqueue"
+	"github.com/lonelysadness/netmonitor/internal/prompt"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to the policy file (built-in defaults when empty)")
+	flag.Parse()
+
 	mustInit := func(err error, msg string) {
 		if err != nil {
-			logger.Log.Fatalf("%s: %v", msg, err)
+			logger.Fatal(msg, "err", err)
 		}
 	}
 
-	logger.Log.Println("Starting netmonitor...")
+	// Load and validate the policy before touching any iptables rule
+	cfg := config.Default()
+	if *configPath != "" {
+		var err error
+		cfg, err = config.Load(*configPath)
+		mustInit(err, "Error loading config")
+	}
+
+	mustInit(logger.Open(logOptions(cfg.Logging)), "Error opening log file")
+	logger.Log.Info("starting netmonitor")
+
+	// GeoIP only enriches connections, so missing databases are not fatal
+	geo := geoip.NewResolver(geoip.Paths{
+		Country: cfg.GeoIP.Country,
+		City:    cfg.GeoIP.City,
+		ASN:     cfg.GeoIP.ASN,
+		Overlay: cfg.GeoIP.Overlay,
+	})
+	nfqueue.SetGeoIP(geo)
+
+	mustInit(iplist.Load(cfg.IPLists.Lists), "Error loading IP lists")
+
+	nfqueue.SetCacheDuration(cfg.Cache.Duration)
+	nfqueue.SetConnectionLog(cfg.Logging.Terminal, cfg.Logging.Sample)
+	nfqueue.SetRules(cfg.RuleSet())
+	nfqueue.SetDNS(cfg.DNS.Observe, cfg.DNS.RedirectPort)
 
-	mustInit(geoip.Init("data/GeoLite2-Country.mmdb", "data/GeoLite2-ASN.mmdb"), "Error initializing GeoIP database")
-	defer geoip.Close()
+	blocklist, err := dns.LoadBlocklist(cfg.DNS.Block, cfg.DNS.Lists)
+	mustInit(err, "Error loading filter lists")
+	logger.Log.Info("blocking domains", "count", blocklist.Len())
+	nfqueue.SetBlocklist(blocklist)
+
+	prompts := prompt.NewManager(cfg.Prompt.Timeout, cfg.Prompt.Fallback, nfqueue.AddRule)
+	nfqueue.SetPrompter(prompts)
+
+	// The resolver has to listen before queries are redirected to it
+	var resolver *dns.Resolver
+	if len(cfg.DNS.Upstreams) > 0 {
+		resolver = dns.NewResolver(nfqueue.Domains(), cfg.DNS.Upstreams)
+		resolver.SetBlocklist(blocklist, cfg.DNS.BlockResponse)
+		mustInit(resolver.Start(cfg.DNS.RedirectPort), "Error starting DNS resolver")
+		defer resolver.Close()
+	}
 
 	// Initialize IPTables
-	ipt, err := iptables.New()
+	ipt, err := iptables.New(cfg.Queue.IPv4, cfg.Queue.IPv6, cfg.DNS.RedirectPort)
 	mustInit(err, "Error initializing iptables")
 
 	// Setup IPTables rules
 	mustInit(ipt.Setup(), "Error setting up iptables")
 	defer ipt.Cleanup()
 
-	qv4, err := nfqueue.NewQueue(17040, false, nfqueue.Callback)
+	qv4, err := nfqueue.NewQueue(cfg.Queue.IPv4, false, nfqueue.Callback)
 	mustInit(err, "Error initializing nfqueue v4")
 	defer qv4.Destroy()
 
-	qv6, err := nfqueue.NewQueue(17060, false, nfqueue.Callback)
+	qv6, err := nfqueue.NewQueue(cfg.Queue.IPv6, true, nfqueue.Callback)
 	mustInit(err, "Error initializing nfqueue v6")
 	defer qv6.Destroy()
 
+	// History is optional, the daemon runs without it
+	var store *history.Store
+	if cfg.History.Dir != "" {
+		store, err = history.Open(cfg.History.Dir, history.Retention{MaxAge: cfg.History.MaxAge, MaxSize: cfg.History.MaxSize})
+		if err != nil {
+			logger.Log.Warn("not recording connection history", "err", err)
+			store = nil
+		}
+	}
+
+	var server *apiserver.Server
+	if cfg.API.Socket != "" {
+		server = apiserver.NewServer(cfg.API.Socket, []*nfqueue.Queue{qv4, qv6}, prompts, geo, store)
+		mustInit(server.Start(), "Error starting control API")
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	go iplist.Watch(ctx, cfg.IPLists.Reload)
+	go geo.Watch(ctx)
+	go nfqueue.TrackConnections(ctx)
+	go nfqueue.LogConnections(ctx)
+	// recorded is closed once recordHistory stopped appending to the store
+	recorded := make(chan struct{})
+	if store != nil {
+		go recordHistory(ctx, store, recorded)
+	}
+
+	if *configPath != "" {
+		go reloadOnHangup(ctx, *configPath, cfg, prompts, resolver)
+	}
+
 	go func() {
 		<-ctx.Done()
-		logger.Log.Println("Shutting down...")
+		logger.Log.Info("shutting down")
+		if server != nil {
+			server.Close()
+		}
 		qv4.Destroy()
 		qv6.Destroy()
 		ipt.Cleanup() // Use the instance method instead of package function
+		if resolver != nil {
+			resolver.Close()
+		}
+		if store != nil {
+			<-recorded
+			store.Close()
+		}
 		os.Exit(0)
 	}()
 
 	qv4.Run(ctx)
 	qv6.Run(ctx)
 }
+
+// reloadOnHangup re-reads the policy file on every SIGHUP and applies it
+// without touching the queues. An invalid file leaves the running policy
+// in place.
+func reloadOnHangup(ctx context.Context, path string, cfg *config.Config, prompts *prompt.Manager, resolver *dns.Resolver) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		logger.Log.Info("reloading config", "path", path)
+		next, err := config.Load(path)
+		if err != nil {
+			logger.Log.Warn("keeping current config, reload failed", "err", err)
+			continue
+		}
+
+		if next.Queue != cfg.Queue || next.GeoIP != cfg.GeoIP || next.API != cfg.API || next.History != cfg.History ||
+			next.DNS.RedirectPort != cfg.DNS.RedirectPort || !slices.Equal(next.DNS.Upstreams, cfg.DNS.Upstreams) ||
+			next.IPLists.Reload != cfg.IPLists.Reload {
+			logger.Log.Warn("queue, GeoIP, API, history, DNS redirect and upstream, and IP list reload changes take effect after a restart")
+		}
+		// The redirect and the resolver keep running with the values they
+		// were started with
+		next.DNS.RedirectPort, next.DNS.Upstreams = cfg.DNS.RedirectPort, cfg.DNS.Upstreams
+		if next.Logging != cfg.Logging {
+			if err := logger.Open(logOptions(next.Logging)); err != nil {
+				logger.Log.Warn("failed to reopen log files", "err", err)
+			}
+		}
+
+		if err := iplist.Load(next.IPLists.Lists); err != nil {
+			logger.Log.Warn("keeping current IP lists, reload failed", "err", err)
+		}
+		nfqueue.SetCacheDuration(next.Cache.Duration)
+		nfqueue.SetConnectionLog(next.Logging.Terminal, next.Logging.Sample)
+		nfqueue.SetDNS(next.DNS.Observe, next.DNS.RedirectPort)
+		if blocklist, err := dns.LoadBlocklist(next.DNS.Block, next.DNS.Lists); err != nil {
+			logger.Log.Warn("keeping current filter lists, reload failed", "err", err)
+		} else {
+			nfqueue.SetBlocklist(blocklist)
+			if resolver != nil {
+				resolver.SetBlocklist(blocklist, next.DNS.BlockResponse)
+			}
+		}
+		prompts.Configure(next.Prompt.Timeout, next.Prompt.Fallback)
+		changed := nfqueue.ApplyRules(next.RuleSet())
+		logger.Log.Info("config reloaded", "changed_verdicts", changed)
+		cfg = next
+	}
+}
+
+// logOptions converts the logging section of the config into the options
+// of the logger
+func logOptions(c config.LoggingConfig) logger.Options {
+	return logger.Options{
+		File:        c.File,
+		Connections: c.Connections,
+		Format:      c.Format,
+		Level:       c.Level,
+		Mode:        c.Mode,
+		Rotation: logger.Rotation{
+			MaxSize:    c.MaxSize,
+			MaxAge:     c.MaxAge,
+			MaxBackups: c.MaxBackups,
+			Compress:   c.Compress,
+		},
+	}
+}
+
+// recordHistory appends every decided connection to store until ctx is
+// done. Events are flushed every second and retention is enforced every
+// hour. Events dropped because the store fell behind are reported every
+// minute. done is closed on return, after the last Append.
+func recordHistory(ctx context.Context, store *history.Store, done chan<- struct{}) {
+	defer close(done)
+	events, unsubscribe := nfqueue.Subscribe("history")
+	defer unsubscribe()
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	expire := time.NewTicker(time.Hour)
+	defer expire.Stop()
+	report := time.NewTicker(time.Minute)
+	defer report.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			if err := store.Append(apiserver.ConnectionEvent(ev)); err != nil {
+				logger.Log.Warn("failed to record connection history", "err", err)
+			}
+		case <-flush.C:
+			if err := store.Flush(); err != nil {
+				logger.Log.Warn("failed to write connection history", "err", err)
+			}
+		case <-expire.C:
+			if err := store.Expire(); err != nil {
+				logger.Log.Warn("failed to delete expired connection history", "err", err)
+			}
+		case <-report.C:
+			for _, s := range nfqueue.EventStats() {
+				if s.Name == "history" && s.Dropped > dropped {
+					logger.Log.Warn("connection history is missing events, recording fell behind",
+						"dropped", s.Dropped-dropped, "total", s.Dropped)
+					dropped = s.Dropped
+				}
+			}
+		}
+	}
+}
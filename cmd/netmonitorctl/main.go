@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/api"
+	"github.com/lonelysadness/netmonitor/internal/config"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+)
+
+const usage = `usage: netmonitorctl [-socket path] [-json] <command> [arguments]
+
+commands:
+  conns list [-process name]       list connections with a cached verdict
+  tail [-process name]             follow new connections as they are decided
+  history [-since t] [filters]     list recorded connections (see history -h)
+  rules list                       list the active rules
+  rules add -name n -verdict v ... add a rule (see rules add -h)
+  rules del <name>                 delete a rule
+  stats                            show queue and attribution statistics
+  cache flush                      drop all cached verdicts
+  prompts                          list connections waiting for a decision
+  answer <id> <verdict> [scope]    answer a prompt; scope is once, always,
+                                   process or destination
+  lookup <ip>                      show country, ASN and IP lists of an address
+  top [-by d] [-window w] [-n n]   show who moves the most traffic; d is process,
+                                   destination, country or asn, w is 1m, 5m or 1h
+`
+
+// stringList is a flag that can be repeated or given comma separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+type cli struct {
+	client *api.Client
+	json   bool
+}
+
+func main() {
+	socket := flag.String("socket", config.Default().API.Socket, "path of the daemon control socket")
+	jsonOutput := flag.Bool("json", false, "print JSON instead of tables")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c := &cli{client: api.NewClient(*socket), json: *jsonOutput}
+	if err := c.run(ctx, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "netmonitorctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func (c *cli) run(ctx context.Context, args []string) error {
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "conns", "connections":
+		if len(args) == 0 || args[0] != "list" {
+			return fmt.Errorf("usage: conns list [-process name]")
+		}
+		return c.listConnections(ctx, args[1:])
+	case "tail":
+		return c.tail(ctx, args)
+	case "history":
+		return c.history(ctx, args)
+	case "rules":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: rules list|add|del")
+		}
+		switch args[0] {
+		case "list":
+			return c.listRules(ctx)
+		case "add":
+			return c.addRule(ctx, args[1:])
+		case "del", "delete":
+			if len(args) != 2 {
+				return fmt.Errorf("usage: rules del <name>")
+			}
+			return c.client.DeleteRule(ctx, args[1])
+		}
+		return fmt.Errorf("unknown rules command %q", args[0])
+	case "stats":
+		return c.stats(ctx)
+	case "cache":
+		if len(args) != 1 || args[0] != "flush" {
+			return fmt.Errorf("usage: cache flush")
+		}
+		flushed, err := c.client.FlushCache(ctx)
+		if err != nil {
+			return err
+		}
+		return c.print(flushed, func() { fmt.Printf("Flushed %d cached verdicts\n", flushed.Flushed) })
+	case "prompts":
+		return c.listPrompts(ctx)
+	case "answer":
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("usage: answer <id> <verdict> [scope]")
+		}
+		answer := api.PromptAnswer{Verdict: args[1], Scope: "once"}
+		if len(args) == 3 {
+			answer.Scope = args[2]
+		}
+		return c.client.AnswerPrompt(ctx, args[0], answer)
+	case "lookup":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: lookup <ip>")
+		}
+		return c.lookup(ctx, args[0])
+	case "top":
+		return c.top(ctx, args)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// print writes v as JSON when requested and calls table otherwise
+func (c *cli) print(v interface{}, table func()) error {
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	table()
+	return nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+// matchesProcess compares name against the process name and the base name
+// of its executable
+func matchesProcess(conn api.Connection, name string) bool {
+	return name == "" || conn.Process == name || (conn.Path != "" && filepath.Base(conn.Path) == name) || conn.Path == name
+}
+
+func endpoint(ip string, port uint16) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// destination shows the remote end, labelled with the domain it was
+// resolved from when known
+func destination(conn api.Connection) string {
+	if conn.Domain == "" {
+		return endpoint(conn.Dst, conn.DstPort)
+	}
+	return fmt.Sprintf("%s (%s)", conn.Domain, endpoint(conn.Dst, conn.DstPort))
+}
+
+func processLabel(conn api.Connection) string {
+	if conn.PID == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%s (%d)", conn.Process, conn.PID)
+}
+
+// country shows the addresses GeoIP could not place as "unknown", the name
+// rules use for them
+func country(code string) string {
+	if code == "" {
+		return rules.UnknownCountry
+	}
+	return code
+}
+
+// location shows the overlay network or local scope of the remote end of
+// conn, and its country otherwise
+func location(conn api.Connection) string {
+	switch {
+	case conn.Label != "":
+		return conn.Label
+	case conn.Scope != "" && conn.Scope != "internet":
+		return conn.Scope
+	}
+	return country(conn.Country)
+}
+
+func (c *cli) listConnections(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("conns list", flag.ExitOnError)
+	process := fs.String("process", "", "only show connections of this process")
+	fs.Parse(args)
+
+	conns, err := c.client.Connections(ctx)
+	if err != nil {
+		return err
+	}
+	filtered := conns[:0]
+	for _, conn := range conns {
+		if matchesProcess(conn, *process) {
+			filtered = append(filtered, conn)
+		}
+	}
+
+	return c.print(filtered, func() {
+		tw := newTable()
+		fmt.Fprintln(tw, "PROTO\tSOURCE\tDESTINATION\tDIR\tPROCESS\tLOCATION\tASN\tSTATE\tVERDICT")
+		for _, conn := range filtered {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				conn.Protocol, endpoint(conn.Src, conn.SrcPort), destination(conn),
+				direction(conn.Inbound), processLabel(conn), location(conn), conn.ASN, state(conn), conn.Verdict)
+		}
+		tw.Flush()
+	})
+}
+
+// state is the conntrack state of conn, "-" until conntrack reports it
+func state(conn api.Connection) string {
+	if conn.State == "" {
+		return "-"
+	}
+	return conn.State
+}
+
+func direction(inbound bool) string {
+	if inbound {
+		return "in"
+	}
+	return "out"
+}
+
+func (c *cli) tail(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	process := fs.String("process", "", "only show connections of this process")
+	fs.Parse(args)
+
+	enc := json.NewEncoder(os.Stdout)
+	return c.client.StreamConnections(ctx, func(ev api.ConnectionEvent) {
+		if !matchesProcess(ev.Connection, *process) {
+			return
+		}
+		if c.json {
+			enc.Encode(ev)
+			return
+		}
+		printEvent(ev, "15:04:05")
+	})
+}
+
+// printEvent writes ev on one line, with its time in layout
+func printEvent(ev api.ConnectionEvent, layout string) {
+	conn := ev.Connection
+	rule := ev.Rule
+	if rule == "" {
+		rule = "default"
+	}
+	if ev.Limited != "" {
+		rule += ": " + ev.Limited
+	}
+	fmt.Printf("%s %-6s %s -> %s %s %s %s/AS%d %s (%s)\n",
+		ev.Time.Local().Format(layout), conn.Protocol,
+		endpoint(conn.Src, conn.SrcPort), destination(conn),
+		direction(conn.Inbound), processLabel(conn), location(conn), conn.ASN, conn.Verdict, rule)
+}
+
+func (c *cli) history(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	since := fs.String("since", "1h", "RFC 3339 time or duration before now")
+	until := fs.String("until", "", "RFC 3339 time or duration before now")
+	process := fs.String("process", "", "process name or executable path")
+	dest := fs.String("destination", "", "domain with its subdomains, address or CIDR")
+	countryCode := fs.String("country", "", "ISO country code")
+	verdict := fs.String("verdict", "", "verdict such as block or accept-always")
+	n := fs.Int("n", 100, "show the latest n connections, 0 for all")
+	fs.Parse(args)
+
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"since": *since, "until": *until, "process": *process,
+		"destination": *dest, "country": *countryCode, "verdict": *verdict,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	query.Set("limit", strconv.Itoa(*n))
+
+	events, err := c.client.History(ctx, query)
+	if err != nil {
+		return err
+	}
+	return c.print(events, func() {
+		for _, ev := range events {
+			printEvent(ev, time.DateTime)
+		}
+	})
+}
+
+func (c *cli) listRules(ctx context.Context) error {
+	list, err := c.client.Rules(ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(list, func() {
+		tw := newTable()
+		fmt.Fprintln(tw, "#\tNAME\tMATCH\tVERDICT")
+		for i, rule := range list.Rules {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i, rule.Name, describeRule(rule), rule.Verdict)
+		}
+		fmt.Fprintf(tw, "-\tdefault\t*\t%s\n", list.Default)
+		tw.Flush()
+	})
+}
+
+func describeRule(r api.Rule) string {
+	match := describeMatch(r.Match)
+	if r.Except != nil {
+		match += " except(" + describeMatch(*r.Except) + ")"
+	}
+	if l := r.Limit; l != nil {
+		var parts []string
+		if l.Rate != "" {
+			parts = append(parts, fmt.Sprintf("rate=%s burst=%d", l.Rate, l.Burst))
+		}
+		if l.MaxConnections > 0 {
+			parts = append(parts, fmt.Sprintf("max=%d", l.MaxConnections))
+		}
+		match += fmt.Sprintf(" limit(%s per %s, else %s)", strings.Join(parts, " "), l.Per, l.Overflow)
+	}
+	return match
+}
+
+func describeMatch(r api.Match) string {
+	var parts []string
+	add := func(key string, values []string) {
+		if len(values) > 0 {
+			parts = append(parts, key+"="+strings.Join(values, ","))
+		}
+	}
+	add("process", r.Process)
+	add("parent", r.Parent)
+	add("uid", itoa(r.UID))
+	add("user", r.User)
+	add("unit", r.Unit)
+	add("container", r.Container)
+	add("sha256", r.SHA256)
+	add("domain", r.Domain)
+	add("dst", r.Destination)
+	add("port", r.Port)
+	add("proto", r.Protocol)
+	add("country", r.Country)
+	add("continent", r.Continent)
+	add("asn", itoa(r.ASN))
+	add("scope", r.Scope)
+	add("iplist", r.IPList)
+	if r.Direction != "" {
+		parts = append(parts, "dir="+r.Direction)
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, " ")
+}
+
+func itoa[T int | uint](values []T) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		out = append(out, fmt.Sprint(v))
+	}
+	return out
+}
+
+func (c *cli) addRule(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rules add", flag.ExitOnError)
+	var rule api.Rule
+	var uids, asns, processes, parents, users, units, containers, hashes, domains, destinations, ports, protocols, countries, continents, scopes, iplists stringList
+	fs.StringVar(&rule.Name, "name", "", "unique rule name (required)")
+	fs.StringVar(&rule.Verdict, "verdict", "", "accept, block, drop, their -always variants or prompt (required)")
+	fs.StringVar(&rule.Direction, "direction", "", "in, out or any")
+	fs.Var(&processes, "process", "process name or executable path, repeatable")
+	fs.Var(&parents, "parent", "ancestor process name or executable path, repeatable")
+	fs.Var(&uids, "uid", "owner UID, repeatable")
+	fs.Var(&users, "user", "owner user name, repeatable")
+	fs.Var(&units, "unit", "systemd unit, repeatable")
+	fs.Var(&containers, "container", "container ID, repeatable")
+	fs.Var(&hashes, "sha256", "pinned SHA-256 of the executable, repeatable")
+	fs.StringVar(&rule.HashMismatch, "hash-mismatch", "", "block, prompt or allow when the executable hash differs")
+	fs.StringVar(&rule.GeoIPUnavailable, "geoip-unavailable", "", "unknown, match or no-match for country, continent and asn without GeoIP data")
+	fs.Var(&domains, "domain", "domain or *.suffix wildcard, repeatable")
+	fs.Var(&destinations, "destination", "remote address or CIDR, repeatable")
+	fs.Var(&ports, "port", "remote port or range, repeatable")
+	fs.Var(&protocols, "protocol", "protocol name or number, repeatable")
+	fs.Var(&countries, "country", "ISO country code, EU or unknown, repeatable")
+	fs.Var(&continents, "continent", "continent code or name, repeatable")
+	fs.Var(&asns, "asn", "autonomous system number, repeatable")
+	fs.Var(&scopes, "scope", "localhost, lan, internet or an overlay network label, repeatable")
+	fs.Var(&iplists, "iplist", "name of an IP list containing the remote address, repeatable")
+	var limit api.Limit
+	fs.StringVar(&limit.Rate, "rate", "", "cap new connections at a rate such as 10/s, 30/m or 100/h")
+	fs.IntVar(&limit.Burst, "burst", 0, "connections allowed at once above the rate, defaults to its count")
+	fs.IntVar(&limit.MaxConnections, "max-connections", 0, "cap the open connections")
+	fs.StringVar(&limit.Per, "per", "", "count connections per process (default) or destination")
+	fs.StringVar(&limit.Overflow, "overflow", "", "block (default) or drop connections over the limit")
+	position := fs.Int("position", -1, "insert at this index of the added rules instead of appending")
+	fs.Parse(args)
+
+	if limit != (api.Limit{}) {
+		rule.Limit = &limit
+	}
+	rule.Process = processes
+	rule.Parent = parents
+	rule.User = users
+	rule.Unit = units
+	rule.Container = containers
+	rule.SHA256 = hashes
+	rule.Domain = domains
+	rule.Destination = destinations
+	rule.Port = ports
+	rule.Protocol = protocols
+	rule.Country = countries
+	rule.Continent = continents
+	rule.Scope = scopes
+	rule.IPList = iplists
+	for _, s := range uids {
+		var uid int
+		if _, err := fmt.Sscan(s, &uid); err != nil {
+			return fmt.Errorf("invalid uid %q", s)
+		}
+		rule.UID = append(rule.UID, uid)
+	}
+	for _, s := range asns {
+		var asn uint
+		if _, err := fmt.Sscan(strings.TrimPrefix(strings.ToUpper(s), "AS"), &asn); err != nil {
+			return fmt.Errorf("invalid asn %q", s)
+		}
+		rule.ASN = append(rule.ASN, asn)
+	}
+
+	req := api.AddRuleRequest{Rule: rule}
+	if *position >= 0 {
+		req.Position = position
+	}
+	added, err := c.client.AddRule(ctx, req)
+	if err != nil {
+		return err
+	}
+	return c.print(added, func() { fmt.Printf("Added rule %q\n", added.Name) })
+}
+
+func (c *cli) stats(ctx context.Context) error {
+	stats, err := c.client.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(stats, func() {
+		tw := newTable()
+		fmt.Fprintln(tw, "QUEUE\tPROCESSED\tDROPPED\tPENDING\tAVG TIME")
+		for _, q := range stats.Queues {
+			var avg time.Duration
+			if q.PacketsProcessed > 0 {
+				avg = q.ProcessingTime / time.Duration(q.PacketsProcessed)
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\n", q.Queue, q.PacketsProcessed, q.PacketsDropped, q.PendingVerdicts, avg)
+		}
+		tw.Flush()
+		fmt.Println()
+		tw = newTable()
+		fmt.Fprintln(tw, "BACKEND\tHITS\tMISSES")
+		for _, b := range stats.Attribution {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", b.Backend, b.Hits, b.Misses)
+		}
+		tw.Flush()
+		if len(stats.Events) > 0 {
+			fmt.Println()
+			tw = newTable()
+			fmt.Fprintln(tw, "EVENT SINK\tDELIVERED\tDROPPED")
+			for _, e := range stats.Events {
+				fmt.Fprintf(tw, "%s\t%d\t%d\n", e.Sink, e.Delivered, e.Dropped)
+			}
+			tw.Flush()
+		}
+		if len(stats.GeoIP) > 0 {
+			fmt.Println()
+			tw = newTable()
+			fmt.Fprintln(tw, "GEOIP\tPATH\tLOADED\tERROR")
+			for _, g := range stats.GeoIP {
+				loaded := "-"
+				if !g.Loaded.IsZero() {
+					loaded = g.Loaded.Format(time.DateTime)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", g.Kind, g.Path, loaded, g.Error)
+			}
+			tw.Flush()
+		}
+		fmt.Printf("\nCached connections: %d\nPending prompts: %d\n", stats.Connections, stats.Prompts)
+	})
+}
+
+func (c *cli) listPrompts(ctx context.Context) error {
+	prompts, err := c.client.Prompts(ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(prompts, func() {
+		tw := newTable()
+		fmt.Fprintln(tw, "ID\tPROTO\tDESTINATION\tPROCESS\tLOCATION\tEXPIRES IN")
+		for _, p := range prompts {
+			conn := p.Connection
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.ID, conn.Protocol,
+				destination(conn), processLabel(conn), location(conn),
+				time.Until(p.Deadline).Round(time.Second))
+		}
+		tw.Flush()
+	})
+}
+
+func (c *cli) lookup(ctx context.Context, ip string) error {
+	lookup, err := c.client.Lookup(ctx, ip)
+	if err != nil {
+		return err
+	}
+	return c.print(lookup, func() {
+		place := country(lookup.Country)
+		if lookup.City != "" {
+			place = lookup.City + ", " + place
+		}
+		if lookup.Continent != "" {
+			place += ", continent " + lookup.Continent
+		}
+		if lookup.EU {
+			place += ", EU"
+		}
+		fmt.Printf("IP:      %s\n", lookup.IP)
+		if lookup.Label != "" {
+			fmt.Printf("Network: %s (%s)\n", lookup.Label, lookup.Scope)
+		} else {
+			fmt.Printf("Scope:   %s\nCountry: %s\n", lookup.Scope, place)
+		}
+		fmt.Printf("ASN:     AS%d\nOrg:     %s\n", lookup.ASN, lookup.Org)
+		if lookup.Latitude != nil && lookup.Longitude != nil {
+			fmt.Printf("Coords:  %.4f, %.4f\n", *lookup.Latitude, *lookup.Longitude)
+		}
+		if len(lookup.IPLists) > 0 {
+			fmt.Printf("Listed:  %s in %s\n", lookup.Prefix, strings.Join(lookup.IPLists, ", "))
+		}
+	})
+}
+
+// top shows the busiest groups, refreshed every interval until interrupted.
+// With -json or a zero interval it prints once.
+func (c *cli) top(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	by := fs.String("by", "process", "group by process, destination, country or asn")
+	window := fs.String("window", "1m", "sum the traffic of the last 1m, 5m or 1h")
+	n := fs.Int("n", 20, "number of rows")
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval, 0 to print once")
+	fs.Parse(args)
+
+	for {
+		traffic, err := c.client.Traffic(ctx, *by, *window, *n)
+		if err != nil {
+			return err
+		}
+		if c.json || *interval <= 0 {
+			return c.print(traffic, func() { printTraffic(traffic) })
+		}
+		fmt.Print("\033[H\033[2J") // clear the screen
+		fmt.Printf("Top %s by traffic over the last %s, %s\n\n", traffic.By, traffic.Window, time.Now().Format(time.TimeOnly))
+		printTraffic(traffic)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func printTraffic(traffic *api.Traffic) {
+	window, _ := time.ParseDuration(traffic.Window)
+	tw := newTable()
+	fmt.Fprintf(tw, "%s\tIN\tOUT\tRATE IN\tRATE OUT\tPKTS IN\tPKTS OUT\n", strings.ToUpper(traffic.By))
+	for _, u := range traffic.Usage {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", u.Key,
+			formatBytes(u.BytesIn), formatBytes(u.BytesOut),
+			rate(u.BytesIn, window), rate(u.BytesOut, window),
+			u.PacketsIn, u.PacketsOut)
+	}
+	tw.Flush()
+}
+
+// formatBytes writes n with a binary unit
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// rate is the average of n bytes over window, per second
+func rate(n uint64, window time.Duration) string {
+	if window <= 0 {
+		return "-"
+	}
+	return formatBytes(uint64(float64(n)/window.Seconds())) + "/s"
+}
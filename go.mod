@@ -3,23 +3,23 @@ module github.com/lonelysadness/netmonitor
 go 1.22.0
 
 require (
+	github.com/cilium/ebpf v0.16.0
 	github.com/coreos/go-iptables v0.7.0
 	github.com/florianl/go-nfqueue v1.3.2
 	github.com/hashicorp/go-multierror v1.1.1
+	github.com/mdlayher/netlink v1.7.2
 	github.com/oschwald/geoip2-golang v1.11.0
 	github.com/tevino/abool v1.2.0
+	golang.org/x/net v0.23.0
 	golang.org/x/sys v0.21.0
 )
 
 require (
-	github.com/cilium/ebpf v0.16.0 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/josharian/native v1.1.0 // indirect
-	github.com/mdlayher/netlink v1.7.2 // indirect
 	github.com/mdlayher/socket v0.4.1 // indirect
 	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
 	golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
-	golang.org/x/net v0.23.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 )
@@ -0,0 +1,251 @@
+// Package accounting sums the traffic of connections per process,
+// destination, country and ASN over rolling windows
+package accounting
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dimension is what traffic is grouped by
+type Dimension int
+
+const (
+	ByProcess Dimension = iota + 1
+	ByDestination
+	ByCountry
+	ByASN
+)
+
+var dimensionNames = map[Dimension]string{
+	ByProcess:     "process",
+	ByDestination: "destination",
+	ByCountry:     "country",
+	ByASN:         "asn",
+}
+
+func (d Dimension) String() string {
+	if name, ok := dimensionNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("Dimension(%d)", int(d))
+}
+
+// ParseDimension converts a dimension name to a Dimension
+func ParseDimension(s string) (Dimension, error) {
+	for d, name := range dimensionNames {
+		if name == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dimension %q, expected process, destination, country or asn", s)
+}
+
+// Windows are the periods traffic is summed over
+var Windows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// ParseWindow converts a window such as "5m" to its duration
+func ParseWindow(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		for _, w := range Windows {
+			if d == w {
+				return d, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown window %q, expected 1m, 5m or 1h", s)
+}
+
+// FormatWindow writes a window the way ParseWindow reads it
+func FormatWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
+
+// Traffic counts bytes and packets in both directions, seen from this host
+type Traffic struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+func (t *Traffic) add(o Traffic) {
+	t.BytesIn += o.BytesIn
+	t.BytesOut += o.BytesOut
+	t.PacketsIn += o.PacketsIn
+	t.PacketsOut += o.PacketsOut
+}
+
+// Bytes is the traffic in both directions
+func (t Traffic) Bytes() uint64 {
+	return t.BytesIn + t.BytesOut
+}
+
+// Keys are the groups a connection's traffic is added to. Empty keys are
+// left out of their dimension.
+type Keys struct {
+	Process     string
+	Destination string
+	Country     string
+	ASN         string
+}
+
+func (k Keys) of(d Dimension) string {
+	switch d {
+	case ByProcess:
+		return k.Process
+	case ByDestination:
+		return k.Destination
+	case ByCountry:
+		return k.Country
+	case ByASN:
+		return k.ASN
+	}
+	return ""
+}
+
+// Usage is the traffic of one group over a window
+type Usage struct {
+	Key string
+	Traffic
+}
+
+// The windows up to five minutes are summed from 10 second buckets and the
+// hour from minute buckets
+const (
+	fineStep   = 10 * time.Second
+	fineSize   = 30
+	coarseStep = time.Minute
+	coarseSize = 60
+)
+
+type bucket struct {
+	start int64 // unix time the bucket begins at
+	Traffic
+}
+
+// series is the recent traffic of one group
+type series struct {
+	fine   [fineSize]bucket
+	coarse [coarseSize]bucket
+	last   time.Time
+}
+
+func (s *series) add(now time.Time, t Traffic) {
+	for _, ring := range []struct {
+		buckets []bucket
+		step    time.Duration
+	}{{s.fine[:], fineStep}, {s.coarse[:], coarseStep}} {
+		start := now.Truncate(ring.step).Unix()
+		b := &ring.buckets[start/int64(ring.step.Seconds())%int64(len(ring.buckets))]
+		if b.start != start {
+			*b = bucket{start: start}
+		}
+		b.add(t)
+	}
+	s.last = now
+}
+
+// sum returns the traffic of the buckets begun within window before now
+func (s *series) sum(now time.Time, window time.Duration) Traffic {
+	buckets, step := s.fine[:], fineStep
+	if window > fineStep*fineSize {
+		buckets, step = s.coarse[:], coarseStep
+	}
+	from := now.Add(-window).Truncate(step).Unix()
+	var total Traffic
+	for _, b := range buckets {
+		if b.start > from {
+			total.add(b.Traffic)
+		}
+	}
+	return total
+}
+
+// Meter sums traffic over the Windows
+type Meter struct {
+	sync.Mutex
+	series map[Dimension]map[string]*series
+}
+
+// NewMeter creates a Meter without traffic
+func NewMeter() *Meter {
+	m := &Meter{series: make(map[Dimension]map[string]*series)}
+	for d := range dimensionNames {
+		m.series[d] = make(map[string]*series)
+	}
+	return m
+}
+
+// Add counts t, which happened at now, for the groups of keys
+func (m *Meter) Add(now time.Time, keys Keys, t Traffic) {
+	if t == (Traffic{}) {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	for d, groups := range m.series {
+		key := keys.of(d)
+		if key == "" {
+			continue
+		}
+		s, ok := groups[key]
+		if !ok {
+			s = &series{}
+			groups[key] = s
+		}
+		s.add(now, t)
+	}
+}
+
+// Top returns the n groups of d that moved the most bytes within window,
+// all of them when n is 0
+func (m *Meter) Top(d Dimension, window time.Duration, n int) []Usage {
+	return m.top(time.Now(), d, window, n)
+}
+
+func (m *Meter) top(now time.Time, d Dimension, window time.Duration, n int) []Usage {
+	m.Lock()
+	var usage []Usage
+	for key, s := range m.series[d] {
+		if t := s.sum(now, window); t != (Traffic{}) {
+			usage = append(usage, Usage{Key: key, Traffic: t})
+		}
+	}
+	m.Unlock()
+
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Bytes() != usage[j].Bytes() {
+			return usage[i].Bytes() > usage[j].Bytes()
+		}
+		return usage[i].Key < usage[j].Key
+	})
+	if n > 0 && len(usage) > n {
+		usage = usage[:n]
+	}
+	return usage
+}
+
+// Expire drops the groups without traffic within the longest window
+func (m *Meter) Expire() {
+	m.expire(time.Now())
+}
+
+func (m *Meter) expire(now time.Time) {
+	oldest := now.Add(-Windows[len(Windows)-1])
+	m.Lock()
+	defer m.Unlock()
+	for _, groups := range m.series {
+		for key, s := range groups {
+			if s.last.Before(oldest) {
+				delete(groups, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package accounting
+
+import (
+	"testing"
+	"time"
+)
+
+// start is on a full hour, so buckets begin at offsets from it
+var start = time.Unix(1714557600, 0)
+
+func at(offset time.Duration) time.Time {
+	return start.Add(offset)
+}
+
+func bytesOut(n uint64) Traffic {
+	return Traffic{BytesOut: n, PacketsOut: 1}
+}
+
+func TestSeriesSum(t *testing.T) {
+	var s series
+	s.add(at(5*time.Second), bytesOut(100))
+	s.add(at(25*time.Second), bytesOut(200))
+	s.add(at(65*time.Second), bytesOut(400))
+	s.add(at(130*time.Second), bytesOut(800))
+
+	tests := []struct {
+		name   string
+		now    time.Duration
+		window time.Duration
+		want   uint64
+	}{
+		// Buckets begun within the window count, the one the window
+		// starts in does not
+		{"minute", 130 * time.Second, time.Minute, 800},
+		{"minute at a bucket boundary", 80 * time.Second, time.Minute, 1200},
+		{"five minutes", 130 * time.Second, 5 * time.Minute, 1500},
+		{"hour", 130 * time.Second, time.Hour, 1500},
+		{"minute passed", 10 * time.Minute, time.Minute, 0},
+		{"five minutes passed", 8 * time.Minute, 5 * time.Minute, 0},
+		{"hour minute buckets", time.Hour + 30*time.Second, time.Hour, 1200},
+		{"hour passed", 2 * time.Hour, time.Hour, 0},
+	}
+	for _, tt := range tests {
+		if got := s.sum(at(tt.now), tt.window).Bytes(); got != tt.want {
+			t.Errorf("%s: sum over %s at +%s = %d, want %d", tt.name, tt.window, tt.now, got, tt.want)
+		}
+	}
+
+	// A bucket reused after the ring went round forgets the old traffic
+	s.add(at(300*time.Second), bytesOut(1000))
+	if got := s.sum(at(300*time.Second), 5*time.Minute).Bytes(); got != 2400 {
+		t.Errorf("sum after wrapping = %d, want 2400", got)
+	}
+	if got := s.sum(at(300*time.Second), time.Hour).Bytes(); got != 2500 {
+		t.Errorf("hourly sum after wrapping = %d, want 2500", got)
+	}
+	s.add(at(time.Hour+5*time.Minute), bytesOut(3000))
+	if got := s.sum(at(time.Hour+5*time.Minute), time.Hour).Bytes(); got != 3000 {
+		t.Errorf("hourly sum an hour later = %d, want 3000", got)
+	}
+}
+
+func TestMeterTop(t *testing.T) {
+	m := NewMeter()
+	curl := Keys{Process: "/usr/bin/curl", Destination: "example.com", Country: "NL", ASN: "AS64500"}
+	firefox := Keys{Process: "/usr/bin/firefox", Destination: "example.com", Country: "DE"}
+	wget := Keys{Process: "/usr/bin/wget", Destination: "198.51.100.1"}
+
+	m.Add(at(0), firefox, bytesOut(5000))
+	m.Add(at(50*time.Minute), wget, bytesOut(700))
+	m.Add(at(58*time.Minute), curl, Traffic{BytesIn: 300, BytesOut: 200})
+	m.Add(at(59*time.Minute+30*time.Second), firefox, bytesOut(100))
+	m.Add(at(59*time.Minute+40*time.Second), wget, bytesOut(100))
+	m.Add(at(59*time.Minute+50*time.Second), curl, Traffic{})
+	now := at(time.Hour - time.Second)
+
+	names := func(usage []Usage) []string {
+		var keys []string
+		for _, u := range usage {
+			keys = append(keys, u.Key)
+		}
+		return keys
+	}
+	tests := []struct {
+		name   string
+		d      Dimension
+		window time.Duration
+		n      int
+		want   []string
+		bytes  []uint64
+	}{
+		{"last minute, ties by key", ByProcess, time.Minute, 0, []string{"/usr/bin/firefox", "/usr/bin/wget"}, []uint64{100, 100}},
+		{"five minutes", ByProcess, 5 * time.Minute, 0, []string{"/usr/bin/curl", "/usr/bin/firefox", "/usr/bin/wget"}, []uint64{500, 100, 100}},
+		{"hour", ByProcess, time.Hour, 0, []string{"/usr/bin/firefox", "/usr/bin/wget", "/usr/bin/curl"}, []uint64{5100, 800, 500}},
+		{"first n", ByProcess, time.Hour, 2, []string{"/usr/bin/firefox", "/usr/bin/wget"}, []uint64{5100, 800}},
+		{"destinations", ByDestination, time.Hour, 0, []string{"example.com", "198.51.100.1"}, []uint64{5600, 800}},
+		{"empty keys left out", ByASN, time.Hour, 0, []string{"AS64500"}, []uint64{500}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := m.top(now, tt.d, tt.window, tt.n)
+			got := names(usage)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Top = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] || usage[i].Bytes() != tt.bytes[i] {
+					t.Errorf("Top[%d] = %s with %d bytes, want %s with %d", i, got[i], usage[i].Bytes(), tt.want[i], tt.bytes[i])
+				}
+			}
+		})
+	}
+	if u := m.top(now, ByProcess, 5*time.Minute, 0)[0]; u.BytesIn != 300 || u.BytesOut != 200 || u.PacketsIn != 0 {
+		t.Errorf("curl traffic = %+v", u.Traffic)
+	}
+
+	// Groups without traffic within the hour are dropped, empty traffic
+	// does not count
+	later := at(2*time.Hour - 25*time.Second)
+	m.expire(later)
+	if got := names(m.top(later, ByProcess, time.Hour, 0)); len(got) != 0 {
+		t.Errorf("Top an hour later = %v, want none", got)
+	}
+	for key, want := range map[string]bool{"/usr/bin/curl": false, "/usr/bin/firefox": false, "/usr/bin/wget": true} {
+		if _, ok := m.series[ByProcess][key]; ok != want {
+			t.Errorf("%s kept = %v, want %v", key, ok, want)
+		}
+	}
+}
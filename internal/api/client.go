@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Client talks to a running daemon over its control socket
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a Client for the socket at path
+func NewClient(path string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://netmonitor/"+Version+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func decodeError(resp *http.Response) error {
+	var apiErr Error
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return fmt.Errorf("daemon returned %s", resp.Status)
+	}
+	return fmt.Errorf("daemon returned %s: %s", resp.Status, apiErr.Error)
+}
+
+func (c *Client) Connections(ctx context.Context) ([]Connection, error) {
+	var conns []Connection
+	err := c.do(ctx, http.MethodGet, "/connections", nil, &conns)
+	return conns, err
+}
+
+// StreamConnections calls fn for every new connection until ctx is done or
+// the daemon closes the stream
+func (c *Client) StreamConnections(ctx context.Context, fn func(ConnectionEvent)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://netmonitor/"+Version+"/connections/stream", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var ev ConnectionEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return fmt.Errorf("invalid event from daemon: %w", err)
+		}
+		fn(ev)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	err := c.do(ctx, http.MethodGet, "/stats", nil, &stats)
+	return &stats, err
+}
+
+func (c *Client) Rules(ctx context.Context) (*RuleList, error) {
+	var list RuleList
+	err := c.do(ctx, http.MethodGet, "/rules", nil, &list)
+	return &list, err
+}
+
+func (c *Client) AddRule(ctx context.Context, req AddRuleRequest) (*Rule, error) {
+	var rule Rule
+	err := c.do(ctx, http.MethodPost, "/rules", req, &rule)
+	return &rule, err
+}
+
+func (c *Client) DeleteRule(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/rules/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *Client) FlushCache(ctx context.Context) (*CacheFlush, error) {
+	var flushed CacheFlush
+	err := c.do(ctx, http.MethodPost, "/cache/flush", nil, &flushed)
+	return &flushed, err
+}
+
+func (c *Client) Prompts(ctx context.Context) ([]Prompt, error) {
+	var prompts []Prompt
+	err := c.do(ctx, http.MethodGet, "/prompts", nil, &prompts)
+	return prompts, err
+}
+
+func (c *Client) AnswerPrompt(ctx context.Context, id string, answer PromptAnswer) error {
+	return c.do(ctx, http.MethodPost, "/prompts/"+url.PathEscape(id), answer, nil)
+}
+
+func (c *Client) Lookup(ctx context.Context, ip string) (*Lookup, error) {
+	var lookup Lookup
+	err := c.do(ctx, http.MethodGet, "/lookup/"+url.PathEscape(ip), nil, &lookup)
+	return &lookup, err
+}
+
+// Traffic returns the top limit groups of by within window; empty values
+// use the defaults of the daemon
+func (c *Client) Traffic(ctx context.Context, by, window string, limit int) (*Traffic, error) {
+	q := url.Values{}
+	if by != "" {
+		q.Set("by", by)
+	}
+	if window != "" {
+		q.Set("window", window)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var traffic Traffic
+	err := c.do(ctx, http.MethodGet, "/traffic?"+q.Encode(), nil, &traffic)
+	return &traffic, err
+}
+
+// History returns the recorded connections matching query, which holds the
+// parameters of GET /v1/history
+func (c *Client) History(ctx context.Context, query url.Values) ([]ConnectionEvent, error) {
+	var events []ConnectionEvent
+	err := c.do(ctx, http.MethodGet, "/history?"+query.Encode(), nil, &events)
+	return events, err
+}
@@ -0,0 +1,475 @@
+// Package api defines the wire format of the control API and a client for it
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/dns"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"github.com/lonelysadness/netmonitor/pkg/utils"
+)
+
+// Version is the prefix of every API path
+const Version = "v1"
+
+// Connection is a connection known to the daemon
+type Connection struct {
+	Key         string    `json:"key"`
+	Protocol    string    `json:"protocol"`
+	Src         string    `json:"src"`
+	SrcPort     uint16    `json:"src_port"`
+	Dst         string    `json:"dst"`
+	Domain      string    `json:"domain,omitempty"`
+	FilterList  string    `json:"filter_list,omitempty"`
+	FilterEntry string    `json:"filter_entry,omitempty"`
+	DstPort     uint16    `json:"dst_port"`
+	Inbound     bool      `json:"inbound"`
+	PID         int       `json:"pid,omitempty"`
+	Process     string    `json:"process,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Cmdline     []string  `json:"cmdline,omitempty"`
+	Started     time.Time `json:"started,omitempty"`
+	Parents     []string  `json:"parents,omitempty"`
+	UID         int       `json:"uid"`
+	GID         int       `json:"gid"`
+	User        string    `json:"user,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	Container   string    `json:"container,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Country     string    `json:"country,omitempty"`
+	Continent   string    `json:"continent,omitempty"`
+	City        string    `json:"city,omitempty"`
+	Scope       string    `json:"scope,omitempty"`
+	Label       string    `json:"label,omitempty"`
+	ASN         uint      `json:"asn,omitempty"`
+	IPLists     []string  `json:"iplists,omitempty"`
+	Verdict     string    `json:"verdict,omitempty"`
+	Expires     time.Time `json:"expires,omitempty"`
+	// The life and traffic of the connection as conntrack reports it,
+	// empty until it does; Sent and Received are seen from this host
+	State           string    `json:"state,omitempty"`
+	Opened          time.Time `json:"opened,omitempty"`
+	Closed          time.Time `json:"closed,omitempty"`
+	BytesSent       uint64    `json:"bytes_sent,omitempty"`
+	BytesReceived   uint64    `json:"bytes_received,omitempty"`
+	PacketsSent     uint64    `json:"packets_sent,omitempty"`
+	PacketsReceived uint64    `json:"packets_received,omitempty"`
+}
+
+// ConnectionEvent is one line of the GET /v1/connections/stream response
+type ConnectionEvent struct {
+	Time       time.Time  `json:"time"`
+	Connection Connection `json:"connection"`
+	Rule       string     `json:"rule,omitempty"`
+	Limited    string     `json:"limited,omitempty"` // why the limit of Rule was exceeded
+}
+
+// QueueStats are the counters of one nfqueue
+type QueueStats struct {
+	Queue            uint16        `json:"queue"`
+	PacketsProcessed uint64        `json:"packets_processed"`
+	PacketsDropped   uint64        `json:"packets_dropped"`
+	ProcessingTime   time.Duration `json:"processing_time_ns"`
+	PendingVerdicts  uint64        `json:"pending_verdicts"`
+}
+
+// AttributionStats are the lookup counters of one attribution backend
+type AttributionStats struct {
+	Backend string `json:"backend"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// EventSinkStats are the connection event counters of one consumer, such as
+// the log, the history or the streams of the API
+type EventSinkStats struct {
+	Sink      string `json:"sink"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// GeoIPStatus tells whether a GeoIP database is in use
+type GeoIPStatus struct {
+	Kind   string    `json:"kind"`
+	Path   string    `json:"path"`
+	Loaded time.Time `json:"loaded,omitempty"` // zero when the database is not in use
+	Error  string    `json:"error,omitempty"`  // last failure to open the file
+}
+
+// Stats is the response of GET /v1/stats
+type Stats struct {
+	Queues      []QueueStats       `json:"queues"`
+	Attribution []AttributionStats `json:"attribution"`
+	GeoIP       []GeoIPStatus      `json:"geoip"`
+	Events      []EventSinkStats   `json:"events"`
+	Connections int                `json:"connections"`
+	Prompts     int                `json:"prompts"`
+}
+
+// Rule is the wire form of a rule; list fields use the same syntax as the
+// policy file
+type Rule struct {
+	Name string `json:"name"`
+	Match
+	HashMismatch string `json:"hash_mismatch,omitempty"` // block (default), prompt or allow
+	// GeoIPUnavailable is unknown (default), match or no-match
+	GeoIPUnavailable string `json:"geoip_unavailable,omitempty"`
+	Except           *Match `json:"except,omitempty"`
+	Limit            *Limit `json:"limit,omitempty"`
+	Verdict          string `json:"verdict"`
+}
+
+// Limit is the wire form of the connection limit of a rule
+type Limit struct {
+	Per            string `json:"per,omitempty"`  // process (default) or destination
+	Rate           string `json:"rate,omitempty"` // such as 10/s, 30/m or 100/h
+	Burst          int    `json:"burst,omitempty"`
+	MaxConnections int    `json:"max_connections,omitempty"`
+	Overflow       string `json:"overflow,omitempty"` // block (default) or drop
+}
+
+// Match is the wire form of the conditions of a rule
+type Match struct {
+	Process     []string `json:"process,omitempty"`
+	Parent      []string `json:"parent,omitempty"`
+	UID         []int    `json:"uid,omitempty"`
+	User        []string `json:"user,omitempty"`
+	Unit        []string `json:"unit,omitempty"`
+	Container   []string `json:"container,omitempty"`
+	SHA256      []string `json:"sha256,omitempty"`
+	Destination []string `json:"destination,omitempty"`
+	Domain      []string `json:"domain,omitempty"`
+	Port        []string `json:"port,omitempty"`
+	Protocol    []string `json:"protocol,omitempty"`
+	Country     []string `json:"country,omitempty"`
+	Continent   []string `json:"continent,omitempty"`
+	ASN         []uint   `json:"asn,omitempty"`
+	Scope       []string `json:"scope,omitempty"`
+	IPList      []string `json:"iplist,omitempty"`
+	Direction   string   `json:"direction,omitempty"`
+}
+
+// RuleList is the response of GET /v1/rules
+type RuleList struct {
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// AddRuleRequest is the body of POST /v1/rules. Added rules are evaluated
+// ahead of the rules of the policy file and survive reloads; Position is
+// the index among them. Without a position the rule is appended to them.
+type AddRuleRequest struct {
+	Rule     Rule `json:"rule"`
+	Position *int `json:"position,omitempty"`
+}
+
+// Prompt is a connection waiting for a decision
+type Prompt struct {
+	ID         string     `json:"id"`
+	Connection Connection `json:"connection"`
+	Created    time.Time  `json:"created"`
+	Deadline   time.Time  `json:"deadline"`
+}
+
+// PromptAnswer is the body of POST /v1/prompts/{id}
+type PromptAnswer struct {
+	Verdict string `json:"verdict"`
+	Scope   string `json:"scope"`
+}
+
+// Lookup is the response of GET /v1/lookup/{ip}
+type Lookup struct {
+	IP        string   `json:"ip"`
+	Country   string   `json:"country"` // empty when unknown
+	Continent string   `json:"continent,omitempty"`
+	EU        bool     `json:"eu,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Scope     string   `json:"scope"`
+	Label     string   `json:"label,omitempty"` // overlay network holding IP
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	ASN       uint     `json:"asn"`
+	Org       string   `json:"org"`
+	Prefix    string   `json:"prefix,omitempty"` // longest listed prefix holding IP
+	IPLists   []string `json:"iplists,omitempty"`
+}
+
+// TrafficUsage is the traffic of one process, destination, country or ASN
+type TrafficUsage struct {
+	Key        string `json:"key"`
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+	PacketsIn  uint64 `json:"packets_in"`
+	PacketsOut uint64 `json:"packets_out"`
+}
+
+// Traffic is the response of GET /v1/traffic: the groups that moved the
+// most bytes within the window, the busiest first
+type Traffic struct {
+	By     string         `json:"by"`
+	Window string         `json:"window"`
+	Usage  []TrafficUsage `json:"usage"`
+}
+
+// CacheFlush is the response of POST /v1/cache/flush
+type CacheFlush struct {
+	Flushed int `json:"flushed"`
+}
+
+// Error is the body of every non-2xx response
+type Error struct {
+	Error string `json:"error"`
+}
+
+// ConnectionFromConn converts a connection into its wire form
+func ConnectionFromConn(key string, c *rules.Conn) Connection {
+	conn := Connection{
+		Key:         key,
+		Protocol:    utils.GetProtocolName(c.Protocol),
+		Src:         c.SrcIP.String(),
+		SrcPort:     c.SrcPort,
+		Dst:         c.DstIP.String(),
+		Domain:      c.Domain,
+		DstPort:     c.DstPort,
+		Inbound:     c.Inbound,
+		PID:         c.PID,
+		Process:     c.ProcessName,
+		Path:        c.ProcessPath,
+		Cmdline:     c.Cmdline,
+		Started:     c.Started,
+		UID:         c.UID,
+		GID:         c.GID,
+		User:        c.User,
+		Unit:        c.Unit,
+		Container:   c.Container,
+		Source:      c.Attribution,
+		Country:     c.Country,
+		Continent:   c.Continent,
+		City:        c.City,
+		Scope:       c.Scope,
+		Label:       c.Label,
+		ASN:         c.ASN,
+		FilterList:  c.FilterList,
+		FilterEntry: c.FilterEntry,
+		IPLists:     c.IPLists,
+	}
+	for _, p := range c.Parents {
+		conn.Parents = append(conn.Parents, p.Path)
+	}
+	return conn
+}
+
+// RuleFromRule converts a rule into its wire form
+func RuleFromRule(r *rules.Rule) Rule {
+	out := Rule{
+		Name:    r.Name,
+		Match:   matchFromMatch(&r.Match),
+		Verdict: r.Verdict.String(),
+	}
+	if len(r.Match.SHA256) > 0 {
+		out.HashMismatch = r.OnHashMismatch.String()
+	}
+	if r.UsesGeoIP() && r.OnGeoIPUnavailable != 0 {
+		out.GeoIPUnavailable = r.OnGeoIPUnavailable.String()
+	}
+	if r.Except != nil {
+		except := matchFromMatch(r.Except)
+		out.Except = &except
+	}
+	if l := r.Limit; l != nil {
+		out.Limit = &Limit{
+			Per:            l.Per.String(),
+			Burst:          l.Burst,
+			MaxConnections: l.MaxConnections,
+			Overflow:       l.Overflow.String(),
+		}
+		if l.Rate.Count > 0 {
+			out.Limit.Rate = l.Rate.String()
+		}
+	}
+	return out
+}
+
+func matchFromMatch(m *rules.Match) Match {
+	out := Match{
+		Process:   m.Processes,
+		Parent:    m.Parents,
+		UID:       m.UIDs,
+		User:      m.Users,
+		Unit:      m.Units,
+		Container: m.Containers,
+		SHA256:    m.SHA256,
+		Domain:    m.Domains,
+		Country:   m.Countries,
+		Continent: m.Continents,
+		ASN:       m.ASNs,
+		Scope:     m.Scopes,
+		IPList:    m.IPLists,
+	}
+	for _, n := range m.Destinations {
+		out.Destination = append(out.Destination, n.String())
+	}
+	for _, p := range m.Ports {
+		out.Port = append(out.Port, p.String())
+	}
+	for _, p := range m.Protocols {
+		name := utils.GetProtocolName(p)
+		if name == "Unknown" {
+			name = strconv.Itoa(int(p))
+		}
+		out.Protocol = append(out.Protocol, strings.ToLower(name))
+	}
+	if m.Direction != rules.AnyDirection {
+		out.Direction = m.Direction.String()
+	}
+	return out
+}
+
+// ToRule validates the wire form and converts it into a rule
+func (r Rule) ToRule() (*rules.Rule, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule needs a name")
+	}
+	verdict, err := rules.ParseVerdict(r.Verdict)
+	if err != nil {
+		return nil, err
+	}
+
+	onMismatch := rules.HashBlock
+	if r.HashMismatch != "" {
+		if onMismatch, err = rules.ParseHashPolicy(r.HashMismatch); err != nil {
+			return nil, err
+		}
+	}
+
+	onGeoIP := rules.GeoIPUnknown
+	if r.GeoIPUnavailable != "" {
+		if onGeoIP, err = rules.ParseGeoIPPolicy(r.GeoIPUnavailable); err != nil {
+			return nil, err
+		}
+	}
+
+	rule := &rules.Rule{
+		Name:               r.Name,
+		Verdict:            verdict,
+		OnHashMismatch:     onMismatch,
+		OnGeoIPUnavailable: onGeoIP,
+	}
+	m, err := r.Match.toMatch()
+	if err != nil {
+		return nil, err
+	}
+	rule.Match = *m
+	if r.Except != nil {
+		if len(r.Except.SHA256) > 0 {
+			return nil, fmt.Errorf("sha256 cannot be used in except")
+		}
+		if rule.Except, err = r.Except.toMatch(); err != nil {
+			return nil, fmt.Errorf("except: %w", err)
+		}
+	}
+	if r.Limit != nil {
+		if rule.Limit, err = r.Limit.toLimit(verdict); err != nil {
+			return nil, fmt.Errorf("limit: %w", err)
+		}
+	}
+	return rule, nil
+}
+
+func (w Limit) toLimit(verdict rules.Verdict) (*rules.Limit, error) {
+	l := &rules.Limit{Burst: w.Burst, MaxConnections: w.MaxConnections}
+	var err error
+	if w.Per != "" {
+		if l.Per, err = rules.ParseLimitKey(w.Per); err != nil {
+			return nil, err
+		}
+	}
+	if w.Rate != "" {
+		if l.Rate, err = rules.ParseRate(w.Rate); err != nil {
+			return nil, err
+		}
+	}
+	if w.Overflow != "" {
+		if l.Overflow, err = rules.ParseVerdict(w.Overflow); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.Validate(verdict); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (w Match) toMatch() (*rules.Match, error) {
+	direction, err := rules.ParseDirection(w.Direction)
+	if err != nil {
+		return nil, err
+	}
+	m := &rules.Match{
+		Processes:  w.Process,
+		Parents:    w.Parent,
+		UIDs:       w.UID,
+		Users:      w.User,
+		Units:      w.Unit,
+		Containers: w.Container,
+		ASNs:       w.ASN,
+		IPLists:    w.IPList,
+		Direction:  direction,
+	}
+	for _, s := range w.Country {
+		c, err := rules.ParseCountry(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Countries = append(m.Countries, c)
+	}
+	for _, s := range w.Continent {
+		c, err := rules.ParseContinent(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Continents = append(m.Continents, c)
+	}
+	for _, s := range w.Scope {
+		scope, err := rules.ParseScope(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Scopes = append(m.Scopes, scope)
+	}
+	for _, d := range w.Domain {
+		m.Domains = append(m.Domains, dns.Normalize(d))
+	}
+	for _, s := range w.SHA256 {
+		h, err := rules.ParseSHA256(s)
+		if err != nil {
+			return nil, err
+		}
+		m.SHA256 = append(m.SHA256, h)
+	}
+	for _, s := range w.Destination {
+		n, err := rules.ParseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Destinations = append(m.Destinations, n)
+	}
+	for _, s := range w.Port {
+		p, err := rules.ParsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Ports = append(m.Ports, p)
+	}
+	for _, s := range w.Protocol {
+		p, err := rules.ParseProtocol(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Protocols = append(m.Protocols, p)
+	}
+	return m, nil
+}
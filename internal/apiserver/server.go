@@ -0,0 +1,486 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/accounting"
+	"github.com/lonelysadness/netmonitor/internal/api"
+	"github.com/lonelysadness/netmonitor/internal/geoip"
+	"github.com/lonelysadness/netmonitor/internal/history"
+	"github.com/lonelysadness/netmonitor/internal/iplist"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/nfqueue"
+	"github.com/lonelysadness/netmonitor/internal/prompt"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"golang.org/x/sys/unix"
+)
+
+// Server exposes the control API on a Unix domain socket that only root
+// can use
+type Server struct {
+	path     string
+	queues   []*nfqueue.Queue
+	prompts  *prompt.Manager
+	geo      *geoip.Resolver
+	history  *history.Store // nil when history is disabled
+	listener net.Listener
+	http     *http.Server
+}
+
+type peerUIDKey struct{}
+
+// NewServer creates a Server listening on the socket at path once started
+func NewServer(path string, queues []*nfqueue.Queue, prompts *prompt.Manager, geo *geoip.Resolver, history *history.Store) *Server {
+	s := &Server{
+		path:    path,
+		queues:  queues,
+		prompts: prompts,
+		geo:     geo,
+		history: history,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/connections", s.handleConnections)
+	mux.HandleFunc("GET /v1/connections/stream", s.handleConnectionStream)
+	mux.HandleFunc("GET /v1/stats", s.handleStats)
+	mux.HandleFunc("GET /v1/rules", s.handleListRules)
+	mux.HandleFunc("POST /v1/rules", s.handleAddRule)
+	mux.HandleFunc("DELETE /v1/rules/{name}", s.handleDeleteRule)
+	mux.HandleFunc("POST /v1/cache/flush", s.handleFlushCache)
+	mux.HandleFunc("GET /v1/prompts", s.handleListPrompts)
+	mux.HandleFunc("POST /v1/prompts/{id}", s.handleAnswerPrompt)
+	mux.HandleFunc("GET /v1/lookup/{ip}", s.handleLookup)
+	mux.HandleFunc("GET /v1/traffic", s.handleTraffic)
+	mux.HandleFunc("GET /v1/history", s.handleHistory)
+
+	s.http = &http.Server{
+		Handler:     requireRoot(mux),
+		ConnContext: withPeerUID,
+	}
+	return s
+}
+
+// Start creates the socket and serves requests in the background
+func (s *Server) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	// Remove a socket left behind by a previous run
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	ln, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.path, err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+	s.listener = ln
+
+	go func() {
+		if err := s.http.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log.Error("api: server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops the server and removes the socket
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := s.http.Shutdown(ctx)
+	os.Remove(s.path)
+	return err
+}
+
+// withPeerUID records the UID of the connecting process
+func withPeerUID(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerUIDKey{}, cred.Uid)
+}
+
+// requireRoot rejects clients that are not running as root, on top of the
+// socket permissions
+func requireRoot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := r.Context().Value(peerUIDKey{}).(uint32)
+		if !ok || uid != 0 {
+			writeError(w, http.StatusForbidden, errors.New("only root may use the control socket"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Log.Warn("api: failed to write response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, api.Error{Error: err.Error()})
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	conns := nfqueue.Connections()
+	out := make([]api.Connection, 0, len(conns))
+	for _, c := range conns {
+		conn := api.ConnectionFromConn(c.Key, c.Conn)
+		conn.Verdict = c.Verdict.String()
+		conn.Expires = c.Expires
+		if f := c.Flow; f != nil {
+			conn.State, conn.Opened, conn.Closed = f.State, f.Opened, f.Closed
+			conn.BytesSent, conn.BytesReceived = f.Sent.Bytes, f.Received.Bytes
+			conn.PacketsSent, conn.PacketsReceived = f.Sent.Packets, f.Received.Packets
+		}
+		out = append(out, conn)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	writeJSON(w, http.StatusOK, out)
+}
+
+// ConnectionEvent converts ev into its wire form
+func ConnectionEvent(ev nfqueue.Event) api.ConnectionEvent {
+	conn := api.ConnectionFromConn(ev.Key, ev.Conn)
+	conn.Verdict = ev.Verdict.String()
+	return api.ConnectionEvent{Time: ev.Time, Connection: conn, Rule: ev.Rule, Limited: ev.Limited}
+}
+
+// handleConnectionStream writes one JSON object per line for every new
+// connection until the client goes away
+func (s *Server) handleConnectionStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	events, unsubscribe := nfqueue.Subscribe("stream")
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(ConnectionEvent(ev)); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := api.Stats{
+		Connections: len(nfqueue.Connections()),
+		Prompts:     len(s.prompts.Pending()),
+	}
+	for _, q := range s.queues {
+		snap := q.Stats()
+		stats.Queues = append(stats.Queues, api.QueueStats{
+			Queue:            snap.QueueID,
+			PacketsProcessed: snap.PacketsProcessed,
+			PacketsDropped:   snap.PacketsDropped,
+			ProcessingTime:   snap.ProcessingTime,
+			PendingVerdicts:  snap.PendingVerdicts,
+		})
+	}
+	for _, e := range nfqueue.EventStats() {
+		stats.Events = append(stats.Events, api.EventSinkStats{Sink: e.Name, Delivered: e.Delivered, Dropped: e.Dropped})
+	}
+	for _, b := range nfqueue.AttributionStats() {
+		stats.Attribution = append(stats.Attribution, api.AttributionStats{
+			Backend: b.Name,
+			Hits:    b.Hits,
+			Misses:  b.Misses,
+		})
+	}
+	for _, g := range s.geo.Status() {
+		status := api.GeoIPStatus{
+			Kind:   g.Kind.String(),
+			Path:   g.Path,
+			Loaded: g.Loaded,
+		}
+		if g.Error != nil {
+			status.Error = g.Error.Error()
+		}
+		stats.GeoIP = append(stats.GeoIP, status)
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) handleListRules(w http.ResponseWriter, r *http.Request) {
+	rs := nfqueue.Rules()
+	list := api.RuleList{
+		Default: rs.Default().String(),
+		Rules:   make([]api.Rule, 0, len(rs.Rules())),
+	}
+	for _, rule := range rs.Rules() {
+		list.Rules = append(list.Rules, api.RuleFromRule(rule))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleAddRule(w http.ResponseWriter, r *http.Request) {
+	var req api.AddRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	rule, err := req.Rule.ToRule()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	names := rule.Match.IPLists
+	if rule.Except != nil {
+		names = append(slices.Clone(names), rule.Except.IPLists...)
+	}
+	for _, name := range names {
+		if !iplist.Has(name) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown IP list %q", name))
+			return
+		}
+	}
+
+	position := -1
+	if req.Position != nil {
+		position = *req.Position
+	}
+	if err := nfqueue.InsertRule(position, rule); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	logger.Log.Info("api: added rule", "rule", rule.Name)
+	writeJSON(w, http.StatusCreated, api.RuleFromRule(rule))
+}
+
+func (s *Server) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !nfqueue.DeleteRule(name) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no rule named %q", name))
+		return
+	}
+	logger.Log.Info("api: deleted rule", "rule", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleFlushCache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.CacheFlush{Flushed: nfqueue.FlushCache()})
+}
+
+func (s *Server) handleListPrompts(w http.ResponseWriter, r *http.Request) {
+	pending := s.prompts.Pending()
+	out := make([]api.Prompt, 0, len(pending))
+	for _, req := range pending {
+		out = append(out, api.Prompt{
+			ID:         req.ID,
+			Connection: api.ConnectionFromConn("", req.Conn),
+			Created:    req.Created,
+			Deadline:   req.Deadline,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) handleAnswerPrompt(w http.ResponseWriter, r *http.Request) {
+	var answer api.PromptAnswer
+	if err := json.NewDecoder(r.Body).Decode(&answer); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	verdict, err := rules.ParseVerdict(answer.Verdict)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	scope, err := prompt.ParseScope(answer.Scope)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.prompts.Answer(r.PathValue("id"), prompt.Decision{Verdict: verdict, Scope: scope})
+	switch {
+	case errors.Is(err, prompt.ErrNotPending):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid IP address %q", r.PathValue("ip")))
+		return
+	}
+	record := s.geo.Lookup(ip)
+	lookup := api.Lookup{
+		IP:        ip.String(),
+		Country:   record.Country,
+		Continent: record.Continent,
+		EU:        record.EU,
+		City:      record.City,
+		Scope:     record.Scope,
+		Label:     record.Label,
+		ASN:       record.ASN,
+		Org:       record.Org,
+	}
+	if record.Latitude != 0 || record.Longitude != 0 {
+		lookup.Latitude, lookup.Longitude = &record.Latitude, &record.Longitude
+	}
+	if m, ok := iplist.Lookup(ip); ok {
+		lookup.Prefix = m.Prefix.String()
+		lookup.IPLists = m.Lists
+	}
+	writeJSON(w, http.StatusOK, lookup)
+}
+
+// handleTraffic returns the busiest groups of the by query parameter
+// (process by default) within window (1m by default), at most limit of them
+func (s *Server) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	by, window, limit := accounting.ByProcess, time.Minute, 0
+	var err error
+	if v := query.Get("by"); v != "" {
+		if by, err = accounting.ParseDimension(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := query.Get("window"); v != "" {
+		if window, err = accounting.ParseWindow(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+	}
+
+	usage := nfqueue.Traffic().Top(by, window, limit)
+	out := api.Traffic{
+		By:     by.String(),
+		Window: accounting.FormatWindow(window),
+		Usage:  make([]api.TrafficUsage, 0, len(usage)),
+	}
+	for _, u := range usage {
+		out.Usage = append(out.Usage, api.TrafficUsage{
+			Key:        u.Key,
+			BytesIn:    u.BytesIn,
+			BytesOut:   u.BytesOut,
+			PacketsIn:  u.PacketsIn,
+			PacketsOut: u.PacketsOut,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleHistory returns the recorded connections matching the query
+// parameters, the oldest first. since and until are RFC 3339 times or
+// durations before now; limit keeps the latest events, 1000 by default and
+// all of them when 0.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if s.history == nil {
+		writeError(w, http.StatusNotFound, errors.New("connection history is disabled"))
+		return
+	}
+	query := r.URL.Query()
+	q := history.Query{
+		Process:     query.Get("process"),
+		Destination: query.Get("destination"),
+		Country:     query.Get("country"),
+		Verdict:     query.Get("verdict"),
+		Limit:       1000,
+	}
+	var err error
+	if q.Since, err = parseTime(query.Get("since")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.Until, err = parseTime(query.Get("until")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+	}
+
+	events, err := s.history.Query(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if events == nil {
+		events = []api.ConnectionEvent{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// parseTime reads an RFC 3339 time or a duration before now; empty is the
+// zero time
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or a duration such as 1h", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,1038 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/lonelysadness/netmonitor/internal/dns"
+	"github.com/lonelysadness/netmonitor/internal/iplist"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+)
+
+// Config is the typed form of a netmonitor policy file
+type Config struct {
+	Queue   QueueConfig
+	GeoIP   GeoIPConfig
+	Cache   CacheConfig
+	Logging LoggingConfig
+	Prompt  PromptConfig
+	API     APIConfig
+	DNS     DNSConfig
+	IPLists IPListsConfig
+	History HistoryConfig
+	Rules   RulesConfig
+}
+
+type QueueConfig struct {
+	IPv4 uint16
+	IPv6 uint16
+}
+
+// GeoIPConfig names the GeoIP databases, MaxMind or DB-IP mmdb files or
+// DB-IP and IP2Location lite CSV files. City replaces Country when set.
+type GeoIPConfig struct {
+	Country string
+	City    string
+	ASN     string
+	// Overlay labels local networks; see the example policy for its format
+	Overlay string
+}
+
+type CacheConfig struct {
+	Duration time.Duration
+}
+
+// LoggingConfig controls the diagnostics log in File and the connection
+// log in Connections. Files are rotated once larger than MaxSize bytes or
+// older than MaxAge; rotated files beyond MaxBackups or older than MaxAge
+// are deleted. One in Sample connections is logged, and printed to the
+// terminal with Terminal.
+type LoggingConfig struct {
+	File        string
+	Connections string
+	Format      logger.Format
+	Level       slog.Level
+	Mode        os.FileMode
+	MaxSize     int64
+	MaxAge      time.Duration
+	MaxBackups  int
+	Compress    bool
+	Terminal    bool
+	Sample      int
+}
+
+// PromptConfig controls connections with the prompt verdict
+type PromptConfig struct {
+	Timeout  time.Duration
+	Fallback rules.Verdict
+}
+
+// APIConfig controls the local control API; an empty socket disables it
+type APIConfig struct {
+	Socket string
+}
+
+// DNSConfig controls how name resolution is followed. RedirectPort sends
+// queries to remote nameservers to a local resolver on that port; zero
+// leaves them alone. With Upstreams set, netmonitor runs that resolver
+// itself and forwards to them. Blocked domains are refused by the resolver
+// and connections to addresses resolved from them are blocked.
+type DNSConfig struct {
+	Observe       bool
+	RedirectPort  uint16
+	Upstreams     []string // host:port, tried in order
+	Block         []string // domains that are blocked, with subdomains
+	Lists         []string // filter list files adding to Block
+	BlockResponse dns.BlockResponse
+}
+
+// IPListsConfig holds the IP lists rules can refer to by name. The files
+// are checked for changes every Reload.
+type IPListsConfig struct {
+	Reload time.Duration
+	Lists  []iplist.Source
+}
+
+// HistoryConfig controls the connection history kept in Dir; an empty
+// directory disables it. History older than MaxAge or beyond MaxSize bytes
+// is deleted.
+type HistoryConfig struct {
+	Dir     string
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+type RulesConfig struct {
+	Default rules.Verdict
+	// HashMismatch is the policy of rules with pinned hashes that do not
+	// set their own
+	HashMismatch rules.HashPolicy
+	// GeoIPUnavailable is how country, continent and ASN conditions
+	// evaluate while their GeoIP database is not loaded
+	GeoIPUnavailable rules.GeoIPPolicy
+	Rules            []*rules.Rule
+}
+
+// Error is a problem found in a policy file, located by line
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// Default returns the configuration netmonitor uses without a policy file
+func Default() *Config {
+	return &Config{
+		Queue: QueueConfig{
+			IPv4: 17040,
+			IPv6: 17060,
+		},
+		GeoIP: GeoIPConfig{
+			Country: "data/GeoLite2-Country.mmdb",
+			ASN:     "data/GeoLite2-ASN.mmdb",
+		},
+		Cache: CacheConfig{
+			Duration: 5 * time.Minute,
+		},
+		Logging: LoggingConfig{
+			File:        "/var/log/netmonitor/netmonitor.log",
+			Connections: "/var/log/netmonitor/connections.log",
+			Format:      logger.FormatLogfmt,
+			Level:       slog.LevelInfo,
+			Mode:        0640,
+			MaxSize:     100 << 20,
+			MaxAge:      30 * 24 * time.Hour,
+			MaxBackups:  5,
+			Compress:    true,
+			Terminal:    true,
+			Sample:      1,
+		},
+		Prompt: PromptConfig{
+			Timeout:  time.Minute,
+			Fallback: rules.Block,
+		},
+		API: APIConfig{
+			Socket: "/run/netmonitor/netmonitor.sock",
+		},
+		DNS: DNSConfig{
+			Observe:       true,
+			BlockResponse: dns.BlockNXDomain,
+		},
+		IPLists: IPListsConfig{
+			Reload: 15 * time.Minute,
+		},
+		History: HistoryConfig{
+			Dir:     "/var/lib/netmonitor/history",
+			MaxAge:  30 * 24 * time.Hour,
+			MaxSize: 1 << 30,
+		},
+		Rules: RulesConfig{
+			Default:          rules.AcceptAlways,
+			HashMismatch:     rules.HashBlock,
+			GeoIPUnavailable: rules.GeoIPUnknown,
+		},
+	}
+}
+
+// Load reads and validates the policy file at path. All problems found are
+// returned together, each pointing to the offending line.
+func Load(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, string(content))
+}
+
+// Parse validates src as a policy file; name is only used in error messages
+func Parse(name, src string) (*Config, error) {
+	doc, err := parse(src)
+	if err != nil {
+		if cfgErr, ok := err.(*Error); ok {
+			cfgErr.File = name
+		}
+		return nil, err
+	}
+
+	d := &decoder{file: name}
+	cfg := Default()
+	for _, t := range doc.tables {
+		switch {
+		case t.name == "" && !t.array:
+			for _, e := range t.entries {
+				d.errorf(e.line, "key %q must be inside a table", e.key)
+			}
+		case t.name == "queue" && !t.array:
+			d.decodeQueue(t, &cfg.Queue)
+		case t.name == "geoip" && !t.array:
+			d.decodeGeoIP(t, &cfg.GeoIP)
+		case t.name == "cache" && !t.array:
+			d.decodeCache(t, &cfg.Cache)
+		case t.name == "logging" && !t.array:
+			d.decodeLogging(t, &cfg.Logging)
+		case t.name == "prompt" && !t.array:
+			d.decodePrompt(t, &cfg.Prompt)
+		case t.name == "api" && !t.array:
+			d.decodeAPI(t, &cfg.API)
+		case t.name == "dns" && !t.array:
+			d.decodeDNS(t, &cfg.DNS)
+		case t.name == "iplists" && !t.array:
+			d.decodeIPListsDefaults(t, &cfg.IPLists)
+		case t.name == "iplist" && t.array:
+			if src, ok := d.decodeIPList(t, cfg.IPLists.Lists); ok {
+				cfg.IPLists.Lists = append(cfg.IPLists.Lists, src)
+			}
+		case t.name == "history" && !t.array:
+			d.decodeHistory(t, &cfg.History)
+		case t.name == "rules" && !t.array:
+			d.decodeRulesDefaults(t, &cfg.Rules)
+		case t.name == "rule" && t.array:
+			if rule := d.decodeRule(t); rule != nil {
+				cfg.Rules.Rules = append(cfg.Rules.Rules, rule)
+			}
+		case t.name == "rule.except" && !t.array:
+			d.decodeExcept(t)
+		default:
+			d.errorf(t.line, "unknown table %s", tableName(t))
+		}
+	}
+
+	for _, rule := range cfg.Rules.Rules {
+		if rule.OnHashMismatch == 0 {
+			rule.OnHashMismatch = cfg.Rules.HashMismatch
+		}
+		if rule.OnGeoIPUnavailable == 0 {
+			rule.OnGeoIPUnavailable = cfg.Rules.GeoIPUnavailable
+		}
+	}
+	d.checkConflicts()
+	d.checkIPLists(cfg.IPLists.Lists)
+
+	if cfg.Queue.IPv4 == cfg.Queue.IPv6 {
+		d.errorf(d.queueLine, "queue numbers for IPv4 and IPv6 must differ, both are %d", cfg.Queue.IPv4)
+	}
+
+	if d.errs != nil {
+		return nil, d.errs
+	}
+	return cfg, nil
+}
+
+// RuleSet builds the rule set described by the configuration
+func (c *Config) RuleSet() *rules.RuleSet {
+	return rules.NewRuleSet(c.Rules.Default, c.Rules.Rules...)
+}
+
+func tableName(t *table) string {
+	if t.array {
+		return "[[" + t.name + "]]"
+	}
+	return "[" + t.name + "]"
+}
+
+type decoder struct {
+	file      string
+	errs      *multierror.Error
+	queueLine int
+	ruleLines []ruleLine
+	rule      *rules.Rule // last valid rule, for its except table
+	sawRule   bool
+}
+
+type ruleLine struct {
+	rule *rules.Rule
+	line int
+}
+
+func (d *decoder) errorf(line int, format string, args ...interface{}) {
+	d.errs = multierror.Append(d.errs, &Error{File: d.file, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (d *decoder) unknownKey(t *table, e entry) {
+	d.errorf(e.line, "unknown key %q in %s", e.key, tableName(t))
+}
+
+func (d *decoder) expect(v value, k kind) bool {
+	if v.kind != k {
+		d.errorf(v.line, "expected %s, found %s", kindNames[k], kindNames[v.kind])
+		return false
+	}
+	return true
+}
+
+func (d *decoder) str(v value) string {
+	if !d.expect(v, kindString) {
+		return ""
+	}
+	return v.str
+}
+
+func (d *decoder) port(v value) uint16 {
+	if !d.expect(v, kindInt) {
+		return 0
+	}
+	if v.num < 0 || v.num > 65535 {
+		d.errorf(v.line, "%d is out of range 0-65535", v.num)
+		return 0
+	}
+	return uint16(v.num)
+}
+
+func (d *decoder) duration(v value) time.Duration {
+	s := d.str(v)
+	if s == "" {
+		return 0
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		d.errorf(v.line, "invalid duration %q", s)
+		return 0
+	}
+	if dur <= 0 {
+		d.errorf(v.line, "duration must be positive, found %s", s)
+	}
+	return dur
+}
+
+// size reads a number of bytes, given as an integer or a string with a KB,
+// MB or GB suffix
+func (d *decoder) size(v value) int64 {
+	if v.kind == kindInt {
+		if v.num <= 0 {
+			d.errorf(v.line, "size must be positive, found %d", v.num)
+			return 0
+		}
+		return v.num
+	}
+	s := strings.ToUpper(strings.TrimSpace(d.str(v)))
+	if s == "" {
+		return 0
+	}
+	unit := int64(1)
+	for suffix, u := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, suffix)), u
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		d.errorf(v.line, "invalid size %q, expected a positive number of bytes, KB, MB or GB", v.str)
+		return 0
+	}
+	return n * unit
+}
+
+func (d *decoder) verdict(v value) rules.Verdict {
+	s := d.str(v)
+	if s == "" {
+		return 0
+	}
+	verdict, err := rules.ParseVerdict(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return verdict
+}
+
+func (d *decoder) hashPolicy(v value) rules.HashPolicy {
+	s := d.str(v)
+	if s == "" {
+		return 0
+	}
+	p, err := rules.ParseHashPolicy(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return p
+}
+
+func (d *decoder) geoIPPolicy(v value) rules.GeoIPPolicy {
+	s := d.str(v)
+	if s == "" {
+		return 0
+	}
+	p, err := rules.ParseGeoIPPolicy(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return p
+}
+
+func (d *decoder) sha256(v value) string {
+	s := d.str(v)
+	if s == "" {
+		return ""
+	}
+	h, err := rules.ParseSHA256(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return h
+}
+
+func (d *decoder) country(v value) string {
+	s := d.str(v)
+	if s == "" {
+		return ""
+	}
+	c, err := rules.ParseCountry(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return c
+}
+
+func (d *decoder) scope(v value) string {
+	s := d.str(v)
+	if s == "" {
+		return ""
+	}
+	scope, err := rules.ParseScope(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return scope
+}
+
+func (d *decoder) continent(v value) string {
+	s := d.str(v)
+	if s == "" {
+		return ""
+	}
+	c, err := rules.ParseContinent(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return c
+}
+
+// list returns the elements of an array value, treating a scalar as a
+// single element list
+func (d *decoder) list(v value) []value {
+	if v.kind == kindArray {
+		return v.arr
+	}
+	return []value{v}
+}
+
+func (d *decoder) decodeQueue(t *table, q *QueueConfig) {
+	d.queueLine = t.line
+	for _, e := range t.entries {
+		switch e.key {
+		case "ipv4":
+			q.IPv4 = d.port(e.val)
+		case "ipv6":
+			q.IPv6 = d.port(e.val)
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeGeoIP(t *table, g *GeoIPConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "country":
+			g.Country = d.str(e.val)
+		case "city":
+			g.City = d.str(e.val)
+		case "overlay":
+			g.Overlay = d.str(e.val)
+		case "asn":
+			g.ASN = d.str(e.val)
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeCache(t *table, c *CacheConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "duration":
+			c.Duration = d.duration(e.val)
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeLogging(t *table, l *LoggingConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "file":
+			l.File = d.str(e.val)
+		case "connections":
+			l.Connections = d.str(e.val)
+		case "format":
+			if s := d.str(e.val); s != "" {
+				f, err := logger.ParseFormat(s)
+				if err != nil {
+					d.errorf(e.line, "%v", err)
+				} else {
+					l.Format = f
+				}
+			}
+		case "level":
+			if s := d.str(e.val); s != "" {
+				if err := l.Level.UnmarshalText([]byte(s)); err != nil {
+					d.errorf(e.line, "unknown log level %q, expected debug, info, warn or error", s)
+				}
+			}
+		case "mode":
+			if s := d.str(e.val); s != "" {
+				mode, err := strconv.ParseUint(s, 8, 32)
+				if err != nil || mode > 0777 {
+					d.errorf(e.line, "invalid file mode %q, expected octal permissions such as 0640", s)
+				} else {
+					l.Mode = os.FileMode(mode)
+				}
+			}
+		case "max_size":
+			l.MaxSize = d.size(e.val)
+		case "max_age":
+			l.MaxAge = d.duration(e.val)
+		case "max_backups":
+			if d.expect(e.val, kindInt) {
+				if e.val.num < 0 {
+					d.errorf(e.line, "max_backups cannot be negative")
+				}
+				l.MaxBackups = int(e.val.num)
+			}
+		case "compress":
+			if d.expect(e.val, kindBool) {
+				l.Compress = e.val.b
+			}
+		case "terminal":
+			if d.expect(e.val, kindBool) {
+				l.Terminal = e.val.b
+			}
+		case "sample":
+			if d.expect(e.val, kindInt) {
+				if e.val.num < 1 {
+					d.errorf(e.line, "sample must be at least 1")
+				}
+				l.Sample = int(e.val.num)
+			}
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodePrompt(t *table, p *PromptConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "timeout":
+			p.Timeout = d.duration(e.val)
+		case "fallback":
+			v := d.verdict(e.val)
+			if v == rules.Prompt {
+				d.errorf(e.line, "fallback verdict cannot be prompt")
+			} else if v != 0 {
+				p.Fallback = v
+			}
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeAPI(t *table, a *APIConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "socket":
+			a.Socket = d.str(e.val)
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeDNS(t *table, c *DNSConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "observe":
+			if d.expect(e.val, kindBool) {
+				c.Observe = e.val.b
+			}
+		case "redirect_port":
+			c.RedirectPort = d.port(e.val)
+		case "upstreams":
+			for _, v := range d.list(e.val) {
+				if s := d.str(v); s != "" {
+					upstream, err := dns.ParseUpstream(s)
+					if err != nil {
+						d.errorf(v.line, "%v", err)
+						continue
+					}
+					c.Upstreams = append(c.Upstreams, upstream)
+				}
+			}
+		case "block":
+			for _, v := range d.list(e.val) {
+				if s := d.str(v); s != "" {
+					c.Block = append(c.Block, dns.Normalize(s))
+				}
+			}
+		case "lists":
+			for _, v := range d.list(e.val) {
+				if s := d.str(v); s != "" {
+					c.Lists = append(c.Lists, s)
+				}
+			}
+		case "block_response":
+			if s := d.str(e.val); s != "" {
+				b, err := dns.ParseBlockResponse(s)
+				if err != nil {
+					d.errorf(e.line, "%v", err)
+				} else {
+					c.BlockResponse = b
+				}
+			}
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+	if len(c.Upstreams) > 0 && c.RedirectPort == 0 {
+		d.errorf(t.line, "upstreams need redirect_port, the port the resolver listens on")
+	}
+}
+
+func (d *decoder) decodeIPListsDefaults(t *table, c *IPListsConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "reload":
+			c.Reload = d.duration(e.val)
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeIPList(t *table, defined []iplist.Source) (iplist.Source, bool) {
+	var src iplist.Source
+	for _, e := range t.entries {
+		switch e.key {
+		case "name":
+			src.Name = d.str(e.val)
+		case "path":
+			src.Path = d.str(e.val)
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+	if src.Name == "" || src.Path == "" {
+		d.errorf(t.line, "IP list needs a name and a path")
+		return src, false
+	}
+	for _, prev := range defined {
+		if prev.Name == src.Name {
+			d.errorf(t.line, "IP list name %q already used", src.Name)
+			return src, false
+		}
+	}
+	return src, true
+}
+
+// checkIPLists reports rules referring to IP lists that are not defined
+func (d *decoder) checkIPLists(lists []iplist.Source) {
+	for _, rl := range d.ruleLines {
+		names := rl.rule.Match.IPLists
+		if rl.rule.Except != nil {
+			names = append(slices.Clip(names), rl.rule.Except.IPLists...)
+		}
+		for _, name := range names {
+			if !slices.ContainsFunc(lists, func(src iplist.Source) bool { return src.Name == name }) {
+				d.errorf(rl.line, "rule %q refers to unknown IP list %q", rl.rule.Name, name)
+			}
+		}
+	}
+}
+
+func (d *decoder) decodeHistory(t *table, h *HistoryConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "dir":
+			h.Dir = d.str(e.val)
+		case "max_age":
+			h.MaxAge = d.duration(e.val)
+		case "max_size":
+			h.MaxSize = d.size(e.val)
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeRulesDefaults(t *table, r *RulesConfig) {
+	for _, e := range t.entries {
+		switch e.key {
+		case "default":
+			if v := d.verdict(e.val); v != 0 {
+				r.Default = v
+			}
+		case "hash_mismatch":
+			if p := d.hashPolicy(e.val); p != 0 {
+				r.HashMismatch = p
+			}
+		case "geoip_unavailable":
+			if p := d.geoIPPolicy(e.val); p != 0 {
+				r.GeoIPUnavailable = p
+			}
+		default:
+			d.unknownKey(t, e)
+		}
+	}
+}
+
+func (d *decoder) decodeRule(t *table) *rules.Rule {
+	d.sawRule = true
+	d.rule = nil
+	rule := &rules.Rule{Name: fmt.Sprintf("rule@%d", t.line)}
+	for _, e := range t.entries {
+		switch e.key {
+		case "name":
+			rule.Name = d.str(e.val)
+		case "verdict":
+			rule.Verdict = d.verdict(e.val)
+		case "hash_mismatch":
+			rule.OnHashMismatch = d.hashPolicy(e.val)
+		case "geoip_unavailable":
+			rule.OnGeoIPUnavailable = d.geoIPPolicy(e.val)
+		case "rate", "burst", "max_connections", "per", "overflow":
+			if rule.Limit == nil {
+				rule.Limit = &rules.Limit{}
+			}
+			d.decodeLimit(rule.Limit, e)
+		default:
+			if !d.decodeMatch(&rule.Match, e) {
+				d.unknownKey(t, e)
+			}
+		}
+	}
+
+	if rule.Verdict == 0 {
+		d.errorf(t.line, "rule %q has no verdict", rule.Name)
+		return nil
+	}
+	if rule.Limit != nil {
+		if err := rule.Limit.Validate(rule.Verdict); err != nil {
+			d.errorf(t.line, "rule %q: %v", rule.Name, err)
+			return nil
+		}
+	}
+	for _, prev := range d.ruleLines {
+		if prev.rule.Name == rule.Name {
+			d.errorf(t.line, "rule name %q already used at line %d", rule.Name, prev.line)
+		}
+	}
+	d.rule = rule
+	d.ruleLines = append(d.ruleLines, ruleLine{rule: rule, line: t.line})
+	return rule
+}
+
+// decodeLimit decodes a key of the connection limit of a rule
+func (d *decoder) decodeLimit(l *rules.Limit, e entry) {
+	switch e.key {
+	case "rate":
+		if s := d.str(e.val); s != "" {
+			rate, err := rules.ParseRate(s)
+			if err != nil {
+				d.errorf(e.line, "%v", err)
+			}
+			l.Rate = rate
+		}
+	case "burst":
+		if d.expect(e.val, kindInt) {
+			l.Burst = int(e.val.num)
+		}
+	case "max_connections":
+		if d.expect(e.val, kindInt) {
+			l.MaxConnections = int(e.val.num)
+		}
+	case "per":
+		if s := d.str(e.val); s != "" {
+			per, err := rules.ParseLimitKey(s)
+			if err != nil {
+				d.errorf(e.line, "%v", err)
+			}
+			l.Per = per
+		}
+	case "overflow":
+		l.Overflow = d.verdict(e.val)
+	}
+}
+
+// decodeExcept attaches a [rule.except] table to the rule before it
+func (d *decoder) decodeExcept(t *table) {
+	if !d.sawRule {
+		d.errorf(t.line, "%s must follow a [[rule]]", tableName(t))
+		return
+	}
+	if d.rule == nil {
+		// The rule was invalid and has been reported
+		return
+	}
+
+	except := &rules.Match{}
+	for _, e := range t.entries {
+		switch e.key {
+		case "sha256":
+			d.errorf(e.line, "sha256 cannot be used in %s", tableName(t))
+		default:
+			if !d.decodeMatch(except, e) {
+				d.unknownKey(t, e)
+			}
+		}
+	}
+	if reflect.DeepEqual(*except, rules.Match{}) {
+		d.errorf(t.line, "%s of rule %q is empty and would exempt every connection", tableName(t), d.rule.Name)
+		return
+	}
+	d.rule.Except = except
+}
+
+// decodeMatch decodes a key shared by rules and their except tables. It
+// returns false when the key is not a match condition.
+func (d *decoder) decodeMatch(m *rules.Match, e entry) bool {
+	switch e.key {
+	case "process":
+		for _, v := range d.list(e.val) {
+			if s := d.str(v); s != "" {
+				m.Processes = append(m.Processes, s)
+			}
+		}
+	case "parent":
+		for _, v := range d.list(e.val) {
+			if s := d.str(v); s != "" {
+				m.Parents = append(m.Parents, s)
+			}
+		}
+	case "user":
+		for _, v := range d.list(e.val) {
+			if s := d.str(v); s != "" {
+				m.Users = append(m.Users, s)
+			}
+		}
+	case "unit":
+		for _, v := range d.list(e.val) {
+			if s := d.str(v); s != "" {
+				m.Units = append(m.Units, s)
+			}
+		}
+	case "container":
+		for _, v := range d.list(e.val) {
+			if s := d.str(v); s != "" {
+				m.Containers = append(m.Containers, s)
+			}
+		}
+	case "domain":
+		for _, v := range d.list(e.val) {
+			if s := d.str(v); s != "" {
+				m.Domains = append(m.Domains, dns.Normalize(s))
+			}
+		}
+	case "sha256":
+		for _, v := range d.list(e.val) {
+			if h := d.sha256(v); h != "" {
+				m.SHA256 = append(m.SHA256, h)
+			}
+		}
+	case "uid":
+		for _, v := range d.list(e.val) {
+			if d.expect(v, kindInt) {
+				// (uid_t)-1 means no user to the kernel
+				if v.num < 0 || v.num >= math.MaxUint32 {
+					d.errorf(v.line, "uid %d out of range", v.num)
+					continue
+				}
+				m.UIDs = append(m.UIDs, int(v.num))
+			}
+		}
+	case "destination":
+		for _, v := range d.list(e.val) {
+			if n := d.network(v); n != nil {
+				m.Destinations = append(m.Destinations, n)
+			}
+		}
+	case "port":
+		for _, v := range d.list(e.val) {
+			if r, ok := d.portRange(v); ok {
+				m.Ports = append(m.Ports, r)
+			}
+		}
+	case "protocol":
+		for _, v := range d.list(e.val) {
+			if p, ok := d.protocol(v); ok {
+				m.Protocols = append(m.Protocols, p)
+			}
+		}
+	case "country":
+		for _, v := range d.list(e.val) {
+			if c := d.country(v); c != "" {
+				m.Countries = append(m.Countries, c)
+			}
+		}
+	case "scope":
+		for _, v := range d.list(e.val) {
+			if s := d.scope(v); s != "" {
+				m.Scopes = append(m.Scopes, s)
+			}
+		}
+	case "continent":
+		for _, v := range d.list(e.val) {
+			if c := d.continent(v); c != "" {
+				m.Continents = append(m.Continents, c)
+			}
+		}
+	case "asn":
+		for _, v := range d.list(e.val) {
+			if d.expect(v, kindInt) {
+				if v.num < 0 || v.num > math.MaxUint32 {
+					d.errorf(v.line, "asn %d out of range", v.num)
+					continue
+				}
+				m.ASNs = append(m.ASNs, uint(v.num))
+			}
+		}
+	case "iplist":
+		for _, v := range d.list(e.val) {
+			if s := d.str(v); s != "" {
+				m.IPLists = append(m.IPLists, s)
+			}
+		}
+	case "direction":
+		dir, err := rules.ParseDirection(d.str(e.val))
+		if err != nil {
+			d.errorf(e.line, "%v", err)
+		}
+		m.Direction = dir
+	default:
+		return false
+	}
+	return true
+}
+
+// checkConflicts reports rules whose conditions are identical to an earlier
+// rule with a different verdict, as the later rule could never apply
+func (d *decoder) checkConflicts() {
+	for i, rl := range d.ruleLines {
+		for _, prev := range d.ruleLines[:i] {
+			if reflect.DeepEqual(prev.rule.Match, rl.rule.Match) && reflect.DeepEqual(prev.rule.Except, rl.rule.Except) &&
+				prev.rule.Verdict != rl.rule.Verdict {
+				d.errorf(rl.line, "rule %q conflicts with rule %q at line %d: same match, verdict %s instead of %s",
+					rl.rule.Name, prev.rule.Name, prev.line, rl.rule.Verdict, prev.rule.Verdict)
+			}
+		}
+	}
+}
+
+func (d *decoder) network(v value) *net.IPNet {
+	s := d.str(v)
+	if s == "" {
+		return nil
+	}
+	n, err := rules.ParseNetwork(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+	}
+	return n
+}
+
+func (d *decoder) portRange(v value) (rules.PortRange, bool) {
+	if v.kind == kindInt {
+		p := d.port(v)
+		return rules.PortRange{From: p, To: p}, true
+	}
+
+	s := d.str(v)
+	if s == "" {
+		return rules.PortRange{}, false
+	}
+	r, err := rules.ParsePortRange(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+		return r, false
+	}
+	return r, true
+}
+
+func (d *decoder) protocol(v value) (uint8, bool) {
+	if v.kind == kindInt {
+		if v.num < 0 || v.num > 255 {
+			d.errorf(v.line, "protocol number %d is out of range 0-255", v.num)
+			return 0, false
+		}
+		return uint8(v.num), true
+	}
+
+	s := d.str(v)
+	if s == "" {
+		return 0, false
+	}
+	p, err := rules.ParseProtocol(s)
+	if err != nil {
+		d.errorf(v.line, "%v", err)
+		return 0, false
+	}
+	return p, true
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("../../netmonitor.example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rules.Rules) == 0 {
+		t.Error("example has no rules")
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	cfg, err := Parse("test.toml", `
+[[rule]]
+name = "web"
+process = ["/usr/bin/curl"]
+uid = [0, 1000]
+asn = [13335]
+port = 443
+verdict = "accept"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := cfg.Rules.Rules[0]
+	if rule.Name != "web" || len(rule.Match.UIDs) != 2 || rule.Match.UIDs[1] != 1000 ||
+		len(rule.Match.ASNs) != 1 || rule.Match.ASNs[0] != 13335 {
+		t.Errorf("rule = %+v", rule.Match)
+	}
+}
+
+// errorLines returns "line: message" for every error of err
+func errorLines(t *testing.T, err error) []string {
+	t.Helper()
+	var merr *multierror.Error
+	if !errors.As(err, &merr) {
+		t.Fatalf("got %v, want a list of errors", err)
+	}
+	var lines []string
+	for _, e := range merr.Errors {
+		var cfgErr *Error
+		if !errors.As(e, &cfgErr) {
+			t.Fatalf("got %v, want a config error", e)
+		}
+		if cfgErr.File != "test.toml" {
+			t.Errorf("file = %q, want test.toml", cfgErr.File)
+		}
+		lines = append(lines, fmt.Sprintf("%d: %s", cfgErr.Line, cfgErr.Msg))
+	}
+	return lines
+}
+
+func TestValidationErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string // line and a part of the message
+	}{
+		{"unknown table", "[nope]\n", []string{"1: unknown table [nope]"}},
+		{"top level key", "x = 1\n", []string{"1: must be inside a table"}},
+		{"unknown key", "[queue]\nipv4 = 1\nbogus = 2\n", []string{"3: unknown key \"bogus\""}},
+		{"wrong type", "[cache]\nduration = 5\n", []string{"2: expected string, found integer"}},
+		{"negative asn", "[[rule]]\nname = \"a\"\nasn = [-1]\nverdict = \"block\"\n", []string{"3: asn -1 out of range"}},
+		{"asn too large", "[[rule]]\nname = \"a\"\nasn = [4294967296]\nverdict = \"block\"\n", []string{"3: asn 4294967296 out of range"}},
+		{"negative uid", "[[rule]]\nname = \"a\"\nuid = [-1]\nverdict = \"block\"\n", []string{"3: uid -1 out of range"}},
+		{"uid of nobody", "[[rule]]\nname = \"a\"\nuid = [4294967295]\nverdict = \"block\"\n", []string{"3: uid 4294967295 out of range"}},
+		{"unknown verdict", "[[rule]]\nname = \"a\"\nverdict = \"maybe\"\n", []string{"3: unknown verdict", "1: has no verdict"}},
+		{"no verdict", "[[rule]]\nname = \"a\"\n", []string{"1: has no verdict"}},
+		{"duplicate rule", "[[rule]]\nname = \"a\"\nverdict = \"block\"\nport = 1\n[[rule]]\nname = \"a\"\nverdict = \"block\"\nport = 2\n",
+			[]string{"5: rule name \"a\" already used at line 1"}},
+		{"several", "[queue]\nbogus = 1\n\n[cache]\nduration = \"soon\"\n",
+			[]string{"2: unknown key \"bogus\"", "5: invalid duration"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("test.toml", tt.src)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			got := errorLines(t, err)
+			if len(got) != len(tt.want) {
+				t.Fatalf("errors = %q, want %d", got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				line, msg, _ := strings.Cut(want, ": ")
+				if !strings.HasPrefix(got[i], line+": ") || !strings.Contains(got[i], msg) {
+					t.Errorf("error %d = %q, want %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parser understands the subset of TOML used by netmonitor policy files:
+// [tables], [[arrays of tables]] and their [array.sub] tables, bare keys,
+// strings, integers, booleans and (possibly multi-line) arrays. Every value
+// keeps the line it was read from so validation errors can point at it.
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindBool
+	kindArray
+)
+
+var kindNames = map[kind]string{
+	kindString: "string",
+	kindInt:    "integer",
+	kindBool:   "boolean",
+	kindArray:  "array",
+}
+
+type value struct {
+	line int
+	kind kind
+	str  string
+	num  int64
+	b    bool
+	arr  []value
+}
+
+type entry struct {
+	key  string
+	line int
+	val  value
+}
+
+type table struct {
+	name    string
+	array   bool
+	line    int
+	entries []entry
+}
+
+type document struct {
+	tables []*table
+}
+
+type parser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func parse(src string) (*document, error) {
+	p := &parser{src: src, line: 1}
+	root := &table{line: 1}
+	doc := &document{tables: []*table{root}}
+	current := root
+	seen := map[string]int{}
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return doc, nil
+		}
+
+		if p.peek() == '[' {
+			t, err := p.parseHeader()
+			if err != nil {
+				return nil, err
+			}
+			if t.array {
+				// Sub-tables belong to the latest element of the array
+				for name := range seen {
+					if strings.HasPrefix(name, t.name+".") {
+						delete(seen, name)
+					}
+				}
+			} else {
+				if prev, ok := seen[t.name]; ok {
+					return nil, p.errorf(t.line, "table [%s] already defined at line %d", t.name, prev)
+				}
+				seen[t.name] = t.line
+			}
+			doc.tables = append(doc.tables, t)
+			current = t
+			continue
+		}
+
+		e, err := p.parseEntry()
+		if err != nil {
+			return nil, err
+		}
+		for _, prev := range current.entries {
+			if prev.key == e.key {
+				return nil, p.errorf(e.line, "duplicate key %q (first set at line %d)", e.key, prev.line)
+			}
+		}
+		current.entries = append(current.entries, e)
+	}
+}
+
+func (p *parser) errorf(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipSpace skips spaces and tabs on the current line
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// skipComment skips a comment up to, but not including, the newline
+func (p *parser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments
+func (p *parser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine consumes trailing whitespace and an optional comment and
+// requires a newline or the end of input
+func (p *parser) endOfLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.eof() {
+		return nil
+	}
+	switch p.peek() {
+	case '\n':
+		p.next()
+		return nil
+	case '\r':
+		p.next()
+		if p.peek() == '\n' {
+			p.next()
+			return nil
+		}
+	}
+	return p.errorf(p.line, "unexpected %q after value", p.peek())
+}
+
+func (p *parser) parseHeader() (*table, error) {
+	t := &table{line: p.line}
+	p.next()
+	if p.peek() == '[' {
+		p.next()
+		t.array = true
+	}
+
+	start := p.pos
+	for !p.eof() && p.peek() != ']' && p.peek() != '\n' {
+		p.next()
+	}
+	t.name = strings.TrimSpace(p.src[start:p.pos])
+	if t.name == "" || !isBareKey(strings.ReplaceAll(t.name, ".", "")) {
+		return nil, p.errorf(t.line, "invalid table name %q", t.name)
+	}
+
+	closing := "]"
+	if t.array {
+		closing = "]]"
+	}
+	if !strings.HasPrefix(p.src[p.pos:], closing) {
+		return nil, p.errorf(t.line, "table header is missing %q", closing)
+	}
+	for range closing {
+		p.next()
+	}
+	return t, p.endOfLine()
+}
+
+func (p *parser) parseEntry() (entry, error) {
+	e := entry{line: p.line}
+	start := p.pos
+	for !p.eof() && isBareKeyChar(p.peek()) {
+		p.next()
+	}
+	e.key = p.src[start:p.pos]
+	if e.key == "" {
+		return e, p.errorf(e.line, "expected a key, found %q", p.peek())
+	}
+
+	p.skipSpace()
+	if p.eof() || p.peek() != '=' {
+		return e, p.errorf(e.line, "expected '=' after key %q", e.key)
+	}
+	p.next()
+	p.skipSpace()
+
+	val, err := p.parseValue()
+	if err != nil {
+		return e, err
+	}
+	e.val = val
+	return e, p.endOfLine()
+}
+
+func (p *parser) parseValue() (value, error) {
+	v := value{line: p.line}
+	if p.eof() {
+		return v, p.errorf(v.line, "missing value")
+	}
+
+	switch c := p.peek(); {
+	case c == '"':
+		s, err := p.parseBasicString()
+		v.kind, v.str = kindString, s
+		return v, err
+	case c == '\'':
+		s, err := p.parseLiteralString()
+		v.kind, v.str = kindString, s
+		return v, err
+	case c == '[':
+		arr, err := p.parseArray()
+		v.kind, v.arr = kindArray, arr
+		return v, err
+	case c == 't' || c == 'f':
+		word := p.word()
+		switch word {
+		case "true":
+			v.kind, v.b = kindBool, true
+		case "false":
+			v.kind, v.b = kindBool, false
+		default:
+			return v, p.errorf(v.line, "invalid value %q", word)
+		}
+		return v, nil
+	case c == '+' || c == '-' || (c >= '0' && c <= '9'):
+		word := p.word()
+		n, err := parseInteger(word)
+		if err != nil {
+			return v, p.errorf(v.line, "invalid integer %q", word)
+		}
+		v.kind, v.num = kindInt, n
+		return v, nil
+	default:
+		return v, p.errorf(v.line, "invalid value starting with %q", c)
+	}
+}
+
+// parseInteger parses a TOML integer: decimal with an optional sign and
+// no leading zeros, or unsigned hexadecimal, octal or binary with a 0x, 0o
+// or 0b prefix. Underscores may separate digits.
+func parseInteger(s string) (int64, error) {
+	digits, base := s, 10
+	if len(s) > 2 && s[0] == '0' {
+		switch s[1] {
+		case 'x':
+			digits, base = s[2:], 16
+		case 'o':
+			digits, base = s[2:], 8
+		case 'b':
+			digits, base = s[2:], 2
+		}
+	}
+	if base == 10 {
+		unsigned := strings.TrimLeft(s, "+-")
+		if len(s)-len(unsigned) > 1 || (len(unsigned) > 1 && unsigned[0] == '0') {
+			return 0, strconv.ErrSyntax
+		}
+		digits = unsigned
+	}
+	if digits == "" || digits[0] == '_' || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+		return 0, strconv.ErrSyntax
+	}
+	if base != 10 {
+		n, err := strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), base, 63)
+		return int64(n), err
+	}
+	return strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 10, 64)
+}
+
+// word reads a run of characters up to whitespace, a comma, a closing
+// bracket or a comment
+func (p *parser) word() string {
+	start := p.pos
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n', ',', ']', '#':
+			return p.src[start:p.pos]
+		}
+		p.next()
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *parser) parseBasicString() (string, error) {
+	line := p.line
+	p.next()
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf(line, "unterminated string")
+		}
+		c := p.next()
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", p.errorf(line, "unterminated string")
+			}
+			switch esc := p.next(); esc {
+			case '"', '\\':
+				sb.WriteByte(esc)
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'u', 'U':
+				size := 4
+				if esc == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.src) {
+					return "", p.errorf(line, "invalid escape sequence \\%c", esc)
+				}
+				hex := p.src[p.pos : p.pos+size]
+				r, err := strconv.ParseUint(hex, 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", p.errorf(line, "invalid escape sequence \\%c%s", esc, hex)
+				}
+				p.pos += size
+				sb.WriteRune(rune(r))
+			default:
+				return "", p.errorf(line, "invalid escape sequence \\%c", esc)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+func (p *parser) parseLiteralString() (string, error) {
+	line := p.line
+	p.next()
+	start := p.pos
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf(line, "unterminated string")
+		}
+		if p.next() == '\'' {
+			return p.src[start : p.pos-1], nil
+		}
+	}
+}
+
+func (p *parser) parseArray() ([]value, error) {
+	line := p.line
+	p.next()
+	var arr []value
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil, p.errorf(line, "unterminated array")
+		}
+		if p.peek() == ']' {
+			p.next()
+			return arr, nil
+		}
+
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+
+		p.skipBlank()
+		if p.eof() {
+			return nil, p.errorf(line, "unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.next()
+		case ']':
+		default:
+			return nil, p.errorf(p.line, "expected ',' or ']' in array")
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c == '_' || c == '-' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isBareKey(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isBareKeyChar(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
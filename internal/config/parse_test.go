@@ -0,0 +1,129 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseValues(t *testing.T) {
+	tests := []struct {
+		src  string
+		want value
+	}{
+		{`v = "a\"b\\c"`, value{kind: kindString, str: `a"b\c`}},
+		{`v = "\b\f\n\r\t"`, value{kind: kindString, str: "\b\f\n\r\t"}},
+		{`v = "caf\u00e9 \U0001F600"`, value{kind: kindString, str: "café 😀"}},
+		{`v = 'C:\path\n'`, value{kind: kindString, str: `C:\path\n`}},
+		{`v = 42`, value{kind: kindInt, num: 42}},
+		{`v = +42`, value{kind: kindInt, num: 42}},
+		{`v = -17`, value{kind: kindInt, num: -17}},
+		{`v = 0`, value{kind: kindInt, num: 0}},
+		{`v = 1_000_000`, value{kind: kindInt, num: 1000000}},
+		{`v = 0xdead_beef`, value{kind: kindInt, num: 0xdeadbeef}},
+		{`v = 0o755`, value{kind: kindInt, num: 0755}},
+		{`v = 0b1010`, value{kind: kindInt, num: 10}},
+		{`v = true`, value{kind: kindBool, b: true}},
+		{`v = false # comment`, value{kind: kindBool, b: false}},
+	}
+	for _, tt := range tests {
+		doc, err := parse(tt.src)
+		if err != nil {
+			t.Errorf("parse(%q): %v", tt.src, err)
+			continue
+		}
+		got := doc.tables[0].entries[0].val
+		if got.kind != tt.want.kind || got.str != tt.want.str || got.num != tt.want.num || got.b != tt.want.b {
+			t.Errorf("parse(%q) = %+v, want %+v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseArray(t *testing.T) {
+	doc, err := parse("v = [\n  \"a\", # first\n  2,\n]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr := doc.tables[0].entries[0].val.arr
+	if len(arr) != 2 || arr[0].str != "a" || arr[1].num != 2 {
+		t.Fatalf("got %+v", arr)
+	}
+	if arr[0].line != 2 || arr[1].line != 3 {
+		t.Errorf("lines = %d, %d, want 2, 3", arr[0].line, arr[1].line)
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	src := `top = 1
+[queue]
+number = 1
+
+[[rule]]
+name = "a"
+[rule.except]
+port = 1
+
+[[rule]]
+name = "b"
+[rule.except]
+port = 2
+`
+	doc, err := parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tbl := range doc.tables {
+		names = append(names, tbl.name)
+	}
+	if got := strings.Join(names, ","); got != ",queue,rule,rule.except,rule,rule.except" {
+		t.Errorf("tables = %s", got)
+	}
+	if line := doc.tables[4].line; line != 10 {
+		t.Errorf("second [[rule]] at line %d, want 10", line)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		msg  string
+	}{
+		{"v = 0755", 1, "invalid integer"},
+		{"v = 00", 1, "invalid integer"},
+		{"v = +-1", 1, "invalid integer"},
+		{"v = 1__0", 1, "invalid integer"},
+		{"v = _1", 1, "invalid value"},
+		{"v = 1_", 1, "invalid integer"},
+		{"v = -0x10", 1, "invalid integer"},
+		{"v = 0x", 1, "invalid integer"},
+		{"v = 99999999999999999999", 1, "invalid integer"},
+		{"v = 1.5", 1, "invalid integer"},
+		{"\nv = \"\\x\"", 2, "invalid escape sequence"},
+		{"v = \"\\uD800\"", 1, "invalid escape sequence"},
+		{"v = \"\\u12\"", 1, "invalid escape sequence"},
+		{"v = \"open", 1, "unterminated string"},
+		{"v = 'open", 1, "unterminated string"},
+		{"v = [1, 2", 1, "unterminated array"},
+		{"v = [1 2]", 1, "expected ',' or ']'"},
+		{"v = yes", 1, "invalid value"},
+		{"v = 1 2", 1, "unexpected"},
+		{"v", 1, "expected '='"},
+		{"= 1", 1, "expected a key"},
+		{"v = 1\nv = 2", 2, "duplicate key"},
+		{"[queue]\n[queue]", 2, "already defined at line 1"},
+		{"[bad name]", 1, "invalid table name"},
+		{"[[rule]", 1, "missing"},
+	}
+	for _, tt := range tests {
+		_, err := parse(tt.src)
+		cfgErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("parse(%q) = %v, want a config error", tt.src, err)
+			continue
+		}
+		if cfgErr.Line != tt.line || !strings.Contains(cfgErr.Msg, tt.msg) {
+			t.Errorf("parse(%q) = line %d: %s, want line %d: %s", tt.src, cfgErr.Line, cfgErr.Msg, tt.line, tt.msg)
+		}
+	}
+}
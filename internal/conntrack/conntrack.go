@@ -0,0 +1,140 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ctnetlink message types and attributes from linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtNew = 0
+
+	ctaTupleOrig = 1
+	ctaMark      = 8
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+)
+
+// Tuple identifies a connection in one direction
+type Tuple struct {
+	Protocol uint8
+	Src      net.IP
+	SrcPort  uint16
+	Dst      net.IP
+	DstPort  uint16
+}
+
+// Reverse returns the tuple of the opposite direction
+func (t Tuple) Reverse() Tuple {
+	return Tuple{
+		Protocol: t.Protocol,
+		Src:      t.Dst,
+		SrcPort:  t.DstPort,
+		Dst:      t.Src,
+		DstPort:  t.SrcPort,
+	}
+}
+
+func (t Tuple) String() string {
+	return fmt.Sprintf("%s:%d->%s:%d:%d", t.Src, t.SrcPort, t.Dst, t.DstPort, t.Protocol)
+}
+
+func (t Tuple) family() uint8 {
+	if t.Src.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// Conn is a netlink connection to the kernel connection tracking table
+type Conn struct {
+	nl *netlink.Conn
+}
+
+// Dial opens a ctnetlink socket
+func Dial() (*Conn, error) {
+	nl, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ctnetlink socket: %w", err)
+	}
+	return &Conn{nl: nl}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.nl.Close()
+}
+
+// ClearMark resets the mark of the connection matching t, in either
+// direction, so the CONNMARK rules stop short-circuiting its packets
+func (c *Conn) ClearMark(t Tuple) error {
+	err := c.setMark(t, 0)
+	if netlink.IsNotExist(err) {
+		err = c.setMark(t.Reverse(), 0)
+	}
+	return err
+}
+
+func (c *Conn) setMark(t Tuple, mark uint32) error {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	encodeTuple(ae, ctaTupleOrig, t)
+	ae.Uint32(ctaMark, mark)
+
+	_, err := c.execute(ipctnlMsgCtNew, t.family(), ae)
+	return err
+}
+
+func (c *Conn) execute(msgType uint16, family uint8, ae *netlink.AttributeEncoder) ([]netlink.Message, error) {
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// nfgenmsg: family, version and a big endian resource id
+	data := append([]byte{family, unix.NFNETLINK_V0, 0, 0}, attrs...)
+	return c.nl.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | msgType),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	})
+}
+
+func encodeTuple(ae *netlink.AttributeEncoder, typ uint16, t Tuple) {
+	ae.Nested(typ, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIP, func(ipae *netlink.AttributeEncoder) error {
+			if src4, dst4 := t.Src.To4(), t.Dst.To4(); src4 != nil && dst4 != nil {
+				ipae.Bytes(ctaIPv4Src, src4)
+				ipae.Bytes(ctaIPv4Dst, dst4)
+			} else {
+				ipae.Bytes(ctaIPv6Src, t.Src.To16())
+				ipae.Bytes(ctaIPv6Dst, t.Dst.To16())
+			}
+			return nil
+		})
+		nae.Nested(ctaTupleProto, func(pae *netlink.AttributeEncoder) error {
+			pae.Uint8(ctaProtoNum, t.Protocol)
+			if t.Protocol == unix.IPPROTO_TCP || t.Protocol == unix.IPPROTO_UDP {
+				pae.Uint16(ctaProtoSrcPort, t.SrcPort)
+				pae.Uint16(ctaProtoDstPort, t.DstPort)
+			}
+			return nil
+		})
+		return nil
+	})
+}
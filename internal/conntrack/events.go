@@ -0,0 +1,342 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// More of linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtGet    = 1
+	ipctnlMsgCtDelete = 2
+
+	ctaTupleReply    = 2
+	ctaStatus        = 3
+	ctaProtoInfo     = 4
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+	ctaID            = 12
+	ctaTimestamp     = 20
+
+	ctaProtoInfoTCP      = 1
+	ctaProtoInfoTCPState = 1
+
+	ctaCountersPackets = 1
+	ctaCountersBytes   = 2
+
+	ctaTimestampStart = 1
+	ctaTimestampStop  = 2
+
+	// multicast groups of linux/netfilter/nfnetlink_compat.h, as a bitmask
+	nfnlGroupsConntrack = 1<<(1-1) | 1<<(2-1) | 1<<(3-1) // NEW, UPDATE, DESTROY
+
+	// status bits of linux/netfilter/nf_conntrack_common.h
+	ipsSeenReply = 1 << 1
+	ipsAssured   = 1 << 2
+
+	// eventBuffer is the socket receive buffer for events, large enough to
+	// absorb bursts of short connections
+	eventBuffer = 4 << 20
+)
+
+// tcpStates are the names of the TCP states of linux/netfilter/nf_conntrack_tcp.h
+var tcpStates = []string{
+	"NONE", "SYN_SENT", "SYN_RECV", "ESTABLISHED", "FIN_WAIT",
+	"CLOSE_WAIT", "LAST_ACK", "TIME_WAIT", "CLOSE", "SYN_SENT2",
+}
+
+// Counters count the traffic of one direction of a connection. They stay
+// zero unless accounting is enabled, see EnableAccounting.
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Entry is a connection in the conntrack table
+type Entry struct {
+	ID       uint32
+	Orig     Tuple // direction of the first packet
+	Reply    Tuple
+	Status   uint32
+	TCPState uint8 // only for TCP
+	Mark     uint32
+	// OrigCounters count the packets in the direction of Orig and
+	// ReplyCounters the ones in the direction of Reply
+	OrigCounters  Counters
+	ReplyCounters Counters
+	// Start and Stop are only reported with nf_conntrack_timestamp set
+	Start time.Time
+	Stop  time.Time
+}
+
+// State names the state of the connection: the TCP state for TCP, and
+// UNREPLIED, REPLIED or ASSURED for other protocols
+func (e *Entry) State() string {
+	if e.Orig.Protocol == unix.IPPROTO_TCP && int(e.TCPState) < len(tcpStates) {
+		return tcpStates[e.TCPState]
+	}
+	switch {
+	case e.Status&ipsAssured != 0:
+		return "ASSURED"
+	case e.Status&ipsSeenReply != 0:
+		return "REPLIED"
+	}
+	return "UNREPLIED"
+}
+
+// EventType tells what happened to a conntrack entry
+type EventType int
+
+const (
+	EventNew EventType = iota + 1
+	EventUpdate
+	EventDestroy
+)
+
+var eventTypeNames = map[EventType]string{
+	EventNew:     "new",
+	EventUpdate:  "update",
+	EventDestroy: "destroy",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change of the conntrack table
+type Event struct {
+	Type EventType
+	Entry
+}
+
+// Listen calls handle for every conntrack event until ctx is done or the
+// socket fails. When the kernel drops events because they were not read
+// fast enough, handleLost is called and listening continues.
+func Listen(ctx context.Context, handle func(Event), handleLost func()) error {
+	nl, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{Groups: nfnlGroupsConntrack})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to conntrack events: %w", err)
+	}
+	defer nl.Close()
+	if err := nl.SetReadBuffer(eventBuffer); err != nil {
+		return fmt.Errorf("failed to size the conntrack event buffer: %w", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nl.Close()
+		case <-done:
+		}
+	}()
+
+	return listen(ctx, nl, handle, handleLost)
+}
+
+// receiver is the part of a netlink socket events are read from
+type receiver interface {
+	Receive() ([]netlink.Message, error)
+}
+
+// listen reads events from r until it fails, see Listen
+func listen(ctx context.Context, r receiver, handle func(Event), handleLost func()) error {
+	for {
+		msgs, err := r.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, unix.ENOBUFS) {
+				handleLost()
+				continue
+			}
+			return fmt.Errorf("failed to receive conntrack events: %w", err)
+		}
+		for _, msg := range msgs {
+			ev, ok := parseEvent(msg)
+			if ok {
+				handle(ev)
+			}
+		}
+	}
+}
+
+func parseEvent(msg netlink.Message) (Event, bool) {
+	var typ EventType
+	switch uint16(msg.Header.Type) & 0xff {
+	case ipctnlMsgCtNew:
+		typ = EventUpdate
+		if msg.Header.Flags&(netlink.Create|netlink.Excl) != 0 {
+			typ = EventNew
+		}
+	case ipctnlMsgCtDelete:
+		typ = EventDestroy
+	default:
+		return Event{}, false
+	}
+	entry, err := parseEntry(msg.Data)
+	if err != nil {
+		return Event{}, false
+	}
+	return Event{Type: typ, Entry: entry}, true
+}
+
+// Dump returns the entries of the conntrack table
+func (c *Conn) Dump() ([]Entry, error) {
+	msgs, err := c.nl.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtGet),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0},
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(msgs))
+	for _, msg := range msgs {
+		entry, err := parseEntry(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseEntry decodes the attributes following the nfgenmsg header
+func parseEntry(data []byte) (Entry, error) {
+	if len(data) < 4 {
+		return Entry{}, errors.New("short conntrack message")
+	}
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return Entry{}, err
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var e Entry
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleOrig:
+			ad.Nested(decodeTuple(&e.Orig))
+		case ctaTupleReply:
+			ad.Nested(decodeTuple(&e.Reply))
+		case ctaStatus:
+			e.Status = ad.Uint32()
+		case ctaProtoInfo:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == ctaProtoInfoTCP {
+						nad.Nested(func(tad *netlink.AttributeDecoder) error {
+							for tad.Next() {
+								if tad.Type() == ctaProtoInfoTCPState {
+									e.TCPState = tad.Uint8()
+								}
+							}
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		case ctaMark:
+			e.Mark = ad.Uint32()
+		case ctaCountersOrig:
+			ad.Nested(decodeCounters(&e.OrigCounters))
+		case ctaCountersReply:
+			ad.Nested(decodeCounters(&e.ReplyCounters))
+		case ctaID:
+			e.ID = ad.Uint32()
+		case ctaTimestamp:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case ctaTimestampStart:
+						e.Start = time.Unix(0, int64(nad.Uint64()))
+					case ctaTimestampStop:
+						e.Stop = time.Unix(0, int64(nad.Uint64()))
+					}
+				}
+				return nil
+			})
+		}
+	}
+	return e, ad.Err()
+}
+
+func decodeTuple(t *Tuple) func(*netlink.AttributeDecoder) error {
+	return func(ad *netlink.AttributeDecoder) error {
+		for ad.Next() {
+			switch ad.Type() {
+			case ctaTupleIP:
+				ad.Nested(func(nad *netlink.AttributeDecoder) error {
+					for nad.Next() {
+						switch nad.Type() {
+						case ctaIPv4Src, ctaIPv6Src:
+							t.Src = net.IP(nad.Bytes())
+						case ctaIPv4Dst, ctaIPv6Dst:
+							t.Dst = net.IP(nad.Bytes())
+						}
+					}
+					return nil
+				})
+			case ctaTupleProto:
+				ad.Nested(func(nad *netlink.AttributeDecoder) error {
+					for nad.Next() {
+						switch nad.Type() {
+						case ctaProtoNum:
+							t.Protocol = nad.Uint8()
+						case ctaProtoSrcPort:
+							t.SrcPort = nad.Uint16()
+						case ctaProtoDstPort:
+							t.DstPort = nad.Uint16()
+						}
+					}
+					return nil
+				})
+			}
+		}
+		return nil
+	}
+}
+
+func decodeCounters(c *Counters) func(*netlink.AttributeDecoder) error {
+	return func(ad *netlink.AttributeDecoder) error {
+		for ad.Next() {
+			switch ad.Type() {
+			case ctaCountersPackets:
+				c.Packets = ad.Uint64()
+			case ctaCountersBytes:
+				c.Bytes = ad.Uint64()
+			}
+		}
+		return nil
+	}
+}
+
+// EnableAccounting turns on the kernel sysctls that make conntrack count
+// the traffic of connections and record when they start and stop
+func EnableAccounting() error {
+	var result error
+	for _, name := range []string{"nf_conntrack_acct", "nf_conntrack_timestamp"} {
+		if err := os.WriteFile("/proc/sys/net/netfilter/"+name, []byte("1"), 0644); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
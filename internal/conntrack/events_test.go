@@ -0,0 +1,247 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// message builds a ctnetlink message of msgType carrying the attributes
+// written by attrs, as the kernel sends it
+func message(t *testing.T, msgType uint16, flags netlink.HeaderFlags, family uint8, attrs func(*netlink.AttributeEncoder)) netlink.Message {
+	t.Helper()
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	attrs(ae)
+	data, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | msgType),
+			Flags: flags,
+		},
+		Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...),
+	}
+}
+
+func encodeCounters(ae *netlink.AttributeEncoder, typ uint16, c Counters) {
+	ae.Nested(typ, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint64(ctaCountersPackets, c.Packets)
+		nae.Uint64(ctaCountersBytes, c.Bytes)
+		return nil
+	})
+}
+
+func TestParseEvent(t *testing.T) {
+	orig := Tuple{
+		Protocol: unix.IPPROTO_TCP,
+		Src:      net.ParseIP("192.0.2.1").To4(), SrcPort: 40000,
+		Dst: net.ParseIP("198.51.100.1").To4(), DstPort: 443,
+	}
+	start := time.Unix(1714557600, 123456789)
+	stop := start.Add(90 * time.Second)
+
+	tcp := func(state uint8) func(*netlink.AttributeEncoder) {
+		return func(ae *netlink.AttributeEncoder) {
+			encodeTuple(ae, ctaTupleOrig, orig)
+			encodeTuple(ae, ctaTupleReply, orig.Reverse())
+			ae.Uint32(ctaStatus, ipsSeenReply|ipsAssured)
+			ae.Nested(ctaProtoInfo, func(nae *netlink.AttributeEncoder) error {
+				nae.Nested(ctaProtoInfoTCP, func(tae *netlink.AttributeEncoder) error {
+					tae.Uint8(ctaProtoInfoTCPState, state)
+					return nil
+				})
+				return nil
+			})
+			ae.Uint32(ctaMark, 1710)
+			ae.Uint32(ctaID, 0xdeadbeef)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		msg   netlink.Message
+		want  EventType
+		state string
+		check func(t *testing.T, e Entry)
+	}{
+		{
+			name:  "new",
+			msg:   message(t, ipctnlMsgCtNew, netlink.Create|netlink.Excl, unix.AF_INET, tcp(1)),
+			want:  EventNew,
+			state: "SYN_SENT",
+			check: func(t *testing.T, e Entry) {
+				if !e.Orig.Src.Equal(orig.Src) || e.Orig.SrcPort != 40000 || !e.Orig.Dst.Equal(orig.Dst) || e.Orig.DstPort != 443 || e.Orig.Protocol != unix.IPPROTO_TCP {
+					t.Errorf("orig = %s", e.Orig)
+				}
+				if !e.Reply.Src.Equal(orig.Dst) || e.Reply.SrcPort != 443 {
+					t.Errorf("reply = %s", e.Reply)
+				}
+				if e.Mark != 1710 || e.ID != 0xdeadbeef {
+					t.Errorf("mark %d id %#x, want 1710 0xdeadbeef", e.Mark, e.ID)
+				}
+			},
+		},
+		{
+			name: "update with counters",
+			msg: message(t, ipctnlMsgCtNew, 0, unix.AF_INET, func(ae *netlink.AttributeEncoder) {
+				tcp(3)(ae)
+				encodeCounters(ae, ctaCountersOrig, Counters{Packets: 12, Bytes: 3400})
+				encodeCounters(ae, ctaCountersReply, Counters{Packets: 20, Bytes: 56000})
+				ae.Nested(ctaTimestamp, func(nae *netlink.AttributeEncoder) error {
+					nae.Uint64(ctaTimestampStart, uint64(start.UnixNano()))
+					return nil
+				})
+			}),
+			want:  EventUpdate,
+			state: "ESTABLISHED",
+			check: func(t *testing.T, e Entry) {
+				if e.OrigCounters != (Counters{Packets: 12, Bytes: 3400}) || e.ReplyCounters != (Counters{Packets: 20, Bytes: 56000}) {
+					t.Errorf("counters = %+v, %+v", e.OrigCounters, e.ReplyCounters)
+				}
+				if !e.Start.Equal(start) || !e.Stop.IsZero() {
+					t.Errorf("start %s stop %s, want %s and none", e.Start, e.Stop, start)
+				}
+			},
+		},
+		{
+			name: "destroy",
+			msg: message(t, ipctnlMsgCtDelete, 0, unix.AF_INET, func(ae *netlink.AttributeEncoder) {
+				tcp(7)(ae)
+				ae.Nested(ctaTimestamp, func(nae *netlink.AttributeEncoder) error {
+					nae.Uint64(ctaTimestampStart, uint64(start.UnixNano()))
+					nae.Uint64(ctaTimestampStop, uint64(stop.UnixNano()))
+					return nil
+				})
+			}),
+			want:  EventDestroy,
+			state: "TIME_WAIT",
+			check: func(t *testing.T, e Entry) {
+				if !e.Start.Equal(start) || !e.Stop.Equal(stop) {
+					t.Errorf("start %s stop %s, want %s %s", e.Start, e.Stop, start, stop)
+				}
+			},
+		},
+		{
+			name: "udp over ipv6",
+			msg: message(t, ipctnlMsgCtNew, netlink.Create, unix.AF_INET6, func(ae *netlink.AttributeEncoder) {
+				encodeTuple(ae, ctaTupleOrig, Tuple{
+					Protocol: unix.IPPROTO_UDP,
+					Src:      net.ParseIP("2001:db8::1"), SrcPort: 5353,
+					Dst: net.ParseIP("2001:db8::53"), DstPort: 53,
+				})
+				ae.Uint32(ctaStatus, ipsSeenReply)
+			}),
+			want:  EventNew,
+			state: "REPLIED",
+			check: func(t *testing.T, e Entry) {
+				if !e.Orig.Src.Equal(net.ParseIP("2001:db8::1")) || !e.Orig.Dst.Equal(net.ParseIP("2001:db8::53")) ||
+					e.Orig.SrcPort != 5353 || e.Orig.DstPort != 53 || e.Orig.Protocol != unix.IPPROTO_UDP {
+					t.Errorf("orig = %s", e.Orig)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, ok := parseEvent(tt.msg)
+			if !ok {
+				t.Fatal("message rejected")
+			}
+			if ev.Type != tt.want {
+				t.Errorf("type = %s, want %s", ev.Type, tt.want)
+			}
+			if state := ev.State(); state != tt.state {
+				t.Errorf("state = %s, want %s", state, tt.state)
+			}
+			tt.check(t, ev.Entry)
+		})
+	}
+}
+
+func TestParseEventRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  netlink.Message
+	}{
+		{"get", message(t, ipctnlMsgCtGet, 0, unix.AF_INET, func(*netlink.AttributeEncoder) {})},
+		{"short", netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}, Data: []byte{unix.AF_INET}}},
+		{"truncated attribute", netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)},
+			Data:   []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0, 8, 0, ctaStatus, 0, 0},
+		}},
+	}
+	for _, tt := range tests {
+		if ev, ok := parseEvent(tt.msg); ok {
+			t.Errorf("%s: parsed %+v", tt.name, ev)
+		}
+	}
+}
+
+// fakeReceiver returns its results one by one, then errDone
+type fakeReceiver struct {
+	results []result
+}
+
+type result struct {
+	msgs []netlink.Message
+	err  error
+}
+
+var errDone = errors.New("done")
+
+func (r *fakeReceiver) Receive() ([]netlink.Message, error) {
+	if len(r.results) == 0 {
+		return nil, errDone
+	}
+	res := r.results[0]
+	r.results = r.results[1:]
+	return res.msgs, res.err
+}
+
+func TestListenOverrun(t *testing.T) {
+	destroy := message(t, ipctnlMsgCtDelete, 0, unix.AF_INET, func(ae *netlink.AttributeEncoder) {
+		encodeTuple(ae, ctaTupleOrig, Tuple{
+			Protocol: unix.IPPROTO_TCP,
+			Src:      net.ParseIP("192.0.2.1"), SrcPort: 40000,
+			Dst: net.ParseIP("198.51.100.1"), DstPort: 443,
+		})
+	})
+	ignored := message(t, ipctnlMsgCtGet, 0, unix.AF_INET, func(*netlink.AttributeEncoder) {})
+	r := &fakeReceiver{results: []result{
+		{msgs: []netlink.Message{destroy, ignored}},
+		{err: &netlink.OpError{Op: "receive", Err: unix.ENOBUFS}},
+		{msgs: []netlink.Message{destroy}},
+	}}
+
+	var events []Event
+	lost := 0
+	err := listen(context.Background(), r, func(ev Event) { events = append(events, ev) }, func() { lost++ })
+	if !errors.Is(err, errDone) {
+		t.Errorf("listen() = %v, want the error of the socket", err)
+	}
+	// Listening goes on after the overrun
+	if lost != 1 || len(events) != 2 {
+		t.Errorf("lost %d times, got %d events, want 1 and 2", lost, len(events))
+	}
+	for _, ev := range events {
+		if ev.Type != EventDestroy || ev.Orig.SrcPort != 40000 {
+			t.Errorf("event = %s of %s", ev.Type, ev.Orig)
+		}
+	}
+
+	// Errors after ctx is done end listening quietly
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := listen(ctx, &fakeReceiver{}, func(Event) {}, func() {}); err != nil {
+		t.Errorf("listen() after cancel = %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Listing tells where a blocked domain comes from
+type Listing struct {
+	List  string // path of the filter list, or "config" for inline entries
+	Entry string // line of the list that matched
+}
+
+// Blocklist holds domains whose resolution and connections are refused.
+// Blocking a domain also blocks its subdomains. The domains are kept in a
+// trie of labels starting from the top level domain, so a lookup costs one
+// step per label of the name however long the lists are.
+type Blocklist struct {
+	root node
+	size int
+}
+
+type node struct {
+	children map[string]*node
+	listing  *Listing
+}
+
+// hostsNames are the local entries every hosts file carries
+var hostsNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// LoadBlocklist builds a blocklist from the domains given in the config and
+// the filter lists at paths
+func LoadBlocklist(domains []string, paths []string) (*Blocklist, error) {
+	b := &Blocklist{}
+	for _, d := range domains {
+		b.Add(d, Listing{List: "config", Entry: d})
+	}
+	for _, path := range paths {
+		if err := b.Load(path); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Load adds the domains of the filter list at path. Hosts files, adblock
+// "||example.com^" rules and plain lists of one domain per line are
+// understood; other adblock rules, such as exceptions or rules restricted
+// to paths or options, are skipped.
+func (b *Blocklist) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, domain := range parseListLine(line) {
+			b.Add(domain, Listing{List: path, Entry: line})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// parseListLine returns the domains a filter list line blocks
+func parseListLine(line string) []string {
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return nil
+	}
+
+	// Adblock: ||example.com^
+	if rest, ok := strings.CutPrefix(line, "||"); ok {
+		end := strings.IndexAny(rest, "^$/|")
+		if end < 0 {
+			end = len(rest)
+		}
+		domain, tail := rest[:end], rest[end:]
+		if tail != "" && tail != "^" && tail != "^|" {
+			return nil
+		}
+		if !validDomain(domain) {
+			return nil
+		}
+		return []string{domain}
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 1:
+		// Plain list, wildcards cover the subdomains anyway
+		domain := strings.TrimPrefix(fields[0], "*.")
+		if validDomain(domain) && net.ParseIP(domain) == nil {
+			return []string{domain}
+		}
+	case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+		// Hosts file: address followed by names
+		var domains []string
+		for _, name := range fields[1:] {
+			if !hostsNames[strings.ToLower(name)] && validDomain(name) {
+				domains = append(domains, name)
+			}
+		}
+		return domains
+	}
+	return nil
+}
+
+// validDomain accepts names made of letters, digits, hyphens and
+// underscores separated by dots
+func validDomain(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Add blocks domain and its subdomains. The first listing of a domain is
+// kept.
+func (b *Blocklist) Add(domain string, l Listing) {
+	domain = Normalize(domain)
+	if domain == "" {
+		return
+	}
+	n := &b.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*node)
+			}
+			child = &node{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	if n.listing == nil {
+		n.listing = &l
+		b.size++
+	}
+}
+
+// Match returns the listing that blocks name. When name and some of its
+// parents are listed, the listing of the topmost parent is returned.
+func (b *Blocklist) Match(name string) (Listing, bool) {
+	if b == nil || b.size == 0 || name == "" {
+		return Listing{}, false
+	}
+	n := &b.root
+	labels := strings.Split(Normalize(name), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			return Listing{}, false
+		}
+		if child.listing != nil {
+			return *child.listing, true
+		}
+		n = child
+	}
+	return Listing{}, false
+}
+
+// Blocked reports whether name or one of its parent domains is blocked
+func (b *Blocklist) Blocked(name string) bool {
+	_, ok := b.Match(name)
+	return ok
+}
+
+// Len returns the number of blocked domains
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return b.size
+}
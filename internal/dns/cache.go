@@ -0,0 +1,265 @@
+// Package dns follows name resolution to label connections with the domain
+// they were made to
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MinTTL keeps short lived answers long enough for the connection that
+	// follows the lookup
+	MinTTL = 30 * time.Second
+	// queryTimeout is how long a query waits for its response
+	queryTimeout = 30 * time.Second
+)
+
+// queryKey identifies an outstanding query by the client socket and the
+// message ID
+type queryKey struct {
+	client string
+	port   uint16
+	id     uint16
+}
+
+type query struct {
+	pid     int
+	name    string
+	expires time.Time
+}
+
+type entry struct {
+	domain  string
+	expires time.Time
+}
+
+// Cache remembers which domain each process resolved to which address
+type Cache struct {
+	sync.Mutex
+	queries map[queryKey]query
+	byPID   map[int]map[string]entry // PID -> address -> domain
+}
+
+// NewCache creates an empty cache
+func NewCache() *Cache {
+	return &Cache{
+		queries: make(map[queryKey]query),
+		byPID:   make(map[int]map[string]entry),
+	}
+}
+
+// Query records a query sent by pid from client:port and returns the name
+// asked for
+func (c *Cache) Query(pid int, client net.IP, port uint16, msg []byte) (string, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(msg)
+	if err != nil {
+		return "", err
+	}
+	if hdr.Response {
+		return "", errors.New("not a query")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", err
+	}
+	name := Normalize(q.Name.String())
+
+	c.Lock()
+	defer c.Unlock()
+	c.queries[queryKey{client: client.String(), port: port, id: hdr.ID}] = query{
+		pid:     pid,
+		name:    name,
+		expires: time.Now().Add(queryTimeout),
+	}
+	return name, nil
+}
+
+// Response matches a response delivered to client:port with its query and
+// records the addresses in it. It returns the name asked for and the
+// addresses, or ok false when no query is waiting for the response.
+func (c *Cache) Response(client net.IP, port uint16, msg []byte) (name string, ips []net.IP, ok bool) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(msg)
+	if err != nil || !hdr.Response {
+		return "", nil, false
+	}
+
+	key := queryKey{client: client.String(), port: port, id: hdr.ID}
+	c.Lock()
+	q, ok := c.queries[key]
+	delete(c.queries, key)
+	c.Unlock()
+	if !ok {
+		return "", nil, false
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return q.name, nil, true
+	}
+	ips, ttl := parseAnswers(&p)
+	c.Record(q.pid, q.name, ips, ttl)
+	return q.name, ips, true
+}
+
+// Pending returns the PID that sent the query msg from client:port. The
+// query stays in place for its response.
+func (c *Cache) Pending(client net.IP, port uint16, msg []byte) (int, bool) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(msg)
+	if err != nil {
+		return 0, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	q, ok := c.queries[queryKey{client: client.String(), port: port, id: hdr.ID}]
+	return q.pid, ok
+}
+
+// Answer records the addresses of the response msg under the name in its
+// question as resolved by pid
+func (c *Cache) Answer(pid int, msg []byte) (string, []net.IP) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return "", nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", nil
+	}
+	name := Normalize(q.Name.String())
+	if err := p.SkipAllQuestions(); err != nil {
+		return name, nil
+	}
+	ips, ttl := parseAnswers(&p)
+	c.Record(pid, name, ips, ttl)
+	return name, ips
+}
+
+// parseAnswers returns the A and AAAA records of the answer section and the
+// lowest TTL among them. Parsing stops at the first malformed record.
+func parseAnswers(p *dnsmessage.Parser) ([]net.IP, time.Duration) {
+	var ips []net.IP
+	var ttl uint32
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return ips, time.Duration(ttl) * time.Second
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return ips, time.Duration(ttl) * time.Second
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			// CNAMEs lead to the addresses that follow; the connection
+			// is labelled with the name the process asked for
+			if err := p.SkipAnswer(); err != nil {
+				return ips, time.Duration(ttl) * time.Second
+			}
+			continue
+		}
+		if ttl == 0 || h.TTL < ttl {
+			ttl = h.TTL
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second
+}
+
+// Record remembers that pid resolved domain to ips for ttl
+func (c *Cache) Record(pid int, domain string, ips []net.IP, ttl time.Duration) {
+	if len(ips) == 0 {
+		return
+	}
+	if ttl < MinTTL {
+		ttl = MinTTL
+	}
+	expires := time.Now().Add(ttl)
+	domain = Normalize(domain)
+
+	c.Lock()
+	defer c.Unlock()
+	addrs, ok := c.byPID[pid]
+	if !ok {
+		addrs = make(map[string]entry)
+		c.byPID[pid] = addrs
+	}
+	for _, ip := range ips {
+		addrs[ip.String()] = entry{domain: domain, expires: expires}
+	}
+}
+
+// Resolved returns the domain pid itself resolved to ip
+func (c *Cache) Resolved(pid int, ip net.IP) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.byPID[pid][ip.String()]; ok && time.Now().Before(e.expires) {
+		return e.domain, true
+	}
+	return "", false
+}
+
+// Lookup returns the domain pid resolved to ip. When pid never resolved ip,
+// for example because a local resolver asked on its behalf, the answer any
+// process got is used. Addresses shared by many domains, such as those of
+// CDNs, may then be labelled with the name another process asked for.
+func (c *Cache) Lookup(pid int, ip net.IP) (string, bool) {
+	if domain, ok := c.Resolved(pid, ip); ok {
+		return domain, true
+	}
+	addr := ip.String()
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+	var best entry
+	for _, addrs := range c.byPID {
+		if e, ok := addrs[addr]; ok && now.Before(e.expires) && e.expires.After(best.expires) {
+			best = e
+		}
+	}
+	return best.domain, best.domain != ""
+}
+
+// Expire drops answers past their TTL and queries that were never answered
+func (c *Cache) Expire() {
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+	for key, q := range c.queries {
+		if now.After(q.expires) {
+			delete(c.queries, key)
+		}
+	}
+	for pid, addrs := range c.byPID {
+		for addr, e := range addrs {
+			if now.After(e.expires) {
+				delete(addrs, addr)
+			}
+		}
+		if len(addrs) == 0 {
+			delete(c.byPID, pid)
+		}
+	}
+}
+
+// Normalize lowercases a domain and removes the trailing dot
+func Normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
@@ -0,0 +1,36 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheLookup(t *testing.T) {
+	cache := NewCache()
+	shared := net.ParseIP("192.0.2.1")
+	cache.Record(1, "Listed.Example.", []net.IP{shared}, time.Minute)
+	cache.Record(2, "cdn.example", []net.IP{shared, net.ParseIP("192.0.2.2")}, time.Minute)
+
+	tests := []struct {
+		pid      int
+		ip       string
+		resolved string
+		lookup   string
+	}{
+		{1, "192.0.2.1", "listed.example", "listed.example"},
+		{2, "192.0.2.1", "cdn.example", "cdn.example"},
+		// Never resolved by pid 3: only Lookup borrows another answer
+		{3, "192.0.2.2", "", "cdn.example"},
+		{1, "192.0.2.3", "", ""},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if got, ok := cache.Resolved(tt.pid, ip); got != tt.resolved || ok != (tt.resolved != "") {
+			t.Errorf("Resolved(%d, %s) = %q, %v, want %q", tt.pid, tt.ip, got, ok, tt.resolved)
+		}
+		if got, ok := cache.Lookup(tt.pid, ip); got != tt.lookup || ok != (tt.lookup != "") {
+			t.Errorf("Lookup(%d, %s) = %q, %v, want %q", tt.pid, tt.ip, got, ok, tt.lookup)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// upstreamTimeout bounds one exchange with an upstream nameserver
+	upstreamTimeout = 5 * time.Second
+	// idleTimeout closes TCP clients that stopped sending queries
+	idleTimeout = 10 * time.Second
+	// blockedTTL is how long clients may cache a blocked answer
+	blockedTTL = 60
+	maxMessage = 65535
+
+	// UpstreamMark is the firewall mark of the queries the resolver sends
+	// to its upstreams. iptables lets them pass without queueing them or
+	// redirecting them back to the resolver.
+	UpstreamMark = 1798
+)
+
+// BlockResponse is the answer given to queries for blocked domains
+type BlockResponse int
+
+const (
+	// BlockNXDomain answers that the domain does not exist
+	BlockNXDomain BlockResponse = iota + 1
+	// BlockZero answers 0.0.0.0 or :: so clients fail fast without
+	// retrying other nameservers
+	BlockZero
+)
+
+var blockResponseNames = map[BlockResponse]string{
+	BlockNXDomain: "nxdomain",
+	BlockZero:     "zero",
+}
+
+func (b BlockResponse) String() string {
+	if name, ok := blockResponseNames[b]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseBlockResponse converts "nxdomain" or "zero" into a BlockResponse
+func ParseBlockResponse(s string) (BlockResponse, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for b, n := range blockResponseNames {
+		if n == name {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown block response %q, expected nxdomain or zero", s)
+}
+
+// ParseUpstream validates a nameserver address given as an IP with an
+// optional port and returns it as host:port
+func ParseUpstream(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid upstream %q: expected an IP address with an optional port", s)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("invalid upstream %q: %q is not an IP address", s, host)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("invalid upstream %q: bad port %q", s, port)
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+type blockPolicy struct {
+	list     *Blocklist
+	response BlockResponse
+}
+
+// Resolver is a forwarding nameserver on the loopback addresses. Queries
+// that iptables redirects to it are answered by the upstreams, and the
+// answers are recorded in the cache under the process that asked.
+type Resolver struct {
+	cache     *Cache
+	upstreams []string
+	policy    atomic.Pointer[blockPolicy]
+	mark      int // of upstream queries, none when 0
+
+	mu        sync.Mutex
+	packets   []net.PacketConn
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+// NewResolver creates a resolver forwarding to upstreams, tried in order
+func NewResolver(cache *Cache, upstreams []string) *Resolver {
+	r := &Resolver{
+		cache:     cache,
+		upstreams: upstreams,
+		mark:      UpstreamMark,
+	}
+	r.policy.Store(&blockPolicy{response: BlockNXDomain})
+	return r
+}
+
+// SetBlocklist replaces the blocked domains and how they are answered
+func (r *Resolver) SetBlocklist(list *Blocklist, response BlockResponse) {
+	r.policy.Store(&blockPolicy{list: list, response: response})
+}
+
+// Start listens for UDP and TCP queries on port of 127.0.0.1 and ::1 and
+// serves them in the background. Hosts without IPv6 only get the IPv4
+// listeners.
+func (r *Resolver) Start(port uint16) error {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		if err := r.listen(addr); err != nil {
+			if host == "::1" {
+				logger.Log.Warn("DNS resolver not available over IPv6", "err", err)
+				continue
+			}
+			r.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) listen(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", addr, err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", addr, err)
+	}
+
+	r.mu.Lock()
+	r.packets = append(r.packets, pc)
+	r.listeners = append(r.listeners, ln)
+	r.mu.Unlock()
+
+	r.wg.Add(2)
+	go r.serveUDP(pc)
+	go r.serveTCP(ln)
+	return nil
+}
+
+// Close stops the listeners and waits for them to return
+func (r *Resolver) Close() error {
+	var errs error
+	r.mu.Lock()
+	for _, pc := range r.packets {
+		if err := pc.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	for _, ln := range r.listeners {
+		if err := ln.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	r.packets, r.listeners = nil, nil
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	return errs
+}
+
+func (r *Resolver) serveUDP(pc net.PacketConn) {
+	defer r.wg.Done()
+	buf := make([]byte, maxMessage)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log.Warn("DNS resolver: failed to read query", "err", err)
+			continue
+		}
+		client, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+
+		go func() {
+			answer := r.resolve(client.IP, uint16(client.Port), query, "udp")
+			if answer == nil {
+				return
+			}
+			if _, err := pc.WriteTo(answer, addr); err != nil {
+				logger.Log.Warn("DNS resolver: failed to reply", "client", addr, "err", err)
+			}
+		}()
+	}
+}
+
+func (r *Resolver) serveTCP(ln net.Listener) {
+	defer r.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log.Warn("DNS resolver: failed to accept connection", "err", err)
+			continue
+		}
+		go r.serveConn(conn)
+	}
+}
+
+// serveConn answers the queries of one TCP client in order
+func (r *Resolver) serveConn(conn net.Conn) {
+	defer conn.Close()
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		query, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		answer := r.resolve(client.IP, uint16(client.Port), query, "tcp")
+		if answer == nil {
+			return
+		}
+		if err := writeMessage(conn, answer); err != nil {
+			return
+		}
+	}
+}
+
+// resolve answers one query from client:port. It returns nil for messages
+// that are not worth an answer.
+func (r *Resolver) resolve(client net.IP, port uint16, query []byte, network string) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil || hdr.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	name := Normalize(q.Name.String())
+
+	policy := r.policy.Load()
+	if listing, ok := policy.list.Match(name); ok {
+		logger.Log.Info("DNS resolver: blocked query", "name", name, "client", client,
+			"list", listing.List, "entry", listing.Entry)
+		return policy.blocked(hdr, q)
+	}
+
+	// The query was seen by the queue before it was redirected, which
+	// tells the process that sent it
+	pid, _ := r.cache.Pending(client, port, query)
+
+	answer, err := r.forward(query, network)
+	if err != nil {
+		logger.Log.Debug("DNS resolver: failed to resolve", "name", name, "err", err)
+		return reply(hdr, q, dnsmessage.RCodeServerFailure, false)
+	}
+	r.cache.Answer(pid, answer)
+	return answer
+}
+
+// forward sends the query to the upstreams in order and returns the first
+// reply
+func (r *Resolver) forward(query []byte, network string) ([]byte, error) {
+	var errs error
+	for _, upstream := range r.upstreams {
+		answer, err := r.exchange(network, upstream, query)
+		if err == nil {
+			return answer, nil
+		}
+		errs = multierror.Append(errs, err)
+	}
+	if errs == nil {
+		errs = errors.New("no upstream configured")
+	}
+	return nil, errs
+}
+
+func (r *Resolver) exchange(network, upstream string, query []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: upstreamTimeout}
+	if r.mark != 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, r.mark)
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to mark upstream query: %w", err)
+			}
+			return nil
+		}
+	}
+	conn, err := dialer.Dial(network, upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	var answer []byte
+	if network == "tcp" {
+		if err := writeMessage(conn, query); err != nil {
+			return nil, err
+		}
+		if answer, err = readMessage(conn); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxMessage)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		answer = buf[:n]
+	}
+
+	if len(answer) < 2 || answer[0] != query[0] || answer[1] != query[1] {
+		return nil, fmt.Errorf("reply from %s does not match the query", upstream)
+	}
+	return answer, nil
+}
+
+// blocked answers a query for a blocked domain
+func (p *blockPolicy) blocked(hdr dnsmessage.Header, q dnsmessage.Question) []byte {
+	if p.response == BlockZero {
+		return reply(hdr, q, dnsmessage.RCodeSuccess, true)
+	}
+	return reply(hdr, q, dnsmessage.RCodeNameError, false)
+}
+
+// reply builds an answer to q without asking upstream. With zero set, A and
+// AAAA questions get the unspecified address.
+func reply(hdr dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, zero bool) []byte {
+	h := dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		OpCode:             hdr.OpCode,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	}
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := b.Question(q); err != nil {
+		return nil
+	}
+	if zero {
+		if err := b.StartAnswers(); err != nil {
+			return nil
+		}
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: blockedTTL}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			err := b.AResource(rh, dnsmessage.AResource{})
+			if err != nil {
+				return nil
+			}
+		case dnsmessage.TypeAAAA:
+			err := b.AAAAResource(rh, dnsmessage.AAAAResource{})
+			if err != nil {
+				return nil
+			}
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// readMessage reads one message of a DNS over TCP stream, which prefixes
+// each message with its length
+func readMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
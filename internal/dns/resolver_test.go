@@ -0,0 +1,280 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var stubAddress = net.IPv4(192, 0, 2, 10)
+
+// stubAnswer answers every A question with stubAddress
+func stubAnswer(query []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: hdr.ID, Response: true, RecursionAvailable: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	var a dnsmessage.AResource
+	copy(a.A[:], stubAddress.To4())
+	b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 300}, a)
+	msg, _ := b.Finish()
+	return msg
+}
+
+// startUpstream runs a nameserver answering with stubAnswer over UDP and
+// TCP on the same loopback port
+func startUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	go func() {
+		buf := make([]byte, maxMessage)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(stubAnswer(buf[:n]), from)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				query, err := readMessage(conn)
+				if err != nil {
+					return
+				}
+				writeMessage(conn, stubAnswer(query))
+			}()
+		}
+	}()
+	return addr
+}
+
+// startResolver runs a resolver forwarding to upstream on free loopback
+// ports. Upstream queries are not marked, that needs CAP_NET_ADMIN.
+func startResolver(t *testing.T, cache *Cache, upstream string) *Resolver {
+	t.Helper()
+	r := NewResolver(cache, []string{upstream})
+	r.mark = 0
+	if err := r.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// dial connects to the listener of r for network
+func dial(t *testing.T, r *Resolver, network string) net.Conn {
+	t.Helper()
+	addr := r.packets[0].LocalAddr().String()
+	if network == "tcp" {
+		addr = r.listeners[0].Addr().String()
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// ask sends query over conn and returns the parsed reply
+func ask(t *testing.T, conn net.Conn, network string, query []byte) dnsmessage.Message {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var answer []byte
+	if network == "tcp" {
+		if err := writeMessage(conn, query); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if answer, err = readMessage(conn); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, maxMessage)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer = buf[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		t.Fatalf("failed to parse reply: %v", err)
+	}
+	return msg
+}
+
+func answerIPs(msg dnsmessage.Message) []string {
+	var ips []string
+	for _, rr := range msg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		}
+	}
+	return ips
+}
+
+func TestResolverForwards(t *testing.T) {
+	upstream := startUpstream(t)
+	r := startResolver(t, NewCache(), upstream)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			conn := dial(t, r, network)
+			msg := ask(t, conn, network, newQuery(t, 0x1234, "example.com.", dnsmessage.TypeA))
+			if msg.ID != 0x1234 || !msg.Response || msg.RCode != dnsmessage.RCodeSuccess {
+				t.Fatalf("got header %+v", msg.Header)
+			}
+			if ips := answerIPs(msg); len(ips) != 1 || ips[0] != stubAddress.String() {
+				t.Errorf("got answers %v, want [%s]", ips, stubAddress)
+			}
+		})
+	}
+}
+
+func TestResolverUpstreamFailure(t *testing.T) {
+	// Nothing listens on the upstream port
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := pc.LocalAddr().String()
+	pc.Close()
+
+	r := startResolver(t, NewCache(), upstream)
+	conn := dial(t, r, "udp")
+	msg := ask(t, conn, "udp", newQuery(t, 7, "example.com.", dnsmessage.TypeA))
+	if msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got rcode %v, want %v", msg.RCode, dnsmessage.RCodeServerFailure)
+	}
+}
+
+func TestResolverBlocks(t *testing.T) {
+	upstream := startUpstream(t)
+	list, err := LoadBlocklist([]string{"blocked.example"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		response BlockResponse
+		qname    string
+		qtype    dnsmessage.Type
+		rcode    dnsmessage.RCode
+		ips      []string
+	}{
+		{"nxdomain", BlockNXDomain, "blocked.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"nxdomain subdomain", BlockNXDomain, "ads.blocked.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"zero A", BlockZero, "blocked.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"0.0.0.0"}},
+		{"zero AAAA", BlockZero, "blocked.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"::"}},
+		{"zero TXT", BlockZero, "blocked.example.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, nil},
+		{"not listed", BlockNXDomain, "example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{stubAddress.String()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := startResolver(t, NewCache(), upstream)
+			r.SetBlocklist(list, tt.response)
+
+			conn := dial(t, r, "udp")
+			msg := ask(t, conn, "udp", newQuery(t, 42, tt.qname, tt.qtype))
+			if msg.ID != 42 || !msg.Response {
+				t.Fatalf("got header %+v", msg.Header)
+			}
+			if msg.RCode != tt.rcode {
+				t.Errorf("got rcode %v, want %v", msg.RCode, tt.rcode)
+			}
+			ips := answerIPs(msg)
+			if len(ips) != len(tt.ips) {
+				t.Fatalf("got answers %v, want %v", ips, tt.ips)
+			}
+			for i := range ips {
+				if ips[i] != tt.ips[i] {
+					t.Errorf("got answers %v, want %v", ips, tt.ips)
+				}
+			}
+		})
+	}
+}
+
+func TestResolverRecordsAnswer(t *testing.T) {
+	upstream := startUpstream(t)
+	cache := NewCache()
+	r := startResolver(t, cache, upstream)
+	conn := dial(t, r, "udp")
+
+	// The queue records the query under the sending process before it is
+	// redirected to the resolver
+	const pid = 4242
+	local := conn.LocalAddr().(*net.UDPAddr)
+	query := newQuery(t, 99, "tracked.example.", dnsmessage.TypeA)
+	if _, err := cache.Query(pid, local.IP, uint16(local.Port), query); err != nil {
+		t.Fatal(err)
+	}
+
+	ask(t, conn, "udp", query)
+
+	// Lookup falls back to other processes, the answer must be filed
+	// under pid itself
+	cache.Lock()
+	e, ok := cache.byPID[pid][stubAddress.String()]
+	cache.Unlock()
+	if !ok || e.domain != "tracked.example" {
+		t.Errorf("answer for pid %d = %q, %v, want tracked.example", pid, e.domain, ok)
+	}
+}
@@ -0,0 +1,298 @@
+package geoip
+
+import (
+	"cmp"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// csvDB is a database read from a DB-IP or IP2Location lite CSV file: a
+// sorted list of address ranges, each pointing to a record. IPv4 ranges
+// are kept apart in 32 bits, as they make up most of the rows.
+type csvDB struct {
+	v4      []range4
+	v6      []range6
+	records []Record
+}
+
+type range4 struct {
+	start, end uint32
+	record     int32
+}
+
+type range6 struct {
+	start, end u128
+	record     int32
+}
+
+type u128 struct {
+	hi, lo uint64
+}
+
+func (a u128) less(b u128) bool {
+	return a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo)
+}
+
+func u128From(addr netip.Addr) u128 {
+	b := addr.As16()
+	var v u128
+	for i := 0; i < 8; i++ {
+		v.hi = v.hi<<8 | uint64(b[i])
+		v.lo = v.lo<<8 | uint64(b[i+8])
+	}
+	return v
+}
+
+// csvColumns are the columns of the fields of a row, -1 when the format
+// lacks it
+type csvColumns struct {
+	country, continent, city, lat, lon, asn, org int
+}
+
+// The columns after the range of the supported files:
+//
+//	DB-IP country:        country
+//	DB-IP city:           continent, country, region, city, latitude, longitude
+//	DB-IP ASN:            asn, org
+//	IP2Location DB1:      country, country name
+//	IP2Location DB5/DB11: country, country name, region, city, latitude, longitude, ...
+//	IP2Location ASN:      cidr, asn, org
+var (
+	dbipColumns = map[Kind]csvColumns{
+		KindCountry: {country: 2, continent: -1, city: -1, lat: -1, lon: -1, asn: -1, org: -1},
+		KindCity:    {continent: 2, country: 3, city: 5, lat: 6, lon: 7, asn: -1, org: -1},
+		KindASN:     {asn: 2, org: 3, country: -1, continent: -1, city: -1, lat: -1, lon: -1},
+	}
+	ip2locationColumns = map[Kind]csvColumns{
+		KindCountry: {country: 2, continent: -1, city: -1, lat: -1, lon: -1, asn: -1, org: -1},
+		KindCity:    {country: 2, continent: -1, city: 5, lat: 6, lon: 7, asn: -1, org: -1},
+		KindASN:     {asn: 3, org: 4, country: -1, continent: -1, city: -1, lat: -1, lon: -1},
+	}
+)
+
+// openCSV loads a CSV file. DB-IP files give the range as addresses and
+// IP2Location files as decimal numbers, which tells the formats apart.
+func openCSV(path string, kind Kind) (*csvDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	db := &csvDB{}
+	records := make(map[Record]int32)
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	for line := 1; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 columns", line)
+		}
+
+		start, end, columns, err := parseRange(row[0], row[1], kind)
+		if err != nil {
+			if line == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		record, err := parseRecord(row, columns)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if record == (Record{}) {
+			continue
+		}
+		i, ok := records[record]
+		if !ok {
+			i = int32(len(db.records))
+			db.records = append(db.records, record)
+			records[record] = i
+		}
+		db.add(start, end, i)
+	}
+
+	slices.SortFunc(db.v4, func(a, b range4) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	slices.SortFunc(db.v6, func(a, b range6) int {
+		switch {
+		case a.start.less(b.start):
+			return -1
+		case b.start.less(a.start):
+			return 1
+		}
+		return 0
+	})
+	return db, nil
+}
+
+// parseRange reads the first and last address of a row and the columns of
+// the file format they are written in
+func parseRange(first, last string, kind Kind) (netip.Addr, netip.Addr, csvColumns, error) {
+	if start, err := netip.ParseAddr(first); err == nil {
+		end, err := netip.ParseAddr(last)
+		if err != nil || start.Is4() != end.Is4() {
+			return netip.Addr{}, netip.Addr{}, csvColumns{}, fmt.Errorf("invalid range %s-%s", first, last)
+		}
+		return start, end, dbipColumns[kind], nil
+	}
+	start, err1 := parseDecimal(first)
+	end, err2 := parseDecimal(last)
+	if err1 != nil || err2 != nil {
+		return netip.Addr{}, netip.Addr{}, csvColumns{}, fmt.Errorf("invalid range %s-%s", first, last)
+	}
+	return start, end, ip2locationColumns[kind], nil
+}
+
+// parseDecimal reads an address written as a number, as IP2Location does.
+// Numbers below 2^32 are IPv4 addresses.
+func parseDecimal(s string) (netip.Addr, error) {
+	if s == "" {
+		return netip.Addr{}, errors.New("empty number")
+	}
+	var v u128
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return netip.Addr{}, fmt.Errorf("invalid number %q", s)
+		}
+		// v = v*10 + c
+		hi, lo := bits.Mul64(v.lo, 10)
+		top, hi10 := bits.Mul64(v.hi, 10)
+		hi, carry := bits.Add64(hi, hi10, 0)
+		if top != 0 || carry != 0 {
+			return netip.Addr{}, fmt.Errorf("number %q out of range", s)
+		}
+		lo, carry = bits.Add64(lo, uint64(c-'0'), 0)
+		hi, carry = bits.Add64(hi, 0, carry)
+		if carry != 0 {
+			return netip.Addr{}, fmt.Errorf("number %q out of range", s)
+		}
+		v = u128{hi: hi, lo: lo}
+	}
+	if v.hi == 0 && v.lo <= 0xffffffff {
+		return netip.AddrFrom4([4]byte{byte(v.lo >> 24), byte(v.lo >> 16), byte(v.lo >> 8), byte(v.lo)}), nil
+	}
+	var b [16]byte
+	for i := 0; i < 8; i++ {
+		b[i] = byte(v.hi >> (56 - 8*i))
+		b[i+8] = byte(v.lo >> (56 - 8*i))
+	}
+	return netip.AddrFrom16(b), nil
+}
+
+// parseRecord reads the fields of a row. Unknown values, which the files
+// write as "-" or "ZZ", are left empty.
+func parseRecord(row []string, c csvColumns) (Record, error) {
+	field := func(i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		v := strings.TrimSpace(row[i])
+		if v == "-" {
+			return ""
+		}
+		return v
+	}
+
+	var r Record
+	r.Country = strings.ToUpper(field(c.country))
+	if r.Country == "ZZ" {
+		r.Country = ""
+	}
+	r.Continent = strings.ToUpper(field(c.continent))
+	if r.Continent == "ZZ" {
+		r.Continent = ""
+	}
+	r.City = field(c.city)
+	for _, f := range []struct {
+		column int
+		dst    *float64
+	}{{c.lat, &r.Latitude}, {c.lon, &r.Longitude}} {
+		if s := field(f.column); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return Record{}, fmt.Errorf("invalid coordinate %q", s)
+			}
+			*f.dst = v
+		}
+	}
+	if s := field(c.asn); s != "" {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid asn %q", s)
+		}
+		r.ASN = uint(asn)
+	}
+	r.Org = field(c.org)
+	completeLocation(&r.Location)
+	return r, nil
+}
+
+// add stores the range from start to end. IPv4-mapped ranges, which the
+// IPv6 files of IP2Location use for IPv4, go with the IPv4 ranges.
+func (db *csvDB) add(start, end netip.Addr, record int32) {
+	if start.Unmap().Is4() && end.Unmap().Is4() {
+		s, e := start.Unmap().As4(), end.Unmap().As4()
+		db.v4 = append(db.v4, range4{
+			start:  uint32(s[0])<<24 | uint32(s[1])<<16 | uint32(s[2])<<8 | uint32(s[3]),
+			end:    uint32(e[0])<<24 | uint32(e[1])<<16 | uint32(e[2])<<8 | uint32(e[3]),
+			record: record,
+		})
+		return
+	}
+	db.v6 = append(db.v6, range6{start: u128From(start), end: u128From(end), record: record})
+}
+
+func (db *csvDB) Lookup(ip net.IP) (Record, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Record{}, fmt.Errorf("invalid IP address %v", ip)
+	}
+	addr = addr.Unmap()
+
+	if addr.Is4() {
+		b := addr.As4()
+		v := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+		i := sort.Search(len(db.v4), func(i int) bool { return db.v4[i].start > v }) - 1
+		if i >= 0 && v <= db.v4[i].end {
+			return db.records[db.v4[i].record], nil
+		}
+		return Record{}, nil
+	}
+
+	v := u128From(addr)
+	i := sort.Search(len(db.v6), func(i int) bool { return v.less(db.v6[i].start) }) - 1
+	if i >= 0 && !db.v6[i].end.less(v) {
+		return db.records[db.v6[i].record], nil
+	}
+	return Record{}, nil
+}
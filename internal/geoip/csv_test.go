@@ -0,0 +1,219 @@
+package geoip
+
+import (
+	"compress/gzip"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCSV writes a database file into a temporary directory and returns
+// its path. Files named *.gz are compressed.
+func writeCSV(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !strings.HasSuffix(name, ".gz") {
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	gz := gzip.NewWriter(f)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" for an error
+	}{
+		{"0", "0.0.0.0"},
+		{"3221225985", "192.0.2.1"},
+		{"4294967295", "255.255.255.255"},
+		{"4294967296", "::1:0:0"},
+		{"281470698520576", "::ffff:1.0.0.0"},
+		{"42540766411282592856903984951653826560", "2001:db8::"},
+		{"340282366920938463463374607431768211455", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"340282366920938463463374607431768211456", ""},
+		{"", ""},
+		{"-1", ""},
+		{"12a", ""},
+		{"1.0.0.0", ""},
+	}
+	for _, tt := range tests {
+		got, err := parseDecimal(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseDecimal(%q) = %s, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != netip.MustParseAddr(tt.want) {
+			t.Errorf("parseDecimal(%q) = %s, %v, want %s", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		first, last string
+		start, end  string // "" for an error
+		columns     csvColumns
+	}{
+		{"1.0.0.0", "1.0.0.255", "1.0.0.0", "1.0.0.255", dbipColumns[KindCity]},
+		{"2001:db8::", "2001:db8::ffff", "2001:db8::", "2001:db8::ffff", dbipColumns[KindCity]},
+		{"16777216", "16777471", "1.0.0.0", "1.0.0.255", ip2locationColumns[KindCity]},
+		{"1.0.0.0", "2001:db8::", "", "", csvColumns{}},
+		{"1.0.0.0", "16777471", "", "", csvColumns{}},
+		{"ip_from", "ip_to", "", "", csvColumns{}},
+	}
+	for _, tt := range tests {
+		start, end, columns, err := parseRange(tt.first, tt.last, KindCity)
+		if tt.start == "" {
+			if err == nil {
+				t.Errorf("parseRange(%q, %q) succeeded, want an error", tt.first, tt.last)
+			}
+			continue
+		}
+		if err != nil || start.String() != tt.start || end.String() != tt.end || columns != tt.columns {
+			t.Errorf("parseRange(%q, %q) = %s, %s, %+v, %v, want %s, %s, %+v",
+				tt.first, tt.last, start, end, columns, err, tt.start, tt.end, tt.columns)
+		}
+	}
+}
+
+func TestOpenCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		kind    Kind
+		content string
+		lookups map[string]Record
+	}{
+		{
+			name: "dbip country",
+			file: "dbip-country-lite.csv.gz",
+			kind: KindCountry,
+			content: "1.0.0.0,1.0.0.255,AU\n" +
+				"1.0.1.0,1.0.3.255,CN\n" +
+				"2.16.0.0,2.16.0.255,FR\n" +
+				"2001:db8::,2001:db8::ffff,NO\n" +
+				"2001:db8:1::,2001:db8:1::ffff,ZZ\n",
+			lookups: map[string]Record{
+				"1.0.0.7":        {Location: Location{Country: "AU", Continent: "OC"}},
+				"1.0.2.1":        {Location: Location{Country: "CN", Continent: "AS"}},
+				"2.16.0.1":       {Location: Location{Country: "FR", Continent: "EU", EU: true}},
+				"2001:db8::1":    {Location: Location{Country: "NO", Continent: "EU"}},
+				"2001:db8:1::1":  {},
+				"1.0.4.0":        {},
+				"::ffff:1.0.0.1": {Location: Location{Country: "AU", Continent: "OC"}},
+			},
+		},
+		{
+			name:    "dbip city",
+			file:    "dbip-city-lite.csv",
+			kind:    KindCity,
+			content: `1.0.0.0,1.0.0.255,OC,AU,Queensland,"South Brisbane",-27.4767,153.017` + "\n",
+			lookups: map[string]Record{
+				"1.0.0.1": {Location: Location{Country: "AU", Continent: "OC", City: "South Brisbane", Latitude: -27.4767, Longitude: 153.017}},
+			},
+		},
+		{
+			name:    "dbip asn",
+			file:    "dbip-asn-lite.csv",
+			kind:    KindASN,
+			content: "1.0.0.0,1.0.0.255,13335,\"Cloudflare, Inc.\"\n",
+			lookups: map[string]Record{
+				"1.0.0.1": {ASN: 13335, Org: "Cloudflare, Inc."},
+			},
+		},
+		{
+			name: "ip2location country",
+			file: "IP2LOCATION-LITE-DB1.CSV",
+			kind: KindCountry,
+			content: `"ip_from","ip_to","country_code","country_name"` + "\n" +
+				`"0","16777215","-","-"` + "\n" +
+				`"16777216","16777471","US","United States of America"` + "\n",
+			lookups: map[string]Record{
+				"0.0.0.1": {},
+				"1.0.0.1": {Location: Location{Country: "US", Continent: "NA"}},
+			},
+		},
+		{
+			name: "ip2location ipv6 city",
+			file: "IP2LOCATION-LITE-DB5.IPV6.CSV",
+			kind: KindCity,
+			content: `"281470698520576","281470698520831","DE","Germany","Hessen","Frankfurt am Main","50.1155","8.6842"` + "\n" +
+				`"42540766411282592856903984951653826560","42540766411282592856903984951653892095","IT","Italy","Lazio","Rome","41.8919","12.5113"` + "\n",
+			lookups: map[string]Record{
+				// IPv4-mapped ranges answer for IPv4 addresses
+				"1.0.0.9":        {Location: Location{Country: "DE", Continent: "EU", EU: true, City: "Frankfurt am Main", Latitude: 50.1155, Longitude: 8.6842}},
+				"2001:db8::abcd": {Location: Location{Country: "IT", Continent: "EU", EU: true, City: "Rome", Latitude: 41.8919, Longitude: 12.5113}},
+			},
+		},
+		{
+			name:    "ip2location asn",
+			file:    "IP2LOCATION-LITE-ASN.CSV",
+			kind:    KindASN,
+			content: `"16777216","16777471","1.0.0.0/24","13335","CloudFlare Inc"` + "\n",
+			lookups: map[string]Record{
+				"1.0.0.1": {ASN: 13335, Org: "CloudFlare Inc"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := openCSV(writeCSV(t, tt.file, tt.content), tt.kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ip, want := range tt.lookups {
+				got, err := db.Lookup(net.ParseIP(ip))
+				if err != nil || got != want {
+					t.Errorf("Lookup(%s) = %+v, %v, want %+v", ip, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenCSVMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string // part of the error
+	}{
+		{"too few columns", "1.0.0.0,1.0.0.255\n", "line 1: expected at least 3 columns"},
+		{"bad range after the header", "1.0.0.0,1.0.0.255,OC,AU,,,0,0\n1.0.1.0,bogus,OC,AU,,,0,0\n", "line 2: invalid range"},
+		{"mixed families", "1.0.0.0,1.0.0.255,OC,AU,,,0,0\n1.0.1.0,2001:db8::,OC,AU,,,0,0\n", "line 2: invalid range"},
+		{"bad coordinate", "1.0.0.0,1.0.0.255,OC,AU,,,north,0\n", "line 1: invalid coordinate"},
+		{"unbalanced quotes", "1.0.0.0,1.0.0.255,\"OC,AU\n", "extraneous or missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := openCSV(writeCSV(t, "dbip-city-lite.csv", tt.content), KindCity)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("openCSV() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+
+	_, err := openCSV(writeCSV(t, "dbip-asn-lite.csv", "1.0.0.0,1.0.0.255,ASx,Org\n"), KindASN)
+	if err == nil || !strings.Contains(err.Error(), "invalid asn") {
+		t.Errorf("openCSV() = %v, want an invalid asn error", err)
+	}
+}
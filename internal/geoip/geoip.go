@@ -1,52 +1,241 @@
+// Package geoip locates addresses and finds the networks they belong to.
+// MaxMind and DB-IP databases in the mmdb format and the DB-IP and
+// IP2Location lite CSV files are supported.
 package geoip
 
 import (
+	"fmt"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/lonelysadness/netmonitor/internal/logger"
-	"github.com/oschwald/geoip2-golang"
 )
 
-var db *geoip2.Reader
-var asnDB *geoip2.Reader
+// Kind is the data a database file holds
+type Kind int
 
-func Init(geoipPath string, asnPath string) error {
-	var err error
-	db, err = geoip2.Open(geoipPath)
-	if err != nil {
-		return err
+const (
+	KindCountry Kind = iota + 1
+	KindCity
+	KindASN
+	// KindOverlay labels local networks, see openOverlay
+	KindOverlay
+)
+
+var kindNames = map[Kind]string{
+	KindCountry: "country",
+	KindCity:    "city",
+	KindASN:     "asn",
+	KindOverlay: "overlay",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
 	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Location is where an address is registered. Empty codes mean the
+// database has no answer, for example for private addresses.
+type Location struct {
+	Country   string // ISO 3166-1 code
+	Continent string // two letter continent code
+	EU        bool   // Country is a member of the European Union
+	City      string // only set by city databases
+	Latitude  float64
+	Longitude float64
+}
+
+// Record is what the databases know about an address
+type Record struct {
+	Location
+	ASN uint
+	Org string // organization announcing the network of ASN
+	// Label names the overlay network holding the address; its record
+	// replaces the databases
+	Label string
+	Scope string // ScopeLocalhost, ScopeLAN or ScopeInternet
+	// LocationUnavailable and ASNUnavailable are set by Resolver.Lookup
+	// when the database of the fields was not loaded, as opposed to having
+	// no answer for the address
+	LocationUnavailable bool
+	ASNUnavailable      bool
+}
+
+// Database answers lookups from one database file. A database only fills
+// the fields of its Kind.
+type Database interface {
+	Lookup(ip net.IP) (Record, error)
+}
+
+// Open reads the database of the given kind at path. Files ending in
+// ".mmdb" are MaxMind databases; ".csv" files, optionally gzipped, are
+// DB-IP or IP2Location lite files.
+func Open(path string, kind Kind) (Database, error) {
+	if kind == KindOverlay {
+		return openOverlay(path)
+	}
+	switch ext := filepath.Ext(strings.TrimSuffix(path, ".gz")); ext {
+	case ".mmdb":
+		return openMMDB(path, kind)
+	case ".csv":
+		return openCSV(path, kind)
+	default:
+		return nil, fmt.Errorf("unknown database format %q of %s, expected .mmdb or .csv", ext, path)
+	}
+}
+
+// Paths are the database files of a Resolver. City replaces Country when
+// both are given; an empty path disables the database.
+type Paths struct {
+	Country string
+	City    string
+	ASN     string
+	Overlay string
+}
+
+// Status tells whether a database is in use
+type Status struct {
+	Kind   Kind
+	Path   string
+	Loaded time.Time // when the database in use was opened, zero if none is
+	Error  error     // why the last attempt to open the file failed
+}
+
+// slot holds the database currently opened from one file
+type slot struct {
+	path  string
+	kind  Kind
+	state atomic.Pointer[slotState]
+}
 
-	asnDB, err = geoip2.Open(asnPath)
+type slotState struct {
+	db     Database
+	loaded time.Time
+	err    error
+}
+
+// open reads the file of s. On error the database in use is kept.
+func (s *slot) open() error {
+	db, err := Open(s.path, s.kind)
 	if err != nil {
+		err = fmt.Errorf("%s database %s: %w", s.kind, s.path, err)
+		state := &slotState{err: err}
+		if current := s.state.Load(); current != nil {
+			state.db, state.loaded = current.db, current.loaded
+		}
+		s.state.Store(state)
 		return err
 	}
+	s.state.Store(&slotState{db: db, loaded: time.Now()})
 	return nil
 }
 
-func Close() {
-	if db != nil {
-		db.Close()
+// lookup returns the answer of the database in use, and false when there
+// is none
+func (s *slot) lookup(ip net.IP) (Record, bool) {
+	if s == nil {
+		return Record{}, false
+	}
+	state := s.state.Load()
+	if state == nil || state.db == nil {
+		return Record{}, false
 	}
-	if asnDB != nil {
-		asnDB.Close()
+	record, err := state.db.Lookup(ip)
+	if err != nil {
+		logger.Log.Debug("GeoIP lookup failed", "kind", s.kind, "ip", ip, "err", err)
+		return Record{}, true
 	}
+	return record, true
 }
 
-func LookupCountry(ip net.IP) string {
-	country, err := db.Country(ip)
-	if err != nil {
-		logger.Log.Printf("Error looking up country for IP %s: %v", ip, err)
-		return "Unknown"
+func (s *slot) status() Status {
+	st := Status{Kind: s.kind, Path: s.path}
+	if state := s.state.Load(); state != nil {
+		st.Loaded, st.Error = state.loaded, state.err
 	}
-	return country.Country.IsoCode
+	return st
 }
 
-func LookupASN(ip net.IP) (string, uint, string) {
-	record, err := asnDB.ASN(ip)
-	if err != nil {
-		logger.Log.Printf("Error looking up ASN for IP %s: %v", ip, err)
-		return "Unknown", 0, "Unknown"
+// Resolver looks addresses up in a location and an ASN database. The
+// databases are swapped atomically when Watch sees their files change, so
+// lookups never wait for a reload. GeoIP data is optional: a database that
+// cannot be opened leaves its fields empty until its file appears.
+type Resolver struct {
+	location *slot // nil when disabled
+	asn      *slot
+	overlay  *slot
+}
+
+// NewResolver opens the databases at paths. Databases that fail to open
+// are logged and can be checked with Status.
+func NewResolver(paths Paths) *Resolver {
+	r := &Resolver{}
+	switch {
+	case paths.City != "":
+		r.location = &slot{path: paths.City, kind: KindCity}
+	case paths.Country != "":
+		r.location = &slot{path: paths.Country, kind: KindCountry}
+	}
+	if paths.ASN != "" {
+		r.asn = &slot{path: paths.ASN, kind: KindASN}
+	}
+	if paths.Overlay != "" {
+		r.overlay = &slot{path: paths.Overlay, kind: KindOverlay}
+	}
+	for _, s := range r.slots() {
+		if err := s.open(); err != nil {
+			logger.Log.Warn("continuing without GeoIP data", "kind", s.kind, "err", err)
+		}
+	}
+	return r
+}
+
+// slots returns the enabled databases
+func (r *Resolver) slots() []*slot {
+	var slots []*slot
+	for _, s := range []*slot{r.location, r.asn, r.overlay} {
+		if s != nil {
+			slots = append(slots, s)
+		}
+	}
+	return slots
+}
+
+// Lookup returns the location and network of ip. Addresses in an overlay
+// network get the label and pseudo-ASN of the network and nothing from the
+// databases. Addresses without a country of their own, such as anycast
+// ones, get the country of the network they are registered to. A nil
+// Resolver has no databases.
+func (r *Resolver) Lookup(ip net.IP) Record {
+	if r == nil {
+		return Record{Scope: ScopeOf(ip), LocationUnavailable: true, ASNUnavailable: true}
+	}
+	if record, _ := r.overlay.lookup(ip); record.Label != "" {
+		record.Scope = ScopeOf(ip)
+		return record
+	}
+	record, ok := r.location.lookup(ip)
+	record.Scope = ScopeOf(ip)
+	record.LocationUnavailable = !ok
+	network, ok := r.asn.lookup(ip)
+	record.ASN, record.Org = network.ASN, network.Org
+	record.ASNUnavailable = !ok
+	return record
+}
+
+// Status returns the state of the enabled databases
+func (r *Resolver) Status() []Status {
+	if r == nil {
+		return nil
+	}
+	var status []Status
+	for _, s := range r.slots() {
+		status = append(status, s.status())
 	}
-	return record.AutonomousSystemOrganization, record.AutonomousSystemNumber, ""
+	return status
 }
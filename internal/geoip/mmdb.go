@@ -0,0 +1,89 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// mmdb is a MaxMind or DB-IP database in the MaxMind DB format
+type mmdb struct {
+	reader *geoip2.Reader
+	kind   Kind
+}
+
+// mmdbTypes are the parts of the database type each kind needs; city
+// databases also answer country lookups
+var mmdbTypes = map[Kind][]string{
+	KindCountry: {"Country", "City"},
+	KindCity:    {"City"},
+	KindASN:     {"ASN"},
+}
+
+// openMMDB reads the whole file instead of mapping it, so a swapped out
+// database stays valid for the lookups still using it and is freed by the
+// garbage collector
+func openMMDB(path string, kind Kind) (*mmdb, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := geoip2.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	dbType := reader.Metadata().DatabaseType
+	for _, t := range mmdbTypes[kind] {
+		if strings.Contains(dbType, t) {
+			return &mmdb{reader: reader, kind: kind}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a %s database", dbType, kind)
+}
+
+func (m *mmdb) Lookup(ip net.IP) (Record, error) {
+	switch m.kind {
+	case KindCity:
+		c, err := m.reader.City(ip)
+		if err != nil {
+			return Record{}, err
+		}
+		loc := Location{
+			Country:   c.Country.IsoCode,
+			Continent: c.Continent.Code,
+			EU:        c.Country.IsInEuropeanUnion,
+			City:      c.City.Names["en"],
+			Latitude:  c.Location.Latitude,
+			Longitude: c.Location.Longitude,
+		}
+		if loc.Country == "" {
+			loc.Country = c.RegisteredCountry.IsoCode
+			loc.EU = c.RegisteredCountry.IsInEuropeanUnion
+		}
+		return Record{Location: loc}, nil
+	case KindASN:
+		a, err := m.reader.ASN(ip)
+		if err != nil {
+			return Record{}, err
+		}
+		return Record{ASN: a.AutonomousSystemNumber, Org: a.AutonomousSystemOrganization}, nil
+	default:
+		c, err := m.reader.Country(ip)
+		if err != nil {
+			return Record{}, err
+		}
+		loc := Location{
+			Country:   c.Country.IsoCode,
+			Continent: c.Continent.Code,
+			EU:        c.Country.IsInEuropeanUnion,
+		}
+		if loc.Country == "" {
+			loc.Country = c.RegisteredCountry.IsoCode
+			loc.EU = c.RegisteredCountry.IsInEuropeanUnion
+		}
+		return Record{Location: loc}, nil
+	}
+}
@@ -0,0 +1,102 @@
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lonelysadness/netmonitor/internal/iplist"
+)
+
+// The scopes of an address, from the closest to the farthest
+const (
+	ScopeLocalhost = "localhost"
+	ScopeLAN       = "lan"
+	ScopeInternet  = "internet"
+)
+
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// ScopeOf returns where ip is: ScopeLocalhost for loopback addresses,
+// ScopeLAN for private (RFC 1918 and ULA), shared CGNAT, link-local and
+// multicast addresses, and ScopeInternet for the rest
+func ScopeOf(ip net.IP) string {
+	switch {
+	case ip.IsLoopback():
+		return ScopeLocalhost
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast(), ip.IsMulticast(),
+		ip.IsUnspecified(), ip.Equal(net.IPv4bcast):
+		return ScopeLAN
+	}
+	if addr, ok := netip.AddrFromSlice(ip); ok && cgnat.Contains(addr.Unmap()) {
+		return ScopeLAN
+	}
+	return ScopeInternet
+}
+
+// overlay labels local networks, which the GeoIP databases know nothing
+// about. The longest prefix holding an address wins.
+type overlay struct {
+	tree *iplist.Tree[Record]
+}
+
+// openOverlay reads an overlay file of lines holding a CIDR, a label and
+// optionally a pseudo-ASN, such as
+//
+//	10.96.0.0/12  k8s-pods  AS64512
+//
+// "#" starts a comment. Labels are lowercased.
+func openOverlay(path string) (*overlay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	o := &overlay{tree: &iplist.Tree[Record]{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected a CIDR, a label and an optional ASN", line)
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: network %s has no label", line, fields[0])
+		}
+		p, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		record := Record{Label: strings.ToLower(fields[1])}
+		if len(fields) == 3 {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[2]), "AS"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid asn %q", line, fields[2])
+			}
+			record.ASN = uint(asn)
+			record.Org = record.Label
+		}
+		o.tree.Insert(p.Masked(), record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	o.tree.Index()
+	return o, nil
+}
+
+func (o *overlay) Lookup(ip net.IP) (Record, error) {
+	_, record, _ := o.tree.Lookup(ip)
+	return record, nil
+}
@@ -0,0 +1,190 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"golang.org/x/sys/unix"
+)
+
+// settleTime is how long a database file has to stay unchanged before it
+// is reopened, so that a file still being written is not read
+const settleTime = 2 * time.Second
+
+// watchMask selects the events of files being written or moved into
+// place, and of directories appearing on the way to a database
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE
+
+// Watch reopens a database when its file is rewritten or replaced, until
+// ctx is done. Updaters usually write a new file and rename it over the old
+// one, so the directories of the files are watched rather than the files.
+// A directory that does not exist yet is waited for by watching its
+// nearest existing parent. A database that fails to open is kept as it was.
+func (r *Resolver) Watch(ctx context.Context) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		logger.Log.Warn("not watching GeoIP databases", "err", err)
+		return
+	}
+	// A non-blocking descriptor goes through the runtime poller, so closing
+	// the file ends a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	var paths []string
+	for _, s := range r.slots() {
+		paths = append(paths, filepath.Clean(s.path))
+	}
+	w := &watcher{fd: fd, dirs: make(map[int]string), watched: make(map[string]int)}
+	w.watch(paths)
+	if len(w.dirs) == 0 {
+		return
+	}
+
+	events := make(chan inotifyEvent)
+	go readEvents(ctx, f, events)
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	pending := make(map[*slot]bool)
+	settle := time.NewTimer(settleTime)
+	settle.Stop()
+	changed := func(path string) {
+		for _, s := range r.slots() {
+			if filepath.Clean(s.path) == path {
+				pending[s] = true
+				settle.Reset(settleTime)
+			}
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			dir, ok := w.dirs[ev.wd]
+			if !ok {
+				continue
+			}
+			if ev.mask&unix.IN_IGNORED != 0 {
+				// The directory went away, wait for it to come back
+				delete(w.dirs, ev.wd)
+				delete(w.watched, dir)
+			} else {
+				changed(filepath.Join(dir, ev.name))
+				if ev.mask&unix.IN_ISDIR == 0 {
+					continue
+				}
+			}
+			// A database written before its new directory was watched
+			// is picked up as well
+			for _, path := range w.watch(paths) {
+				if _, err := os.Stat(path); err == nil {
+					changed(path)
+				}
+			}
+		case <-settle.C:
+			for s := range pending {
+				if err := s.open(); err != nil {
+					logger.Log.Warn("keeping current GeoIP database, reload failed", "kind", s.kind, "err", err)
+					continue
+				}
+				logger.Log.Info("reloaded GeoIP database", "kind", s.kind, "path", s.path)
+			}
+			clear(pending)
+		}
+	}
+}
+
+// watcher holds the inotify watches of the directories of the databases
+type watcher struct {
+	fd      int
+	dirs    map[int]string // watched directories by watch descriptor
+	watched map[string]int // watch descriptors by directory
+}
+
+// watch adds watches for the directories of paths, or for their nearest
+// existing parents while they do not exist. It returns the paths whose
+// directory is watched from now on.
+func (w *watcher) watch(paths []string) []string {
+	var added []string
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if _, ok := w.watched[dir]; ok {
+			continue
+		}
+		target := existingDir(dir)
+		if _, ok := w.watched[target]; !ok {
+			wd, err := unix.InotifyAddWatch(w.fd, target, watchMask)
+			if err != nil {
+				logger.Log.Warn("not watching GeoIP databases", "dir", target, "err", err)
+				continue
+			}
+			w.dirs[wd] = target
+			w.watched[target] = wd
+		}
+		if target == dir {
+			added = append(added, path)
+		}
+	}
+	return added
+}
+
+// existingDir returns dir or, if it does not exist, its nearest parent
+// that does
+func existingDir(dir string) string {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// inotifyEvent is an event read from inotify: the name of the file it
+// concerns in the directory watched by wd, empty for the directory itself
+type inotifyEvent struct {
+	wd   int
+	mask uint32
+	name string
+}
+
+// readEvents sends the events inotify reports until f is closed
+func readEvents(ctx context.Context, f *os.File, events chan<- inotifyEvent) {
+	defer close(events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameStart := off + unix.SizeofInotifyEvent
+			off = nameStart + int(ev.Len)
+			if off > n || (ev.Len == 0 && ev.Mask&unix.IN_IGNORED == 0) {
+				continue
+			}
+			name := string(bytes.TrimRight(buf[nameStart:off], "\x00"))
+			select {
+			case events <- inotifyEvent{wd: int(ev.Wd), mask: ev.Mask, name: name}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package geoip
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchMissingDirectory(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "geoip", "dbip", "country.csv")
+	r := NewResolver(Paths{Country: path})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Watch(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	// Give Watch time to add its watches
+	time.Sleep(100 * time.Millisecond)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("1.0.0.0,1.0.0.255,AU\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * settleTime)
+	for time.Now().Before(deadline) {
+		if r.Lookup(net.ParseIP("1.0.0.1")).Country == "AU" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("database in a directory created after Watch started was not loaded")
+}
@@ -0,0 +1,338 @@
+// Package history keeps the connections netmonitor decided on in a
+// directory of append-only segment files, one JSON event per line
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/lonelysadness/netmonitor/internal/api"
+)
+
+const (
+	// A segment is closed once it spans segmentSpan or grows to
+	// segmentSize, so retention can drop history in small steps
+	segmentSpan = time.Hour
+	segmentSize = 64 << 20
+
+	segmentExt = ".jsonl"
+	// segmentLayout names segments by the time of their first event, so
+	// they sort by name
+	segmentLayout = "20060102T150405.000000000Z"
+)
+
+// Retention bounds the history; zero values leave it unbounded
+type Retention struct {
+	MaxAge  time.Duration
+	MaxSize int64 // bytes
+}
+
+// Store appends connection events to the segments in its directory
+type Store struct {
+	sync.Mutex
+	dir       string
+	retention Retention
+
+	// the segment being written, nil until the first event
+	file    *os.File
+	w       *bufio.Writer
+	started time.Time
+	size    int64
+}
+
+// Open creates the directory when needed and drops the history that is
+// past retention. Events are appended to a new segment.
+func Open(dir string, retention Retention) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	s := &Store{dir: dir, retention: retention}
+	if err := s.Expire(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Append writes ev to the current segment. It is buffered until Flush.
+func (s *Store) Append(ev api.ConnectionEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil || ev.Time.Sub(s.started) >= segmentSpan || s.size+int64(len(line)) > segmentSize {
+		if err := s.rotate(ev.Time); err != nil {
+			return err
+		}
+	}
+	n, err := s.w.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate closes the current segment and starts one at t
+func (s *Store) rotate(t time.Time) error {
+	if err := s.closeSegment(); err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, t.UTC().Format(segmentLayout)+segmentExt)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create history segment: %w", err)
+	}
+	s.file, s.w, s.started, s.size = f, bufio.NewWriter(f), t, 0
+	return nil
+}
+
+func (s *Store) closeSegment() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file, s.w = nil, nil
+	return err
+}
+
+// Flush writes the buffered events to disk
+func (s *Store) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+// Close flushes and closes the current segment
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.closeSegment()
+}
+
+type segment struct {
+	path    string
+	started time.Time
+	size    int64
+}
+
+// segments lists the segments in the directory, the oldest first
+func (s *Store) segments() ([]segment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		started, err := time.Parse(segmentLayout, strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(s.dir, name), started: started, size: info.Size()})
+	}
+	slices.SortFunc(segments, func(a, b segment) int { return a.started.Compare(b.started) })
+	return segments, nil
+}
+
+// Expire deletes the segments whose events are all older than MaxAge, and
+// then the oldest ones while the history is larger than MaxSize. The
+// segment being written is kept.
+func (s *Store) Expire() error {
+	s.Lock()
+	defer s.Unlock()
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+	var result error
+	now := time.Now()
+	for i, seg := range segments {
+		if s.file != nil && seg.path == s.file.Name() {
+			break
+		}
+		// A segment ends where the next one starts
+		expired := s.retention.MaxAge > 0 && i+1 < len(segments) &&
+			now.Sub(segments[i+1].started) > s.retention.MaxAge
+		oversize := s.retention.MaxSize > 0 && total > s.retention.MaxSize
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		total -= seg.size
+	}
+	return result
+}
+
+// Query selects events from the history. Empty fields match any event.
+type Query struct {
+	Since time.Time
+	Until time.Time
+	// Process is a process name, an executable path or its base name
+	Process string
+	// Destination is a domain, which matches its subdomains too, a remote
+	// address or a CIDR
+	Destination string
+	Country     string
+	Verdict     string
+	// Limit keeps the latest Limit events, 0 keeps all
+	Limit int
+}
+
+func (q *Query) matches(ev *api.ConnectionEvent) bool {
+	c := &ev.Connection
+	if !q.Since.IsZero() && ev.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && ev.Time.After(q.Until) {
+		return false
+	}
+	if q.Process != "" && c.Process != q.Process && c.Path != q.Process &&
+		(c.Path == "" || filepath.Base(c.Path) != q.Process) {
+		return false
+	}
+	if q.Destination != "" && !matchDestination(q.Destination, c) {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(c.Country, q.Country) {
+		return false
+	}
+	if q.Verdict != "" && c.Verdict != q.Verdict {
+		return false
+	}
+	return true
+}
+
+func matchDestination(dest string, c *api.Connection) bool {
+	remote := c.Dst
+	if c.Inbound {
+		remote = c.Src
+	}
+	if _, n, err := net.ParseCIDR(dest); err == nil {
+		ip := net.ParseIP(remote)
+		return ip != nil && n.Contains(ip)
+	}
+	if ip := net.ParseIP(dest); ip != nil {
+		return ip.Equal(net.ParseIP(remote))
+	}
+	dest = strings.ToLower(strings.TrimSuffix(dest, "."))
+	return c.Domain == dest || strings.HasSuffix(c.Domain, "."+dest)
+}
+
+// Query returns the events matching q, the oldest first. Only the segments
+// overlapping [Since, Until] are read, and with a Limit only the newest of
+// them that hold enough matching events. Lines that cannot be read, such as
+// one cut short by a crash, are skipped.
+func (s *Store) Query(q Query) ([]api.ConnectionEvent, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	segments, err := s.segments()
+	s.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	window := inWindow(segments, q.Since, q.Until)
+	var events []api.ConnectionEvent
+	if q.Limit == 0 {
+		for _, seg := range window {
+			if events, err = scanSegment(seg.path, &q, events); err != nil {
+				return nil, err
+			}
+		}
+		return events, nil
+	}
+
+	for i := len(window) - 1; i >= 0 && len(events) < q.Limit; i-- {
+		found, err := scanSegment(window[i].path, &q, nil)
+		if err != nil {
+			return nil, err
+		}
+		events = append(found, events...)
+	}
+	if len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
+
+// inWindow returns the segments that may hold events between since and
+// until; zero times leave that end open. A segment ends where the next one
+// starts.
+func inWindow(segments []segment, since, until time.Time) []segment {
+	var window []segment
+	for i, seg := range segments {
+		if !until.IsZero() && seg.started.After(until) {
+			break
+		}
+		if !since.IsZero() && i+1 < len(segments) && !segments[i+1].started.After(since) {
+			continue
+		}
+		window = append(window, seg)
+	}
+	return window
+}
+
+// scanSegment appends the events of the segment at path matching q to
+// events, dropping the oldest ones beyond q.Limit
+func scanSegment(path string, q *Query, events []api.ConnectionEvent) ([]api.ConnectionEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return events, nil // expired meanwhile
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		var ev api.ConnectionEvent
+		if len(line) > 0 && json.Unmarshal(line, &ev) == nil && q.matches(&ev) {
+			events = append(events, ev)
+			if q.Limit > 0 && len(events) > q.Limit {
+				events = events[1:]
+			}
+		}
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
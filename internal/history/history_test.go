@@ -0,0 +1,294 @@
+package history
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/api"
+)
+
+func event(t time.Time, process, dst, domain, verdict string) api.ConnectionEvent {
+	return api.ConnectionEvent{
+		Time: t,
+		Connection: api.Connection{
+			Protocol: "TCP",
+			Src:      "192.0.2.1",
+			Dst:      dst,
+			DstPort:  443,
+			Domain:   domain,
+			Process:  process,
+			Path:     "/usr/bin/" + process,
+			Country:  "NL",
+			Verdict:  verdict,
+		},
+	}
+}
+
+func openStore(t *testing.T, retention Retention) (*Store, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "history")
+	s, err := Open(dir, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, dir
+}
+
+func segmentNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func appendAll(t *testing.T, s *Store, events ...api.ConnectionEvent) {
+	t.Helper()
+	for _, ev := range events {
+		if err := s.Append(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendAndQuery(t *testing.T) {
+	s, _ := openStore(t, Retention{})
+	now := time.Now().UTC().Truncate(time.Second)
+	appendAll(t, s,
+		event(now, "curl", "198.51.100.1", "api.example.com", "accept"),
+		event(now.Add(time.Second), "firefox", "203.0.113.5", "", "block"),
+	)
+
+	events, err := s.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if got := events[0]; !got.Time.Equal(now) || got.Connection.Process != "curl" || got.Connection.Domain != "api.example.com" {
+		t.Errorf("first event = %+v", got)
+	}
+	if events[1].Connection.Process != "firefox" {
+		t.Errorf("events out of order: %+v", events)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	s, dir := openStore(t, Retention{})
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	appendAll(t, s,
+		event(start, "curl", "198.51.100.1", "", "accept"),
+		event(start.Add(30*time.Minute), "curl", "198.51.100.1", "", "accept"),
+		// A segment spans at most segmentSpan
+		event(start.Add(segmentSpan), "curl", "198.51.100.1", "", "accept"),
+		event(start.Add(3*segmentSpan), "curl", "198.51.100.1", "", "accept"),
+	)
+
+	want := []string{
+		"20240501T100000.000000000Z.jsonl",
+		"20240501T110000.000000000Z.jsonl",
+		"20240501T130000.000000000Z.jsonl",
+	}
+	if got := segmentNames(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("segments = %v, want %v", got, want)
+	}
+
+	// A reopened store starts a new segment rather than appending to one
+	// it did not write
+	s.Close()
+	s2, err := Open(dir, Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	appendAll(t, s2, event(start.Add(3*segmentSpan+time.Minute), "curl", "198.51.100.1", "", "accept"))
+	if got := segmentNames(t, dir); len(got) != 4 {
+		t.Errorf("segments after reopening = %v, want 4", got)
+	}
+	events, err := s2.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Errorf("got %d events, want 5", len(events))
+	}
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		retention Retention
+		want      int // segments left
+	}{
+		{"unbounded", Retention{}, 4},
+		// The segment started 5h ago ends 3h ago, the one started 3h ago
+		// ends 1h ago
+		{"max age", Retention{MaxAge: 2 * time.Hour}, 3},
+		{"max age keeps the segment being written", Retention{MaxAge: time.Minute}, 2},
+		{"max size", Retention{MaxSize: 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := openStore(t, tt.retention)
+			appendAll(t, s,
+				event(now.Add(-5*time.Hour), "a", "198.51.100.1", "", "accept"),
+				event(now.Add(-3*time.Hour), "b", "198.51.100.1", "", "accept"),
+				event(now.Add(-time.Hour), "c", "198.51.100.1", "", "accept"),
+				event(now, "d", "198.51.100.1", "", "accept"),
+			)
+			if err := s.Expire(); err != nil {
+				t.Fatal(err)
+			}
+			if got := segmentNames(t, dir); len(got) != tt.want {
+				t.Errorf("segments = %v, want %d", got, tt.want)
+			}
+			// The current segment still takes events
+			appendAll(t, s, event(now.Add(time.Second), "e", "198.51.100.1", "", "accept"))
+		})
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	s, _ := openStore(t, Retention{})
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	appendAll(t, s,
+		event(start, "curl", "198.51.100.1", "api.example.com", "accept"),
+		event(start.Add(time.Minute), "firefox", "198.51.100.20", "example.com", "accept"),
+		event(start.Add(2*time.Hour), "firefox", "203.0.113.5", "tracker.example.net", "block"),
+		event(start.Add(3*time.Hour), "wget", "203.0.113.6", "", "drop"),
+	)
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []string // processes of the events returned
+	}{
+		{"all", Query{}, []string{"curl", "firefox", "firefox", "wget"}},
+		{"since", Query{Since: start.Add(time.Hour)}, []string{"firefox", "wget"}},
+		{"until", Query{Until: start.Add(time.Minute)}, []string{"curl", "firefox"}},
+		{"window", Query{Since: start.Add(time.Second), Until: start.Add(2 * time.Hour)}, []string{"firefox", "firefox"}},
+		{"process name", Query{Process: "firefox"}, []string{"firefox", "firefox"}},
+		{"process path", Query{Process: "/usr/bin/wget"}, []string{"wget"}},
+		{"domain and subdomains", Query{Destination: "example.com."}, []string{"curl", "firefox"}},
+		{"address", Query{Destination: "203.0.113.6"}, []string{"wget"}},
+		{"cidr", Query{Destination: "198.51.100.0/24"}, []string{"curl", "firefox"}},
+		{"country", Query{Country: "nl", Verdict: "block"}, []string{"firefox"}},
+		{"limit keeps the latest", Query{Limit: 3}, []string{"firefox", "firefox", "wget"}},
+		{"limit across segments", Query{Process: "firefox", Limit: 2}, []string{"firefox", "firefox"}},
+		{"limit over matches", Query{Verdict: "accept", Limit: 10}, []string{"curl", "firefox"}},
+		{"no match", Query{Country: "DE"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := s.Query(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ev := range events {
+				got = append(got, ev.Connection.Process)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuerySkipsSegmentsOutsideWindow(t *testing.T) {
+	s, dir := openStore(t, Retention{})
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	appendAll(t, s,
+		event(start, "old", "198.51.100.1", "", "accept"),
+		event(start.Add(2*time.Hour), "recent", "198.51.100.1", "", "accept"),
+		event(start.Add(4*time.Hour), "future", "198.51.100.1", "", "accept"),
+	)
+	s.Close()
+
+	// Plant an event of the window into the segments that end before it
+	// and start after it. Reading them would return the event.
+	planted := event(start.Add(2*time.Hour+time.Minute), "planted", "198.51.100.1", "", "accept")
+	line, err := json.Marshal(planted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"20240501T100000.000000000Z.jsonl", "20240501T140000.000000000Z.jsonl"} {
+		if err := os.WriteFile(filepath.Join(dir, name), append(line, '\n'), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := s.Query(Query{Since: start.Add(2 * time.Hour), Until: start.Add(3 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Connection.Process != "recent" {
+		t.Errorf("got %+v, want only the recent event", events)
+	}
+
+	// With a limit, reading stops at the newest segments holding enough
+	// events. The oldest segment is made to fail to read by pointing it
+	// at a directory.
+	oldest := filepath.Join(dir, "20240501T100000.000000000Z.jsonl")
+	if err := os.Remove(oldest); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(t.TempDir(), oldest); err != nil {
+		t.Fatal(err)
+	}
+	events, err = s.Query(Query{Process: "planted", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if _, err := s.Query(Query{Process: "planted"}); err == nil {
+		t.Error("query without a limit skipped the oldest segment")
+	}
+}
+
+func TestQuerySkipsBrokenLines(t *testing.T) {
+	s, dir := openStore(t, Retention{})
+	now := time.Now().UTC()
+	appendAll(t, s, event(now, "curl", "198.51.100.1", "", "accept"))
+	s.Close()
+
+	path := filepath.Join(dir, segmentNames(t, dir)[0])
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An oversized line, an event after it, and a line cut short by a crash
+	f.WriteString(`{"time":"` + strings.Repeat("x", 2<<20) + "\"}\n")
+	line, err := json.Marshal(event(now.Add(time.Second), "wget", "198.51.100.1", "", "accept"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(append(line, '\n'))
+	f.WriteString(`{"time":"2024-05-01T10:00:00Z","connection":{"proc`)
+	f.Close()
+
+	events, err := s.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Connection.Process != "curl" || events[1].Connection.Process != "wget" {
+		t.Errorf("got %+v, want the curl and wget events", events)
+	}
+}
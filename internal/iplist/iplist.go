@@ -0,0 +1,201 @@
+// Package iplist matches addresses against IP and CIDR lists such as the
+// FireHOL netsets or the Spamhaus DROP list
+package iplist
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+)
+
+// Source is a list file and the name rules and logs know it by
+type Source struct {
+	Name string
+	Path string
+}
+
+// Match is the longest listed prefix holding an address and the lists that
+// contain the address, through that prefix or a shorter one
+type Match struct {
+	Prefix netip.Prefix
+	Lists  []string
+}
+
+// set is one generation of the loaded lists
+type set struct {
+	tree    *Tree[[]string]
+	sources []Source
+	mtimes  map[string]time.Time
+}
+
+var (
+	current atomic.Pointer[set]
+	loadMu  sync.Mutex // serializes loads
+)
+
+// Load reads the lists of sources and replaces the ones in use. On error
+// the lists in use are kept.
+func Load(sources []Source) error {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+
+	s, err := build(sources)
+	if err != nil {
+		return err
+	}
+	current.Store(s)
+	logger.Log.Info("loaded IP lists", "prefixes", s.tree.Len(), "lists", len(sources))
+	return nil
+}
+
+func build(sources []Source) (*set, error) {
+	s := &set{
+		tree:    &Tree[[]string]{},
+		sources: sources,
+		mtimes:  make(map[string]time.Time),
+	}
+	var errs error
+	for _, src := range sources {
+		mtime, err := s.add(src)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("IP list %s: %w", src.Name, err))
+			continue
+		}
+		s.mtimes[src.Path] = mtime
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	// A list naming 1.0.0.0/8 also holds 1.2.3.4 when another list names
+	// the longer 1.2.3.0/24
+	s.tree.Inherit(func(outer, lists []string) []string {
+		merged := slices.Clip(lists)
+		for _, name := range outer {
+			if !slices.Contains(merged, name) {
+				merged = append(merged, name)
+			}
+		}
+		return merged
+	})
+	s.tree.Index()
+	return s, nil
+}
+
+// add inserts the prefixes of src and returns the modification time of its
+// file
+func (s *set) add(src Source) (time.Time, error) {
+	f, err := os.Open(src.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p, ok := parseLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		s.tree.Update(p, func(lists []string, _ bool) []string {
+			if slices.Contains(lists, src.Name) {
+				return lists
+			}
+			return append(lists, src.Name)
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// parseLine reads the address or prefix of a list line. "#" and ";" start
+// comments, and anything after the first field is ignored, which covers
+// the "prefix ; SBL id" lines of the DROP list.
+func parseLine(line string) (netip.Prefix, bool) {
+	if i := strings.IndexAny(line, "#;"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return netip.Prefix{}, false
+	}
+	if p, err := netip.ParsePrefix(fields[0]); err == nil {
+		return p.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(fields[0]); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// Lookup returns the longest listed prefix holding ip and the names of all
+// lists containing ip
+func Lookup(ip net.IP) (Match, bool) {
+	s := current.Load()
+	if s == nil || ip == nil {
+		return Match{}, false
+	}
+	p, lists, ok := s.tree.Lookup(ip)
+	if !ok {
+		return Match{}, false
+	}
+	return Match{Prefix: p, Lists: lists}, true
+}
+
+// Has reports whether a list called name is loaded
+func Has(name string) bool {
+	s := current.Load()
+	if s == nil {
+		return false
+	}
+	return slices.ContainsFunc(s.sources, func(src Source) bool { return src.Name == name })
+}
+
+// Watch reloads the lists every interval when one of their files changed,
+// until ctx is done
+func Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s := current.Load()
+		if s == nil || !s.changed() {
+			continue
+		}
+		if err := Load(s.sources); err != nil {
+			logger.Log.Warn("keeping current IP lists, reload failed", "err", err)
+		}
+	}
+}
+
+// changed reports whether a list file was modified since it was loaded
+func (s *set) changed() bool {
+	for _, src := range s.sources {
+		info, err := os.Stat(src.Path)
+		if err != nil || !info.ModTime().Equal(s.mtimes[src.Path]) {
+			return true
+		}
+	}
+	return false
+}
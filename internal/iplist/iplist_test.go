@@ -0,0 +1,113 @@
+package iplist
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeList writes a list file into dir and returns it as a source
+func writeList(t *testing.T, dir, name, content string) Source {
+	t.Helper()
+	path := filepath.Join(dir, name+".netset")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return Source{Name: name, Path: path}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // "" when the line holds no prefix
+	}{
+		{"192.0.2.0/24", "192.0.2.0/24"},
+		{"192.0.2.77/24", "192.0.2.0/24"},
+		{"198.51.100.1", "198.51.100.1/32"},
+		{"2001:db8::/32 ; SBL123", "2001:db8::/32"},
+		{"  203.0.113.0/25   # comment", "203.0.113.0/25"},
+		{"# only a comment", ""},
+		{"; only a comment", ""},
+		{"", ""},
+		{"not-an-address", ""},
+	}
+	for _, tt := range tests {
+		p, ok := parseLine(tt.line)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("parseLine(%q) = %s, want none", tt.line, p)
+			}
+			continue
+		}
+		if !ok || p.String() != tt.want {
+			t.Errorf("parseLine(%q) = %s, %v, want %s", tt.line, p, ok, tt.want)
+		}
+	}
+}
+
+func TestOverlappingLists(t *testing.T) {
+	dir := t.TempDir()
+	s, err := build([]Source{
+		writeList(t, dir, "wide", "10.0.0.0/8\n2001:db8::/32\n"),
+		writeList(t, dir, "narrow", "10.1.2.0/24\n10.1.2.3\n2001:db8:1::/48\n"),
+		writeList(t, dir, "both", "10.1.2.0/24\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip     string
+		prefix string
+		lists  []string
+	}{
+		{"10.1.2.3", "10.1.2.3/32", []string{"narrow", "both", "wide"}},
+		{"10.1.2.4", "10.1.2.0/24", []string{"narrow", "both", "wide"}},
+		{"10.9.9.9", "10.0.0.0/8", []string{"wide"}},
+		{"2001:db8:1::1", "2001:db8:1::/48", []string{"narrow", "wide"}},
+		{"2001:db8:2::1", "2001:db8::/32", []string{"wide"}},
+		{"192.0.2.1", "", nil},
+	}
+	for _, tt := range tests {
+		p, lists, ok := s.tree.Lookup(net.ParseIP(tt.ip))
+		if tt.prefix == "" {
+			if ok {
+				t.Errorf("%s: matched %s %v, want none", tt.ip, p, lists)
+			}
+			continue
+		}
+		if !ok || p.String() != tt.prefix {
+			t.Errorf("%s: prefix = %s, %v, want %s", tt.ip, p, ok, tt.prefix)
+		}
+		got := slices.Clone(lists)
+		want := slices.Clone(tt.lists)
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: lists = %v, want %v", tt.ip, lists, tt.lists)
+		}
+	}
+}
+
+func TestLoadKeepsListsOnError(t *testing.T) {
+	t.Cleanup(func() { current.Store(nil) })
+	dir := t.TempDir()
+	src := writeList(t, dir, "drop", "192.0.2.0/24\n")
+	if err := Load([]Source{src}); err != nil {
+		t.Fatal(err)
+	}
+	missing := Source{Name: "missing", Path: filepath.Join(dir, "missing.netset")}
+	if err := Load([]Source{src, missing}); err == nil {
+		t.Fatal("Load of a missing list succeeded")
+	}
+
+	m, ok := Lookup(net.ParseIP("192.0.2.1"))
+	if !ok || !slices.Equal(m.Lists, []string{"drop"}) {
+		t.Errorf("Lookup = %v, %v, want the drop list", m, ok)
+	}
+	if !Has("drop") || Has("missing") {
+		t.Errorf("Has(drop) = %v, Has(missing) = %v", Has("drop"), Has("missing"))
+	}
+}
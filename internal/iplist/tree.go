@@ -0,0 +1,297 @@
+package iplist
+
+import (
+	"math/bits"
+	"net"
+	"net/netip"
+)
+
+// key is an address as 128 bits. IPv4 addresses use their IPv4-mapped IPv6
+// form, so both families share one tree.
+type key struct {
+	hi, lo uint64
+}
+
+func keyOf(addr netip.Addr) key {
+	b := addr.As16()
+	var k key
+	for i := 0; i < 8; i++ {
+		k.hi = k.hi<<8 | uint64(b[i])
+		k.lo = k.lo<<8 | uint64(b[i+8])
+	}
+	return k
+}
+
+// bit returns bit i of k, counting from the most significant
+func (k key) bit(i int) int {
+	if i < 64 {
+		return int(k.hi >> (63 - i) & 1)
+	}
+	return int(k.lo >> (127 - i) & 1)
+}
+
+// common returns how many leading bits a and b share, at most n
+func common(a, b key, n int) int {
+	c := bits.LeadingZeros64(a.hi ^ b.hi)
+	if c == 64 {
+		c += bits.LeadingZeros64(a.lo ^ b.lo)
+	}
+	return min(c, n)
+}
+
+// masked keeps the first n bits of k
+func (k key) masked(n int) key {
+	switch {
+	case n <= 0:
+		return key{}
+	case n < 64:
+		return key{hi: k.hi &^ (^uint64(0) >> n)}
+	case n < 128:
+		return key{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (n - 64))}
+	}
+	return k
+}
+
+// treeNode is kept small and stored in one slice, with links being indexes,
+// so that a lookup touches as few cache lines as possible
+type treeNode struct {
+	key      key
+	bits     uint8 // prefix length, 0-128
+	set      bool  // the prefix holds a value
+	value    int32 // index into Tree.values
+	children [2]int32
+}
+
+// Tree maps prefixes to values and finds the longest prefix holding an
+// address. Chains of nodes with a single child are collapsed, so a lookup
+// visits at most one node per prefix length on its path.
+type Tree[T any] struct {
+	nodes  []treeNode // nodes[0] stands for no node
+	values []T
+	root   int32
+	v4     []jump // see Index
+}
+
+// jump is where a lookup of an IPv4 address continues after the first 16
+// bits, and the longest prefix found up to there
+type jump struct {
+	node int32
+	best int32
+}
+
+// v4Jump is the prefix length in the 128 bit space that the IPv4 index
+// jumps over: ::ffff:0:0/96 plus 16 bits
+const v4Jump = 96 + 16
+
+// minIndexed is the size below which Index does not bother
+const minIndexed = 4096
+
+// prefixKey returns the key and length of p in the 128 bit space
+func prefixKey(p netip.Prefix) (key, int) {
+	p = p.Masked()
+	n := p.Bits()
+	if p.Addr().Is4() {
+		n += 96
+	}
+	return keyOf(p.Addr()), n
+}
+
+// Insert sets the value of p, replacing the value it had
+func (t *Tree[T]) Insert(p netip.Prefix, value T) {
+	t.Update(p, func(T, bool) T { return value })
+}
+
+// newNode appends a node and returns its index
+func (t *Tree[T]) newNode(k key, n int) int32 {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, treeNode{})
+	}
+	t.nodes = append(t.nodes, treeNode{key: k.masked(n), bits: uint8(n)})
+	return int32(len(t.nodes) - 1)
+}
+
+// setValue stores value in node i, which has none yet
+func (t *Tree[T]) setValue(i int32, value T) {
+	t.values = append(t.values, value)
+	t.nodes[i].set = true
+	t.nodes[i].value = int32(len(t.values) - 1)
+}
+
+// Update sets the value of p to what fn returns for the current value. ok
+// is false when p has none yet.
+func (t *Tree[T]) Update(p netip.Prefix, fn func(current T, ok bool) T) {
+	t.v4 = nil
+	k, n := prefixKey(p)
+	var zero T
+	parent, side := int32(0), 0 // the link to follow, parent 0 is the root
+	for {
+		i := t.root
+		if parent != 0 {
+			i = t.nodes[parent].children[side]
+		}
+
+		if i == 0 {
+			leaf := t.newNode(k, n)
+			t.setValue(leaf, fn(zero, false))
+			t.link(parent, side, leaf)
+			return
+		}
+
+		node := t.nodes[i]
+		c := common(node.key, k, min(int(node.bits), n))
+		if c < int(node.bits) {
+			// p branches off inside the prefix of node
+			split := t.newNode(k, c)
+			t.nodes[split].children[node.key.bit(c)] = i
+			if c == n {
+				t.setValue(split, fn(zero, false))
+			} else {
+				leaf := t.newNode(k, n)
+				t.setValue(leaf, fn(zero, false))
+				t.nodes[split].children[k.bit(c)] = leaf
+			}
+			t.link(parent, side, split)
+			return
+		}
+
+		if int(node.bits) == n {
+			if node.set {
+				t.values[node.value] = fn(t.values[node.value], true)
+			} else {
+				t.setValue(i, fn(zero, false))
+			}
+			return
+		}
+		parent, side = i, k.bit(int(node.bits))
+	}
+}
+
+// link points the given side of parent, or the root for parent 0, to child
+func (t *Tree[T]) link(parent int32, side int, child int32) {
+	if parent == 0 {
+		t.root = child
+	} else {
+		t.nodes[parent].children[side] = child
+	}
+}
+
+// Inherit passes the values of prefixes down to the longer prefixes they
+// hold: the value of each prefix becomes fn(outer, value), where outer is
+// the value of the longest prefix holding it, itself already combined with
+// the ones further out. A lookup then sees what every prefix holding the
+// address maps it to.
+func (t *Tree[T]) Inherit(fn func(outer, value T) T) {
+	type visit struct {
+		node  int32
+		outer int32 // index into t.values, -1 for none
+	}
+	stack := []visit{{node: t.root, outer: -1}}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if v.node == 0 {
+			continue
+		}
+		node := &t.nodes[v.node]
+		outer := v.outer
+		if node.set {
+			if outer >= 0 {
+				t.values[node.value] = fn(t.values[outer], t.values[node.value])
+			}
+			outer = node.value
+		}
+		stack = append(stack, visit{node.children[0], outer}, visit{node.children[1], outer})
+	}
+}
+
+// Index builds a table that lets IPv4 lookups skip the first 16 bits of the
+// address, where trees of many IPv4 prefixes are the densest. Any change to
+// the tree drops the table, so Index belongs after the last insert. Small
+// trees are not indexed.
+func (t *Tree[T]) Index() {
+	if t.Len() < minIndexed {
+		return
+	}
+	v4 := make([]jump, 1<<16)
+	for slot := range v4 {
+		k := key{lo: 0xffff<<32 | uint64(slot)<<16}
+		var j jump
+		for i := t.root; i != 0; {
+			node := &t.nodes[i]
+			if node.bits >= v4Jump {
+				// The rest of the walk depends on the remaining bits
+				j.node = i
+				break
+			}
+			if common(node.key, k, int(node.bits)) < int(node.bits) {
+				break
+			}
+			if node.set {
+				j.best = i
+			}
+			i = node.children[k.bit(int(node.bits))]
+		}
+		v4[slot] = j
+	}
+	t.v4 = v4
+}
+
+// LookupAddr returns the value of the longest prefix holding addr
+func (t *Tree[T]) LookupAddr(addr netip.Addr) (netip.Prefix, T, bool) {
+	addr = addr.Unmap()
+	k := keyOf(addr)
+	start, best := t.root, int32(0)
+	if t.v4 != nil && addr.Is4() {
+		j := t.v4[k.lo>>16&0xffff]
+		start, best = j.node, j.best
+	}
+	for i := start; i != 0; {
+		node := &t.nodes[i]
+		if common(node.key, k, int(node.bits)) < int(node.bits) {
+			break
+		}
+		if node.set {
+			best = i
+		}
+		if node.bits == 128 {
+			break
+		}
+		i = node.children[k.bit(int(node.bits))]
+	}
+
+	if best == 0 {
+		var zero T
+		return netip.Prefix{}, zero, false
+	}
+	node := &t.nodes[best]
+	return node.prefix(), t.values[node.value], true
+}
+
+// Lookup returns the value of the longest prefix holding ip
+func (t *Tree[T]) Lookup(ip net.IP) (netip.Prefix, T, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		var zero T
+		return netip.Prefix{}, zero, false
+	}
+	return t.LookupAddr(addr)
+}
+
+// Len returns the number of prefixes in the tree
+func (t *Tree[T]) Len() int {
+	return len(t.values)
+}
+
+// prefix converts the key of node back into the prefix it was inserted as
+func (n *treeNode) prefix() netip.Prefix {
+	var b [16]byte
+	for i := 0; i < 8; i++ {
+		b[i] = byte(n.key.hi >> (56 - 8*i))
+		b[i+8] = byte(n.key.lo >> (56 - 8*i))
+	}
+	addr := netip.AddrFrom16(b)
+	if addr.Is4In6() && n.bits >= 96 {
+		return netip.PrefixFrom(addr.Unmap(), int(n.bits)-96)
+	}
+	return netip.PrefixFrom(addr, int(n.bits))
+}
@@ -0,0 +1,241 @@
+package iplist
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func buildTree(prefixes ...string) *Tree[string] {
+	t := &Tree[string]{}
+	for _, p := range prefixes {
+		t.Insert(netip.MustParsePrefix(p), p)
+	}
+	return t
+}
+
+func TestTreeLongestPrefix(t *testing.T) {
+	tree := buildTree(
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"10.1.2.3/32",
+		"192.168.0.0/16",
+		"0.0.0.0/1",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db8:1::1/128",
+	)
+
+	tests := []struct {
+		ip   string
+		want string // "" when no prefix holds ip
+	}{
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.3.1", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"11.0.0.1", "0.0.0.0/1"},
+		{"127.0.0.1", "0.0.0.0/1"},
+		{"192.168.100.1", "192.168.0.0/16"},
+		{"192.169.0.1", ""},
+		{"2001:db8:1::1", "2001:db8:1::1/128"},
+		{"2001:db8:1::2", "2001:db8:1::/48"},
+		{"2001:db8:2::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		{"::1", ""},
+		// IPv4-mapped IPv6 addresses are looked up as IPv4
+		{"::ffff:10.1.2.4", "10.1.2.0/24"},
+	}
+	for _, tt := range tests {
+		p, value, ok := tree.Lookup(net.ParseIP(tt.ip))
+		if tt.want == "" {
+			if ok {
+				t.Errorf("Lookup(%s) = %s, want no match", tt.ip, p)
+			}
+			continue
+		}
+		if !ok || p.String() != tt.want || value != tt.want {
+			t.Errorf("Lookup(%s) = %s, %q, %v, want %s", tt.ip, p, value, ok, tt.want)
+		}
+	}
+
+	if tree.Len() != 9 {
+		t.Errorf("Len() = %d, want 9", tree.Len())
+	}
+	if _, _, ok := tree.Lookup(net.IP{1, 2, 3}); ok {
+		t.Error("Lookup of a malformed address matched")
+	}
+}
+
+func TestTreeIPv4AndIPv6Apart(t *testing.T) {
+	// IPv4 prefixes live in the IPv4-mapped range of the shared key space,
+	// even the default route covers no IPv6 address
+	tree := buildTree("0.0.0.0/0")
+	if _, _, ok := tree.Lookup(net.ParseIP("2001:db8::1")); ok {
+		t.Error("IPv4 default route matched an IPv6 address")
+	}
+	if p, _, ok := tree.Lookup(net.ParseIP("203.0.113.1")); !ok || p.String() != "0.0.0.0/0" {
+		t.Errorf("Lookup(203.0.113.1) = %s, %v, want 0.0.0.0/0", p, ok)
+	}
+}
+
+func TestTreeUpdate(t *testing.T) {
+	tree := &Tree[int]{}
+	p := netip.MustParsePrefix("198.51.100.0/24")
+	for i := 0; i < 3; i++ {
+		tree.Update(p, func(n int, ok bool) int {
+			if ok != (i > 0) {
+				t.Errorf("update %d: ok = %v", i, ok)
+			}
+			return n + 1
+		})
+	}
+	// Inserting a host address masks it to the prefix
+	tree.Insert(netip.MustParsePrefix("198.51.100.77/24"), 10)
+
+	if _, n, _ := tree.Lookup(net.ParseIP("198.51.100.1")); n != 10 {
+		t.Errorf("value = %d, want 10", n)
+	}
+	if tree.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", tree.Len())
+	}
+}
+
+func TestTreeInherit(t *testing.T) {
+	tree := buildTree("10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "2001:db8::/32")
+	tree.Inherit(func(outer, value string) string {
+		return value + "<" + outer
+	})
+
+	tests := []struct {
+		ip, want string
+	}{
+		{"10.1.2.3", "10.1.2.0/24<10.1.0.0/16<10.0.0.0/8"},
+		{"10.1.3.3", "10.1.0.0/16<10.0.0.0/8"},
+		{"10.2.0.1", "10.2.0.0/16<10.0.0.0/8"},
+		{"10.3.0.1", "10.0.0.0/8"},
+		{"2001:db8::1", "2001:db8::/32"},
+	}
+	for _, tt := range tests {
+		if _, value, _ := tree.Lookup(net.ParseIP(tt.ip)); value != tt.want {
+			t.Errorf("Lookup(%s) = %q, want %q", tt.ip, value, tt.want)
+		}
+	}
+}
+
+// randomPrefixes returns n IPv4 prefixes of /8 to /32, with one in eight
+// of them IPv6
+func randomPrefixes(r *rand.Rand, n int) []netip.Prefix {
+	prefixes := make([]netip.Prefix, n)
+	for i := range prefixes {
+		if r.Intn(8) == 0 {
+			var b [16]byte
+			r.Read(b[:])
+			b[0] = 0x20
+			prefixes[i] = netip.PrefixFrom(netip.AddrFrom16(b), 16+r.Intn(113)).Masked()
+			continue
+		}
+		var b [4]byte
+		r.Read(b[:])
+		prefixes[i] = netip.PrefixFrom(netip.AddrFrom4(b), 8+r.Intn(25)).Masked()
+	}
+	return prefixes
+}
+
+// longest finds the longest of prefixes holding addr by trying them all
+func longest(prefixes []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	var best netip.Prefix
+	found := false
+	for _, p := range prefixes {
+		if p.Contains(addr) && (!found || p.Bits() > best.Bits()) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+func TestTreeIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	prefixes := randomPrefixes(r, 2*minIndexed)
+	tree := &Tree[netip.Prefix]{}
+	for _, p := range prefixes {
+		tree.Insert(p, p)
+	}
+	plain := *tree
+	tree.Index()
+	if tree.v4 == nil {
+		t.Fatal("tree was not indexed")
+	}
+	if plain.v4 != nil {
+		t.Fatal("copy was indexed")
+	}
+
+	// Addresses inside the prefixes and random ones, most of which only
+	// short prefixes hold
+	var addrs []netip.Addr
+	for _, p := range prefixes[:1000] {
+		addrs = append(addrs, p.Addr())
+	}
+	for i := 0; i < 1000; i++ {
+		var b [4]byte
+		r.Read(b[:])
+		addrs = append(addrs, netip.AddrFrom4(b))
+	}
+
+	for _, addr := range addrs {
+		want, wantOK := longest(prefixes, addr)
+		for name, tr := range map[string]*Tree[netip.Prefix]{"indexed": tree, "plain": &plain} {
+			p, value, ok := tr.LookupAddr(addr)
+			if ok != wantOK || p != want || (ok && value != want) {
+				t.Fatalf("%s: LookupAddr(%s) = %s, %s, %v, want %s, %v", name, addr, p, value, ok, want, wantOK)
+			}
+		}
+	}
+
+	// Changing the tree drops the index
+	tree.Insert(netip.MustParsePrefix("203.0.113.0/24"), netip.Prefix{})
+	if tree.v4 != nil {
+		t.Error("index kept after an insert")
+	}
+}
+
+func TestTreeIndexSmall(t *testing.T) {
+	tree := buildTree("10.0.0.0/8")
+	tree.Index()
+	if tree.v4 != nil {
+		t.Error("small tree was indexed")
+	}
+}
+
+// benchTree holds a million random prefixes and addresses to look up
+var benchTree = sync.OnceValues(func() (*Tree[int], []net.IP) {
+	r := rand.New(rand.NewSource(1))
+	tree := &Tree[int]{}
+	for i, p := range randomPrefixes(r, 1_000_000) {
+		tree.Insert(p, i)
+	}
+	tree.Index()
+
+	ips := make([]net.IP, 4096)
+	for i := range ips {
+		if i%8 == 0 {
+			ips[i] = make(net.IP, 16)
+			r.Read(ips[i])
+			ips[i][0] = 0x20
+			continue
+		}
+		ips[i] = net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))).To4()
+	}
+	return tree, ips
+})
+
+func BenchmarkLookup(b *testing.B) {
+	tree, ips := benchTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Lookup(ips[i%len(ips)])
+	}
+}
@@ -2,6 +2,7 @@ package iptables
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 
 	"github.com/coreos/go-iptables/iptables"
@@ -34,8 +35,10 @@ type rule struct {
 	args  []string
 }
 
-// New creates a new IPTables instance
-func New() (*IPTables, error) {
+// New creates a new IPTables instance sending new connections to the given
+// nfqueue numbers. A non-zero dnsRedirect port sends DNS queries marked for
+// rerouting to the local resolver listening on it.
+func New(v4Queue, v6Queue, dnsRedirect uint16) (*IPTables, error) {
 	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize IPv4 tables: %w", err)
@@ -49,8 +52,8 @@ func New() (*IPTables, error) {
 	return &IPTables{
 		ipt4:     ipt4,
 		ipt6:     ipt6,
-		v4Config: getIPv4Config(),
-		v6Config: getIPv6Config(),
+		v4Config: getIPv4Config(v4Queue, dnsRedirect),
+		v6Config: getIPv6Config(v6Queue, dnsRedirect),
 	}, nil
 }
 
@@ -155,23 +158,27 @@ func (ipt *IPTables) deactivate(handle *iptables.IPTables, config *chainConfig)
 }
 
 // Configuration helpers moved to separate functions for clarity
-func getIPv4Config() *chainConfig {
+func getIPv4Config(queue, dnsRedirect uint16) *chainConfig {
+	queueNum := strconv.Itoa(int(queue))
 	chains := []chain{
 		{table: "mangle", name: "NETMONITOR-INGEST-OUTPUT"},
 		{table: "mangle", name: "NETMONITOR-INGEST-INPUT"},
 		{table: "filter", name: "NETMONITOR-FILTER"},
 	}
 	rules := []rule{
+		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-m", "mark", "--mark", "1798", "-j", "RETURN"}},
 		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-j", "CONNMARK", "--restore-mark"}},
-		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", "17040", "--queue-bypass"}},
+		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", queueNum, "--queue-bypass"}},
 		{table: "mangle", chain: "NETMONITOR-INGEST-INPUT", args: []string{"-j", "CONNMARK", "--restore-mark"}},
-		{table: "mangle", chain: "NETMONITOR-INGEST-INPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", "17040", "--queue-bypass"}},
+		{table: "mangle", chain: "NETMONITOR-INGEST-INPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", queueNum, "--queue-bypass"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "0", "-j", "DROP"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1700", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1701", "-p", "icmp", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1701", "-j", "REJECT", "--reject-with", "icmp-admin-prohibited"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1702", "-j", "DROP"}},
+		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1799", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-j", "CONNMARK", "--save-mark"}},
+		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1798", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1710", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1711", "-p", "icmp", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1711", "-j", "REJECT", "--reject-with", "icmp-admin-prohibited"}},
@@ -184,26 +191,33 @@ func getIPv4Config() *chainConfig {
 		{table: "filter", chain: "OUTPUT", args: []string{"-j", "NETMONITOR-FILTER"}},
 		{table: "filter", chain: "INPUT", args: []string{"-j", "NETMONITOR-FILTER"}},
 	}
+	if dnsRedirect != 0 {
+		chains, rules, once = withDNSRedirect(chains, rules, once, "127.0.0.1", dnsRedirect)
+	}
 	return &chainConfig{chains: chains, rules: rules, once: once}
 }
 
-func getIPv6Config() *chainConfig {
+func getIPv6Config(queue, dnsRedirect uint16) *chainConfig {
+	queueNum := strconv.Itoa(int(queue))
 	chains := []chain{
 		{table: "mangle", name: "NETMONITOR-INGEST-OUTPUT"},
 		{table: "mangle", name: "NETMONITOR-INGEST-INPUT"},
 		{table: "filter", name: "NETMONITOR-FILTER"},
 	}
 	rules := []rule{
+		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-m", "mark", "--mark", "1798", "-j", "RETURN"}},
 		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-j", "CONNMARK", "--restore-mark"}},
-		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", "17060", "--queue-bypass"}},
+		{table: "mangle", chain: "NETMONITOR-INGEST-OUTPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", queueNum, "--queue-bypass"}},
 		{table: "mangle", chain: "NETMONITOR-INGEST-INPUT", args: []string{"-j", "CONNMARK", "--restore-mark"}},
-		{table: "mangle", chain: "NETMONITOR-INGEST-INPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", "17060", "--queue-bypass"}},
+		{table: "mangle", chain: "NETMONITOR-INGEST-INPUT", args: []string{"-m", "mark", "--mark", "0", "-j", "NFQUEUE", "--queue-num", queueNum, "--queue-bypass"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "0", "-j", "DROP"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1700", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1701", "-p", "icmpv6", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1701", "-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1702", "-j", "DROP"}},
+		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1799", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-j", "CONNMARK", "--save-mark"}},
+		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1798", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1710", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1711", "-p", "icmpv6", "-j", "RETURN"}},
 		{table: "filter", chain: "NETMONITOR-FILTER", args: []string{"-m", "mark", "--mark", "1711", "-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"}},
@@ -216,5 +230,23 @@ func getIPv6Config() *chainConfig {
 		{table: "filter", chain: "OUTPUT", args: []string{"-j", "NETMONITOR-FILTER"}},
 		{table: "filter", chain: "INPUT", args: []string{"-j", "NETMONITOR-FILTER"}},
 	}
+	if dnsRedirect != 0 {
+		chains, rules, once = withDNSRedirect(chains, rules, once, "[::1]", dnsRedirect)
+	}
 	return &chainConfig{chains: chains, rules: rules, once: once}
 }
+
+// withDNSRedirect adds the NAT rules sending queries marked 1799 to the local
+// resolver at addr:port. The resolver's own queries, marked 1798, are never
+// redirected.
+func withDNSRedirect(chains []chain, rules, once []rule, addr string, port uint16) ([]chain, []rule, []rule) {
+	to := addr + ":" + strconv.Itoa(int(port))
+	chains = append(chains, chain{table: "nat", name: "NETMONITOR-DNS"})
+	rules = append(rules,
+		rule{table: "nat", chain: "NETMONITOR-DNS", args: []string{"-m", "mark", "--mark", "1798", "-j", "RETURN"}},
+		rule{table: "nat", chain: "NETMONITOR-DNS", args: []string{"-m", "mark", "--mark", "1799", "-p", "udp", "-j", "DNAT", "--to-destination", to}},
+		rule{table: "nat", chain: "NETMONITOR-DNS", args: []string{"-m", "mark", "--mark", "1799", "-p", "tcp", "-j", "DNAT", "--to-destination", to}},
+	)
+	once = append(once, rule{table: "nat", chain: "OUTPUT", args: []string{"-j", "NETMONITOR-DNS"}})
+	return chains, rules, once
+}
@@ -1,18 +1,192 @@
+// Package logger writes structured records through log/slog to two
+// streams: diagnostics of the daemon and the connections it decides on
 package logger
 
 import (
-    "log"
-    "os"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-var Log *log.Logger
+// Format is how records are written
+type Format int
+
+const (
+	// FormatLogfmt writes key=value pairs
+	FormatLogfmt Format = iota + 1
+	FormatJSON
+)
+
+var formatNames = map[Format]string{
+	FormatLogfmt: "logfmt",
+	FormatJSON:   "json",
+}
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat converts "logfmt" or "json" into a Format
+func ParseFormat(s string) (Format, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for f, n := range formatNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log format %q, expected logfmt or json", s)
+}
+
+// Options configure both streams
+type Options struct {
+	File string // diagnostics, stderr when empty
+	// Connections receives the connection events, which go to the
+	// diagnostics output when it is empty
+	Connections string
+	Format      Format
+	Level       slog.Level // of diagnostics; connection events are info
+	Mode        os.FileMode
+	Rotation    Rotation
+}
+
+// Log writes diagnostics and Conns connection events. Both write logfmt to
+// stderr until Open configures them.
+var (
+	Log   = slog.New(&handler{stream: &diagnostics})
+	Conns = slog.New(&handler{stream: &connections})
+)
+
+// stream is a destination that Open can swap while records are written
+type stream struct {
+	current atomic.Pointer[output]
+}
+
+type output struct {
+	handler slog.Handler
+}
+
+var (
+	diagnostics, connections stream
+
+	mu    sync.Mutex
+	files []*rotatingFile
+)
 
 func init() {
-    file, err := os.OpenFile("netmonitor.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-    if err != nil {
-        log.Fatalln("Failed to open log file:", err)
-    }
+	h := newHandler(os.Stderr, FormatLogfmt, slog.LevelInfo)
+	diagnostics.current.Store(&output{handler: h})
+	connections.current.Store(&output{handler: h})
+}
+
+// Open points the streams at the files of opts. The previously opened
+// files are closed; on error the streams are left as they were.
+func Open(opts Options) error {
+	var opened []*rotatingFile
+	open := func(path string) (io.Writer, error) {
+		if path == "" {
+			return os.Stderr, nil
+		}
+		f, err := openRotating(path, opts.Mode, opts.Rotation)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, f)
+		return f, nil
+	}
+	fail := func(err error) error {
+		for _, f := range opened {
+			f.Close()
+		}
+		return err
+	}
+
+	diag, err := open(opts.File)
+	if err != nil {
+		return fail(err)
+	}
+	conns := diag
+	if opts.Connections != "" && opts.Connections != opts.File {
+		if conns, err = open(opts.Connections); err != nil {
+			return fail(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	diagnostics.current.Store(&output{handler: newHandler(diag, opts.Format, opts.Level)})
+	connections.current.Store(&output{handler: newHandler(conns, opts.Format, slog.LevelInfo)})
+	for _, f := range files {
+		f.Close()
+	}
+	files = opened
+	return nil
+}
+
+// Fatal logs msg at error level and exits
+func Fatal(msg string, args ...any) {
+	Log.Error(msg, args...)
+	os.Exit(1)
+}
+
+func newHandler(w io.Writer, format Format, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Only the file name of the source, as log.Lshortfile did
+			if src, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+				a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+			}
+			return a
+		},
+	}
+	if format == FormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
 
-    Log = log.New(file, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+// handler sends records to the output of its stream at the time they are
+// written, applying the attributes and groups added with With
+type handler struct {
+	stream *stream
+	with   []func(slog.Handler) slog.Handler
 }
 
+func (h *handler) inner() slog.Handler {
+	inner := h.stream.current.Load().handler
+	for _, with := range h.with {
+		inner = with(inner)
+	}
+	return inner
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.stream.current.Load().handler.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner().Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{stream: h.stream, with: append(slices.Clip(h.with), func(inner slog.Handler) slog.Handler {
+		return inner.WithAttrs(attrs)
+	})}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{stream: h.stream, with: append(slices.Clip(h.with), func(inner slog.Handler) slog.Handler {
+		return inner.WithGroup(name)
+	})}
+}
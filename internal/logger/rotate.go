@@ -0,0 +1,219 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Rotation bounds the size and age of a log file and keeps the rotated
+// ones for a while. Zero values disable the limits.
+type Rotation struct {
+	MaxSize int64 // bytes a file may grow to before it is rotated
+	// MaxAge is how long a file is written to before it is rotated, and how
+	// long rotated files are kept after their last record
+	MaxAge     time.Duration
+	MaxBackups int  // rotated files kept beyond this are deleted
+	Compress   bool // gzip rotated files
+}
+
+// backupLayout is appended to the name of a rotated file, so the backups
+// sort by name
+const backupLayout = "20060102T150405.000"
+
+// rotatingFile is a log file that moves aside once it reaches MaxSize or
+// MaxAge
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	mode     os.FileMode
+	rotation Rotation
+	file     *os.File
+	size     int64
+	started  time.Time // when the file was started, see open
+
+	cleanupMu sync.Mutex     // serializes compressing and deleting backups
+	cleaning  sync.WaitGroup // cleanups still running
+}
+
+func openRotating(path string, mode os.FileMode, rotation Rotation) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{path: path, mode: mode, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	// Backups left by an earlier run may have aged meanwhile
+	f.startCleanup("")
+	return f, nil
+}
+
+// open opens the log file for appending with the configured permissions,
+// which also apply to a file that already exists. The age of a file that
+// already holds records counts from its last modification, the oldest time
+// known to be in it.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, f.mode)
+	if err != nil {
+		return err
+	}
+	if err := file.Chmod(f.mode); err != nil {
+		file.Close()
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.started = file, info.Size(), time.Now()
+	if f.size > 0 {
+		f.started = info.ModTime()
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.due(len(p)) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the file as it is rather than losing records
+			fmt.Fprintf(os.Stderr, "failed to rotate %s: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file has to be rotated before n more bytes are
+// written to it
+func (f *rotatingFile) due(n int) bool {
+	return (f.rotation.MaxSize > 0 && f.size+int64(n) > f.rotation.MaxSize) ||
+		(f.rotation.MaxAge > 0 && time.Since(f.started) > f.rotation.MaxAge)
+}
+
+// rotate renames the file with the current time appended and starts a new
+// one. The backups are compressed and pruned in the background. When the
+// new file cannot be opened, the old one is moved back and kept.
+func (f *rotatingFile) rotate() error {
+	backup := f.path + "." + time.Now().Format(backupLayout)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		if rerr := os.Rename(backup, f.path); rerr != nil {
+			err = multierror.Append(err, rerr)
+		}
+		return err
+	}
+	old.Close()
+	f.startCleanup(backup)
+	return nil
+}
+
+// startCleanup runs cleanup in the background
+func (f *rotatingFile) startCleanup(backup string) {
+	f.cleaning.Add(1)
+	go func() {
+		defer f.cleaning.Done()
+		f.cleanup(backup)
+	}()
+}
+
+// cleanup compresses backup if requested and deletes the backups beyond
+// MaxBackups or older than MaxAge. An empty backup only prunes.
+func (f *rotatingFile) cleanup(backup string) {
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	var errs error
+	if f.rotation.Compress && backup != "" {
+		if err := compress(backup, f.mode); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	backups = slices.DeleteFunc(backups, func(name string) bool {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, f.path+"."), ".gz")
+		_, err := time.Parse(backupLayout, stamp)
+		return err != nil
+	})
+	slices.Sort(backups)
+	slices.Reverse(backups) // newest first
+	for i, name := range backups {
+		old := false
+		if f.rotation.MaxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > f.rotation.MaxAge {
+				old = true
+			}
+		}
+		if old || (f.rotation.MaxBackups > 0 && i >= f.rotation.MaxBackups) {
+			if err := os.Remove(name); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	if errs != nil {
+		fmt.Fprintf(os.Stderr, "failed to clean up rotated logs of %s: %v\n", f.path, errs)
+	}
+}
+
+// compress replaces path with a gzipped copy
+func compress(path string, mode os.FileMode) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the file and waits for the backups to be compressed and
+// pruned
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.cleaning.Wait()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,178 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backups returns the rotated files of path, oldest first
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func write(t *testing.T, f *rotatingFile, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if _, err := f.Write([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+		// Backups are named by the millisecond they were rotated at
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netmonitor.log")
+	f, err := openRotating(path, 0o640, Rotation{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record larger than MaxSize still goes into one file
+	write(t, f, "aaaa\n", "bbbb\n", "cccc\n", "dddddddddddddddd\n", "eeee\n")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := backups(t, path)
+	want := []string{"aaaa\nbbbb\n", "cccc\n", "dddddddddddddddd\n"}
+	if len(got) != len(want) {
+		t.Fatalf("backups = %v, want %d", got, len(want))
+	}
+	for i, name := range got {
+		if content := read(t, name); content != want[i] {
+			t.Errorf("%s holds %q, want %q", filepath.Base(name), content, want[i])
+		}
+	}
+	if content := read(t, path); content != "eeee\n" {
+		t.Errorf("current file holds %q, want %q", content, "eeee\n")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, want 0640", info.Mode().Perm())
+	}
+}
+
+func TestRotateMaxBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netmonitor.log")
+	f, err := openRotating(path, 0o600, Rotation{MaxSize: 5, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, f, "1111\n", "2222\n", "3333\n", "4444\n", "5555\n")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := backups(t, path)
+	if len(got) != 2 {
+		t.Fatalf("backups = %v, want 2", got)
+	}
+	// The newest ones are kept
+	if read(t, got[0]) != "3333\n" || read(t, got[1]) != "4444\n" {
+		t.Errorf("kept %q and %q, want the third and fourth record", read(t, got[0]), read(t, got[1]))
+	}
+}
+
+func TestRotateCompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netmonitor.log")
+	f, err := openRotating(path, 0o600, Rotation{MaxSize: 5, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, f, "1111\n", "2222\n")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := backups(t, path)
+	if len(got) != 1 || !strings.HasSuffix(got[0], ".gz") {
+		t.Fatalf("backups = %v, want one gzipped file", got)
+	}
+	gz, err := os.Open(got[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+	r, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1111\n" {
+		t.Errorf("backup holds %q, want %q", b, "1111\n")
+	}
+}
+
+func TestRotateMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netmonitor.log")
+	old := time.Now().Add(-2 * time.Hour)
+
+	// A backup older than MaxAge left by an earlier run, a recent one, and a
+	// file that is not a backup
+	expired := path + "." + old.Format(backupLayout) + ".gz"
+	recent := path + "." + time.Now().Add(-time.Minute).Format(backupLayout)
+	other := path + ".keep"
+	for _, name := range []string{expired, recent, other} {
+		if err := os.WriteFile(name, []byte("x\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(expired, old, old); err != nil {
+		t.Fatal(err)
+	}
+	// The current file was last written before MaxAge
+	if err := os.WriteFile(path, []byte("stale\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openRotating(path, 0o600, Rotation{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, f, "fresh\n", "fresher\n")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale file was rotated before the first new record, and deleted
+	// with the expired backup as its last record is older than MaxAge
+	got := backups(t, path)
+	if len(got) != 2 || got[0] != recent || got[1] != other {
+		t.Errorf("backups = %v, want only %s and %s", got, filepath.Base(recent), filepath.Base(other))
+	}
+	// The new file is young enough to keep taking records
+	if content := read(t, path); content != "fresh\nfresher\n" {
+		t.Errorf("current file holds %q, want the new records", content)
+	}
+}
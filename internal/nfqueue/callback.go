@@ -5,22 +5,38 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/florianl/go-nfqueue"
+	"github.com/lonelysadness/netmonitor/internal/conntrack"
 	"github.com/lonelysadness/netmonitor/internal/geoip"
+	"github.com/lonelysadness/netmonitor/internal/iplist"
 	"github.com/lonelysadness/netmonitor/internal/logger"
 	"github.com/lonelysadness/netmonitor/internal/proc"
-	"github.com/lonelysadness/netmonitor/pkg/utils"
+	"github.com/lonelysadness/netmonitor/internal/prompt"
+	"github.com/lonelysadness/netmonitor/internal/rules"
 	"golang.org/x/sys/unix"
 )
 
-// ConnectionCache stores connection verdicts for faster processing
+// ConnectionCache stores connection verdicts for faster processing.
+// Connections conntrack reports on stay cached until they end; the others
+// expire after cacheDuration.
 type ConnectionCache struct {
 	sync.RWMutex
-	verdicts    map[string]*CacheEntry
+	verdicts map[string]*CacheEntry
+	// closed holds the entries of ended connections for closedRetention,
+	// so they can still be listed
+	closed map[string]*CacheEntry
+	// counted holds the conntrack counters of both directions of every
+	// connection, by the key of its original direction, as last added to
+	// the meter
+	counted map[string][2]conntrack.Counters
+	// open counts the accepted connections of each process or destination
+	// under rules with max_connections. Every entry holding a count gives
+	// it back when it leaves verdicts.
+	open        map[counterKey]int
 	cleanupDone chan struct{}
 }
 
@@ -31,25 +47,137 @@ func init() {
 }
 
 type CacheEntry struct {
-	verdict int
+	verdict rules.Verdict
+	conn    *rules.Conn
 	expiry  time.Time
+	flow    *Flow     // nil until conntrack reports the connection
+	seen    time.Time // when conntrack last reported the connection
+	// byRules is set when the rule set alone took the verdict, rather than
+	// a prompt, a limit or the handling of DNS flows
+	byRules bool
+	opened  counterKey // open connection counter held, zero for none
+}
+
+// live reports whether the entry may still be used at now
+func (e *CacheEntry) live(now time.Time) bool {
+	return (e.flow != nil && tracking.Load()) || now.Before(e.expiry)
 }
 
 var (
 	connCache = &ConnectionCache{
 		verdicts:    make(map[string]*CacheEntry),
+		closed:      make(map[string]*CacheEntry),
+		counted:     make(map[string][2]conntrack.Counters),
+		open:        make(map[counterKey]int),
 		cleanupDone: make(chan struct{}),
 	}
-	cacheDuration  = 5 * time.Minute
-	connIdentifier *proc.ConnectionIdentifier
+	cacheDuration = 5 * time.Minute
+	attributor    *proc.Chain
+	activeRules   atomic.Value
+	rulesMu       sync.Mutex // serializes rule set updates
+	prompts       *prompt.Manager
+	geo           *geoip.Resolver
+)
+
+func init() {
+	// Keep the historic accept-everything behavior until a rule set is loaded
+	activeRules.Store(rules.NewRuleSet(rules.AcceptAlways))
+}
+
+// SetCacheDuration sets how long verdicts are cached for connections that
+// conntrack does not report on
+func SetCacheDuration(d time.Duration) {
+	connCache.Lock()
+	defer connCache.Unlock()
+	cacheDuration = d
+}
+
+// SetPrompter sets the manager asked about connections with a prompt verdict
+func SetPrompter(m *prompt.Manager) {
+	prompts = m
+}
+
+// SetGeoIP sets the resolver locating remote addresses
+func SetGeoIP(r *geoip.Resolver) {
+	geo = r
+}
+
+// configRules are the rules of the policy file and runtimeRules the ones
+// learned from prompts or added through the API. Runtime rules come first
+// and survive reloads; activeRules holds both.
+var (
+	configRules  = rules.NewRuleSet(rules.AcceptAlways)
+	runtimeRules = rules.NewRuleSet(rules.AcceptAlways)
 )
 
+// activate combines the runtime and the config rules into the rule set
+// used for new connections. rulesMu must be held.
+func activate() {
+	activeRules.Store(configRules.Prepend(runtimeRules.Rules()...))
+}
+
+// AddRule activates rule ahead of the other runtime rules. Rule names are
+// unique, so a rule named like an active one is rejected.
+func AddRule(rule *rules.Rule) error {
+	return InsertRule(0, rule)
+}
+
+// InsertRule activates rule at position index of the runtime rules, which
+// are evaluated ahead of the config rules. A negative index appends it to
+// them. The cached connections are re-evaluated like on ApplyRules.
+func InsertRule(index int, rule *rules.Rule) error {
+	rulesMu.Lock()
+	if Rules().Lookup(rule.Name) != nil {
+		rulesMu.Unlock()
+		return fmt.Errorf("rule %q already exists", rule.Name)
+	}
+	runtimeRules = runtimeRules.Insert(index, rule)
+	activate()
+	rulesMu.Unlock()
+
+	reapply()
+	return nil
+}
+
+// DeleteRule removes the rule called name and reports whether it existed.
+// A config rule comes back with the next reload. The cached connections
+// are re-evaluated like on ApplyRules.
+func DeleteRule(name string) bool {
+	rulesMu.Lock()
+	var ok bool
+	if runtimeRules, ok = runtimeRules.Remove(name); !ok {
+		configRules, ok = configRules.Remove(name)
+	}
+	activate()
+	rulesMu.Unlock()
+
+	if ok {
+		reapply()
+	}
+	return ok
+}
+
+// SetRules replaces the config rules and the default verdict used for new
+// connections. The runtime rules are kept.
+func SetRules(rs *rules.RuleSet) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	configRules = rs
+	activate()
+}
+
+// Rules returns the rule set currently used for new connections
+func Rules() *rules.RuleSet {
+	return activeRules.Load().(*rules.RuleSet)
+}
+
 func init() {
 	var err error
-	connIdentifier, err = proc.NewConnectionIdentifier()
+	attributor, err = proc.NewAttributor()
 	if err != nil {
-		logger.Log.Fatalf("Failed to initialize connection identifier: %v", err)
+		logger.Log.Warn("some attribution backends are unavailable", "err", err)
 	}
+	logger.Log.Info("attributing connections", "backends", attributor.Name())
 }
 
 // Add periodic cleanup
@@ -63,6 +191,10 @@ func (c *ConnectionCache) startCleanup(ctx context.Context) {
 				return
 			case <-ticker.C:
 				c.cleanup()
+				proc.ForgetExited()
+				domains.Expire()
+				meter.Expire()
+				expireBuckets()
 			}
 		}
 	}()
@@ -73,8 +205,13 @@ func (c *ConnectionCache) cleanup() {
 	defer c.Unlock()
 	now := time.Now()
 	for key, entry := range c.verdicts {
-		if now.After(entry.expiry) {
-			delete(c.verdicts, key)
+		if !entry.live(now) {
+			c.remove(key, entry)
+		}
+	}
+	for key, entry := range c.closed {
+		if now.Sub(entry.flow.Closed) > closedRetention {
+			delete(c.closed, key)
 		}
 	}
 }
@@ -84,32 +221,214 @@ func getConnectionKey(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16
 	return fmt.Sprintf("%s:%d->%s:%d:%d", srcIP, srcPort, dstIP, dstPort, protocol)
 }
 
-// getCachedVerdict checks if there's a cached verdict for this connection
-func (c *ConnectionCache) getCachedVerdict(key string) (int, bool) {
-	c.RLock()
-	defer c.RUnlock()
+// getCachedEntry checks if there's a cached verdict for this connection
+func (c *ConnectionCache) getCachedEntry(key string) (*CacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
 
 	if entry, exists := c.verdicts[key]; exists {
-		if time.Now().Before(entry.expiry) {
-			return entry.verdict, true
+		if entry.live(time.Now()) {
+			return entry, true
 		}
 		// Clean up expired entry
-		delete(c.verdicts, key)
+		c.remove(key, entry)
 	}
-	return 0, false
+	return nil, false
 }
 
-// setCachedVerdict stores a verdict for a connection
-func (c *ConnectionCache) setCachedVerdict(key string, verdict int) {
+// setCachedVerdict stores a verdict for a connection, for ttl or
+// cacheDuration when ttl is zero. The entry holds the open connection count
+// opened taken by overLimit.
+func (c *ConnectionCache) setCachedVerdict(key string, conn *rules.Conn, verdict rules.Verdict, ttl time.Duration, byRules bool, opened counterKey) {
 	c.Lock()
 	defer c.Unlock()
+	if old, ok := c.verdicts[key]; ok {
+		c.release(old.opened)
+	}
 
+	if ttl == 0 {
+		ttl = cacheDuration
+	}
 	c.verdicts[key] = &CacheEntry{
 		verdict: verdict,
-		expiry:  time.Now().Add(cacheDuration),
+		conn:    conn,
+		expiry:  time.Now().Add(ttl),
+		byRules: byRules,
+		opened:  opened,
+	}
+}
+
+// invalidate removes the entries whose verdict under rs differs from the
+// cached one and returns them. Verdicts the rule set did not take alone,
+// such as prompt answers, are kept.
+func (c *ConnectionCache) invalidate(rs *rules.RuleSet) []*CacheEntry {
+	c.Lock()
+	defer c.Unlock()
+
+	var changed []*CacheEntry
+	for key, entry := range c.verdicts {
+		if !entry.byRules {
+			continue
+		}
+		if verdict, _ := evaluate(rs, entry.conn); verdict != entry.verdict {
+			c.remove(key, entry)
+			changed = append(changed, entry)
+		}
+	}
+	return changed
+}
+
+// ApplyRules activates rs as the config rules for new connections and
+// re-evaluates the cached ones, see reapply. It returns the number of
+// affected connections.
+func ApplyRules(rs *rules.RuleSet) int {
+	SetRules(rs)
+	return reapply()
+}
+
+// reapply re-evaluates the cached connections under the active rules.
+// Connections whose verdict changed lose their cached verdict and, if it
+// was permanent, their conntrack mark, so their next packet goes through
+// the queue again. Without conntrack events a cached verdict expires while
+// the kernel keeps the mark of its connection, so the permanent marks of
+// connections without a live cached verdict are cleared as well. It
+// returns the number of affected connections.
+func reapply() int {
+	ct, err := conntrack.Dial()
+	if err != nil {
+		logger.Log.Warn("failed to clear conntrack marks", "err", err)
+		return len(connCache.invalidate(Rules()))
+	}
+	defer ct.Close()
+
+	// Look for stale marks before invalidating, so the connections whose
+	// verdict changes are not counted twice
+	var stale []conntrack.Tuple
+	if entries, err := ct.Dump(); err != nil {
+		logger.Log.Warn("failed to dump conntrack table, stale marks are kept", "err", err)
+	} else {
+		stale = connCache.staleMarks(entries)
+	}
+	changed := connCache.invalidate(Rules())
+
+	tuples := stale
+	for _, entry := range changed {
+		if isPermanent(entry.verdict) {
+			tuples = append(tuples, connTuple(entry.conn))
+		}
+	}
+	for _, tuple := range tuples {
+		if err := ct.ClearMark(tuple); err != nil {
+			logger.Log.Warn("failed to clear conntrack mark", "tuple", tuple, "err", err)
+		}
+	}
+	return len(changed) + len(stale)
+}
+
+// staleMarks returns the original tuples of the connections in entries
+// that carry a permanent verdict mark without a live cached verdict
+func (c *ConnectionCache) staleMarks(entries []conntrack.Entry) []conntrack.Tuple {
+	now := time.Now()
+	c.RLock()
+	defer c.RUnlock()
+	var tuples []conntrack.Tuple
+	for i := range entries {
+		if !isPermanentMark(entries[i].Mark) || c.cached(entryKeys(&entries[i]), now) {
+			continue
+		}
+		tuples = append(tuples, entries[i].Orig)
+	}
+	return tuples
+}
+
+// cached reports whether either of keys has a live cached verdict at now
+func (c *ConnectionCache) cached(keys [2]string, now time.Time) bool {
+	for _, key := range keys {
+		if entry, ok := c.verdicts[key]; ok && entry.live(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// connTuple returns the conntrack tuple of conn in its own direction
+func connTuple(conn *rules.Conn) conntrack.Tuple {
+	return conntrack.Tuple{
+		Protocol: conn.Protocol,
+		Src:      conn.SrcIP,
+		SrcPort:  conn.SrcPort,
+		Dst:      conn.DstIP,
+		DstPort:  conn.DstPort,
 	}
 }
 
+// isPermanent reports whether verdict is saved into the conntrack mark
+func isPermanent(verdict rules.Verdict) bool {
+	switch verdict {
+	case rules.AcceptAlways, rules.BlockAlways, rules.DropAlways:
+		return true
+	}
+	return false
+}
+
+// isPermanentMark reports whether mark is a verdict saved into the
+// conntrack mark
+func isPermanentMark(mark uint32) bool {
+	switch mark {
+	case MarkAcceptAlways, MarkBlockAlways, MarkDropAlways:
+		return true
+	}
+	return false
+}
+
+// Connection is a cached connection and its verdict
+type Connection struct {
+	Key     string
+	Conn    *rules.Conn
+	Verdict rules.Verdict
+	Expires time.Time // zero while conntrack tracks the connection
+	Flow    *Flow     // nil when conntrack has not reported the connection
+}
+
+// Connections returns the connections with a cached verdict and the ones
+// that ended recently
+func Connections() []Connection {
+	connCache.RLock()
+	defer connCache.RUnlock()
+	conns := make([]Connection, 0, len(connCache.verdicts)+len(connCache.closed))
+	for _, entries := range []map[string]*CacheEntry{connCache.verdicts, connCache.closed} {
+		for key, entry := range entries {
+			c := Connection{
+				Key:     key,
+				Conn:    entry.conn,
+				Verdict: entry.verdict,
+				Expires: entry.expiry,
+			}
+			if entry.flow != nil {
+				flow := *entry.flow
+				c.Flow = &flow
+				if tracking.Load() {
+					c.Expires = time.Time{}
+				}
+			}
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// FlushCache drops all cached verdicts and returns how many were dropped.
+// Their open connection counts are given back.
+func FlushCache() int {
+	connCache.Lock()
+	defer connCache.Unlock()
+	n := len(connCache.verdicts)
+	for key, entry := range connCache.verdicts {
+		connCache.remove(key, entry)
+	}
+	return n
+}
+
 // handleIPv4 extracts IPv4 packet information
 func handleIPv4(packet []byte) (net.IP, net.IP, uint8) {
 	ipHeader := packet[:20]
@@ -159,93 +478,197 @@ func Callback(pkt Packet) int {
 		srcIP, dstIP, protocol = handleIPv6(packet)
 		headerLength = 40
 	default:
-		logger.Log.Printf("Unknown IP version for packet ID: %s", pkt.ID())
+		logger.Log.Warn("unknown IP version", "packet", pkt.ID())
 		return nfqueue.NfAccept
 	}
 
 	srcPort, dstPort := parsePorts(packet, protocol, headerLength)
 	connKey := getConnectionKey(srcIP, srcPort, dstIP, dstPort, protocol)
 
+	pkt.SrcIP = srcIP
+	pkt.DstIP = dstIP
+	pkt.Protocol = protocol
+
+	// DNS responses feed the domain cache and pass when they answer an
+	// allowed query
+	var dnsQuery []byte
+	dnsFlow := isDNSFlow(protocol, srcPort, dstPort)
+	if dnsFlow {
+		msg := dnsPayload(packet, protocol, headerLength)
+		if isDNSPort(srcPort) && acceptDNSReply(srcIP, srcPort, dstIP, dstPort, protocol, msg) {
+			return applyVerdict(&pkt, rules.Accept)
+		}
+		if isDNSPort(dstPort) {
+			dnsQuery = msg
+		}
+	}
+
 	// Check cached verdict
-	if verdict, exists := connCache.getCachedVerdict(connKey); exists {
-		return verdict
+	if entry, exists := connCache.getCachedEntry(connKey); exists {
+		if observeQuery(&pkt, entry.conn, entry.verdict, dnsQuery) {
+			return MarkRerouteNS
+		}
+		return applyVerdict(&pkt, entry.verdict)
+	}
+
+	conn := &rules.Conn{
+		SrcIP:    srcIP,
+		SrcPort:  srcPort,
+		DstIP:    dstIP,
+		DstPort:  dstPort,
+		Protocol: protocol,
+		Inbound:  pkt.Inbound,
+		UID:      -1,
+		GID:      -1,
 	}
 
-	// Get connection details
-	country := geoip.LookupCountry(dstIP)
-	org, asn, _ := geoip.LookupASN(dstIP)
+	// Get connection details for the remote end
+	remoteIP, _ := conn.Remote()
+	record := geo.Lookup(remoteIP)
+	conn.Country, conn.Continent, conn.EU = record.Country, record.Continent, record.EU
+	conn.City = record.City
+	conn.ASN = record.ASN
+	conn.Scope, conn.Label = record.Scope, record.Label
+	conn.LocationUnavailable, conn.ASNUnavailable = record.LocationUnavailable, record.ASNUnavailable
+	if m, ok := iplist.Lookup(remoteIP); ok {
+		conn.IPLists = m.Lists
+	}
 
-	// Use the new connection identifier
-	connDetails, err := connIdentifier.IdentifyConnection(srcIP, srcPort, dstIP, dstPort, protocol)
+	// Identify the process owning the local end of the connection
+	localIP, localPort, remotePort := srcIP, srcPort, dstPort
+	if conn.Inbound {
+		localIP, localPort, remotePort = dstIP, dstPort, srcPort
+	}
+	connDetails, err := attributor.Attribute(proc.Tuple{
+		Protocol:   protocol,
+		LocalIP:    localIP,
+		LocalPort:  localPort,
+		RemoteIP:   remoteIP,
+		RemotePort: remotePort,
+	})
 	if err != nil {
-		logger.Log.Printf("Failed to identify connection: %v", err)
+		logger.Log.Debug("failed to identify connection", "conn", connKey, "err", err)
+	} else {
+		conn.PID = connDetails.PID
+		conn.ProcessName = connDetails.ProcessName
+		conn.Attribution = connDetails.Source
+		conn.UID = connDetails.UID
+		if connDetails.Process != nil {
+			setProcess(conn, connDetails.Process)
+		}
 	}
 
-	// Log connection details
-	logConnection(srcIP, srcPort, dstIP, dstPort, protocol, country, org, asn, connDetails.PID, connDetails.ProcessName)
+	if !conn.Inbound {
+		conn.Domain, conn.OwnDomain = domains.Resolved(conn.PID, remoteIP)
+		if !conn.OwnDomain {
+			conn.Domain, _ = domains.Lookup(conn.PID, remoteIP)
+		}
+	}
+	if listing, ok := listed(conn); ok {
+		conn.FilterList = listing.List
+		conn.FilterEntry = listing.Entry
+	}
 
-	// TODO: Implement rule matching logic here
-	// For now, we'll accept everything but you should add:
-	// 1. Rule matching based on process
-	// 2. User-defined rules
-	// 3. Geographic restrictions
-	// 4. Rate limiting
-	verdict := MarkAcceptAlways // Use firewall mark instead of nfqueue.NfAccept
+	// Listed domains, limits and hash mismatches are logged from the
+	// published event, away from the verdict
+	verdict, rule := evaluate(Rules(), conn)
+	var hashMismatch rules.HashPolicy
+	if rule != nil && rule.HashMismatch(conn) {
+		hashMismatch = rule.OnHashMismatch
+	}
+	byRules := true
+	if verdict == rules.Prompt {
+		verdict, byRules = askUser(connKey, conn), false
+	}
+	var limited string
+	var opened counterKey
+	var ttl time.Duration
+	if rule != nil && rule.Limit != nil && allows(verdict) {
+		if limited, opened = overLimit(rule, conn); limited != "" {
+			verdict, ttl, byRules = rule.Limit.Overflow, limitBackoff, false
+		}
+	}
+	if dnsFlow {
+		verdict, byRules = temporary(verdict), false
+	}
 
 	// Cache the verdict
-	connCache.setCachedVerdict(connKey, verdict)
-
-	// Mark the packet before returning verdict
-	if err := pkt.mark(verdict); err != nil {
-		logger.Log.Printf("Failed to mark packet: %v", err)
-		return MarkAccept // Fallback to basic accept mark if marking fails
+	connCache.setCachedVerdict(connKey, conn, verdict, ttl, byRules, opened)
+
+	ev := Event{
+		Time:         pkt.SeenAt,
+		Key:          connKey,
+		Conn:         conn,
+		Verdict:      verdict,
+		Limited:      limited,
+		HashMismatch: hashMismatch,
+		Org:          record.Org,
 	}
+	if rule != nil {
+		ev.Rule = rule.Name
+	}
+	publish(ev)
 
-	return verdict
+	if observeQuery(&pkt, conn, verdict, dnsQuery) {
+		return MarkRerouteNS
+	}
+	return applyVerdict(&pkt, verdict)
 }
 
-// logConnection logs connection details to file and terminal
-func logConnection(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
-	protocol uint8, country, org string, asn uint, pid int, processName string) {
-
-	var logMsg strings.Builder
-
-	// Format basic connection info with ANSI colors for terminal
-	logMsg.WriteString("\033[1;36m") // Cyan color for connection details
-	fmt.Fprintf(&logMsg, "%s:%d -> %s:%d [%s]",
-		srcIP, srcPort, dstIP, dstPort, utils.GetProtocolName(protocol))
-	logMsg.WriteString("\033[0m") // Reset color
-
-	// Add geographic info
-	if country != "" {
-		logMsg.WriteString("\033[1;33m") // Yellow for country
-		fmt.Fprintf(&logMsg, " Country: %s", country)
-		logMsg.WriteString("\033[0m")
+// setProcess copies the identity of the owning process into conn. The UID
+// reported for the socket wins over the one of the process.
+func setProcess(conn *rules.Conn, p *proc.Process) {
+	conn.ProcessName = p.Name
+	conn.ProcessPath = p.Path
+	conn.Cmdline = p.Cmdline
+	pid := p.PID
+	conn.ExeHash = sync.OnceValues(func() (string, error) {
+		return proc.ExecutableHash(pid)
+	})
+	conn.Started = p.Started
+	conn.GID = p.GID
+	conn.Unit = p.Unit
+	conn.Container = p.Container
+	if conn.UID < 0 {
+		conn.UID = p.UID
 	}
-
-	// Add organizational info
-	if org != "" {
-		logMsg.WriteString("\033[1;32m") // Green for org
-		fmt.Fprintf(&logMsg, " Org: %s", org)
-		logMsg.WriteString("\033[0m")
+	if conn.UID == p.UID {
+		conn.User = p.User
 	}
-	if asn != 0 {
-		fmt.Fprintf(&logMsg, " ASN: %d", asn)
+	for _, a := range p.Ancestors {
+		conn.Parents = append(conn.Parents, rules.Program{Name: a.Name, Path: a.Path})
 	}
+}
+
+// AttributionStats returns the hit and miss counters of the attribution
+// backends
+func AttributionStats() []proc.BackendStats {
+	return attributor.Stats()
+}
 
-	// Add process info
-	if pid != 0 {
-		logMsg.WriteString("\033[1;35m") // Magenta for process
-		fmt.Fprintf(&logMsg, " Process: %s (PID: %d)", processName, pid)
-		logMsg.WriteString("\033[0m")
+// askUser parks the connection until the prompt is answered
+func askUser(connKey string, conn *rules.Conn) rules.Verdict {
+	if prompts == nil {
+		logger.Log.Warn("prompt requested but prompting is disabled, blocking", "conn", connKey)
+		return rules.Block
 	}
 
-	logString := logMsg.String()
+	decision := prompts.Ask(connKey, conn)
+	if decision.TimedOut {
+		logger.Log.Info("prompt timed out", "conn", connKey, "verdict", decision.Verdict)
+		return decision.Verdict
+	}
 
-	// Log to file
-	logger.Log.Println(logString)
+	logger.Log.Info("prompt answered", "conn", connKey, "verdict", decision.Verdict, "scope", decision.Scope)
+	return decision.Verdict
+}
 
-	// Print to terminal with timestamp
-	timestamp := time.Now().Format("15:04:05")
-	fmt.Printf("[%s] %s\n", timestamp, logString)
+// applyVerdict marks the packet according to verdict and returns the mark used
+func applyVerdict(pkt *Packet, verdict rules.Verdict) int {
+	mark := verdictToMark(verdict)
+	if err := pkt.setVerdict(verdict); err != nil {
+		logger.Log.Warn("failed to mark packet", "packet", pkt.ID(), "err", err)
+		return MarkAccept // Fallback to basic accept mark if marking fails
+	}
+	return mark
 }
@@ -0,0 +1,50 @@
+package nfqueue
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/conntrack"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"golang.org/x/sys/unix"
+)
+
+func TestStaleMarks(t *testing.T) {
+	c := useCache(t)
+	entry := func(port uint16, mark uint32) conntrack.Entry {
+		return conntrack.Entry{Mark: mark, Orig: conntrack.Tuple{
+			Protocol: unix.IPPROTO_TCP,
+			Src:      net.ParseIP("192.0.2.1"), SrcPort: port,
+			Dst: net.ParseIP("198.51.100.1"), DstPort: 443,
+		}}
+	}
+	cache := func(port uint16, verdict rules.Verdict, ttl time.Duration) {
+		key, conn := limitedConn(port)
+		c.setCachedVerdict(key, conn, verdict, ttl, true, counterKey{})
+	}
+
+	cache(43001, rules.AcceptAlways, time.Hour)
+	cache(43002, rules.AcceptAlways, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	// Inbound connections are cached in the direction of the reply
+	reverse := getConnectionKey(net.ParseIP("198.51.100.1"), 443, net.ParseIP("192.0.2.1"), 43003, unix.IPPROTO_TCP)
+	c.setCachedVerdict(reverse, &rules.Conn{Inbound: true}, rules.BlockAlways, time.Hour, true, counterKey{})
+
+	entries := []conntrack.Entry{
+		entry(43001, MarkAcceptAlways), // cached
+		entry(43002, MarkAcceptAlways), // cached verdict expired
+		entry(43003, MarkBlockAlways),  // cached under the reverse key
+		entry(43004, MarkDropAlways),   // never cached, or dropped by a flush
+		entry(43005, MarkAccept),       // not saved into the connmark
+		entry(43006, MarkResolver),     // not a verdict
+		entry(43007, 0),
+	}
+	var got []uint16
+	for _, tuple := range c.staleMarks(entries) {
+		got = append(got, tuple.SrcPort)
+	}
+	if len(got) != 2 || got[0] != 43002 || got[1] != 43004 {
+		t.Errorf("stale marks of ports %v, want [43002 43004]", got)
+	}
+}
@@ -0,0 +1,198 @@
+package nfqueue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lonelysadness/netmonitor/internal/geoip"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/pkg/utils"
+)
+
+var (
+	// printConnections writes the decided connections to the terminal too
+	printConnections atomic.Bool
+	// logSample logs one in logSample connections
+	logSample atomic.Int64
+)
+
+func init() {
+	printConnections.Store(true)
+	logSample.Store(1)
+}
+
+// SetConnectionLog configures the connection log sink: whether connections
+// are printed to the terminal too, and to log only one in sample of them.
+func SetConnectionLog(terminal bool, sample int) {
+	printConnections.Store(terminal)
+	logSample.Store(int64(max(sample, 1)))
+}
+
+// LogConnections writes the decided connections to the connection log and
+// the terminal until ctx is done. It runs apart from the verdicts, so a slow
+// disk or terminal drops log records instead of delaying packets.
+func LogConnections(ctx context.Context) {
+	events, unsubscribe := Subscribe("log")
+	defer unsubscribe()
+
+	var n int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			logNotices(ev)
+			n++
+			if n%logSample.Load() != 0 {
+				continue
+			}
+			if logger.Conns.Enabled(ctx, slog.LevelInfo) {
+				logDecision(ev)
+			}
+			if printConnections.Load() {
+				printConnection(ev)
+			}
+		}
+	}
+}
+
+// logNotices writes what deserves attention about a connection to the main
+// log: listed domains, limits and hash mismatches. They are never sampled.
+func logNotices(ev Event) {
+	conn := ev.Conn
+	if conn.FilterList != "" {
+		logger.Log.Info("domain is listed", "domain", conn.Domain, "conn", ev.Key,
+			"list", conn.FilterList, "entry", conn.FilterEntry, "verdict", ev.Verdict)
+	}
+	if ev.Limited != "" {
+		logger.Log.Info("connection over limit", "rule", ev.Rule, "conn", ev.Key,
+			"reason", ev.Limited, "verdict", ev.Verdict)
+	}
+	if ev.HashMismatch != 0 {
+		logger.Log.Warn("executable does not match the pinned hash", "path", conn.ProcessPath,
+			"conn", ev.Key, "rule", ev.Rule, "policy", ev.HashMismatch)
+	}
+}
+
+// logDecision writes the connection and its verdict to the connection log
+func logDecision(ev Event) {
+	conn, org := ev.Conn, ev.Org
+	attrs := []any{
+		"src", net.JoinHostPort(conn.SrcIP.String(), fmt.Sprint(conn.SrcPort)),
+		"dst", net.JoinHostPort(conn.DstIP.String(), fmt.Sprint(conn.DstPort)),
+		"proto", utils.GetProtocolName(conn.Protocol),
+		"inbound", conn.Inbound,
+		"verdict", ev.Verdict,
+	}
+	add := func(key string, value any, ok bool) {
+		if ok {
+			attrs = append(attrs, key, value)
+		}
+	}
+	add("rule", ev.Rule, ev.Rule != "")
+	add("limited", ev.Limited, ev.Limited != "")
+	add("hash_mismatch", ev.HashMismatch, ev.HashMismatch != 0)
+	add("domain", conn.Domain, conn.Domain != "")
+	add("list", conn.FilterList, conn.FilterList != "")
+	add("entry", conn.FilterEntry, conn.FilterEntry != "")
+	add("network", conn.Label, conn.Label != "")
+	add("scope", conn.Scope, conn.Scope == geoip.ScopeLocalhost || conn.Scope == geoip.ScopeLAN)
+	add("country", conn.Country, conn.Country != "")
+	add("city", conn.City, conn.City != "")
+	add("asn", conn.ASN, conn.ASN != 0)
+	add("org", org, org != "")
+	add("ip_lists", strings.Join(conn.IPLists, ","), len(conn.IPLists) > 0)
+	add("pid", conn.PID, conn.PID != 0)
+	add("process", conn.ProcessName, conn.ProcessName != "")
+	add("path", conn.ProcessPath, conn.ProcessPath != "")
+	add("user", conn.User, conn.User != "")
+	add("unit", conn.Unit, conn.Unit != "")
+	add("container", conn.Container, conn.Container != "")
+	logger.Conns.Info("connection", attrs...)
+}
+
+// printConnection writes connection details to the terminal
+func printConnection(ev Event) {
+	conn, org := ev.Conn, ev.Org
+	var logMsg strings.Builder
+
+	// Format basic connection info with ANSI colors for terminal
+	logMsg.WriteString("\033[1;36m") // Cyan color for connection details
+	fmt.Fprintf(&logMsg, "%s:%d -> %s:%d [%s]",
+		conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, utils.GetProtocolName(conn.Protocol))
+	if conn.Domain != "" {
+		fmt.Fprintf(&logMsg, " (%s)", conn.Domain)
+	}
+	logMsg.WriteString("\033[0m") // Reset color
+
+	if conn.FilterList != "" {
+		logMsg.WriteString("\033[1;31m") // Red for listed domains
+		fmt.Fprintf(&logMsg, " Listed: %s in %s", conn.FilterEntry, conn.FilterList)
+		logMsg.WriteString("\033[0m")
+	}
+
+	// Add geographic info; local networks have none
+	switch {
+	case conn.Label != "":
+		logMsg.WriteString("\033[1;33m") // Yellow for networks
+		fmt.Fprintf(&logMsg, " Network: %s", conn.Label)
+		logMsg.WriteString("\033[0m")
+	case conn.Scope == geoip.ScopeLocalhost || conn.Scope == geoip.ScopeLAN:
+		fmt.Fprintf(&logMsg, " Scope: %s", conn.Scope)
+	case conn.Country != "":
+		logMsg.WriteString("\033[1;33m") // Yellow for country
+		fmt.Fprintf(&logMsg, " Country: %s", conn.Country)
+		if conn.City != "" {
+			fmt.Fprintf(&logMsg, ", %s", conn.City)
+		}
+		if conn.Continent != "" {
+			fmt.Fprintf(&logMsg, ", continent %s", conn.Continent)
+		}
+		logMsg.WriteString("\033[0m")
+	}
+
+	// Add organizational info
+	if org != "" && org != conn.Label {
+		logMsg.WriteString("\033[1;32m") // Green for org
+		fmt.Fprintf(&logMsg, " Org: %s", org)
+		logMsg.WriteString("\033[0m")
+	}
+	if conn.ASN != 0 {
+		fmt.Fprintf(&logMsg, " ASN: %d", conn.ASN)
+	}
+	if len(conn.IPLists) > 0 {
+		logMsg.WriteString("\033[1;31m") // Red for listed addresses
+		fmt.Fprintf(&logMsg, " IP lists: %s", strings.Join(conn.IPLists, ","))
+		logMsg.WriteString("\033[0m")
+	}
+
+	// Add process info
+	if conn.PID != 0 {
+		logMsg.WriteString("\033[1;35m") // Magenta for process
+		fmt.Fprintf(&logMsg, " Process: %s (PID: %d", conn.ProcessName, conn.PID)
+		if conn.ProcessPath != "" {
+			fmt.Fprintf(&logMsg, ", %s", conn.ProcessPath)
+		}
+		if conn.User != "" {
+			fmt.Fprintf(&logMsg, ", user %s", conn.User)
+		}
+		if conn.Unit != "" {
+			fmt.Fprintf(&logMsg, ", unit %s", conn.Unit)
+		}
+		if conn.Container != "" {
+			fmt.Fprintf(&logMsg, ", container %.12s", conn.Container)
+		}
+		logMsg.WriteString(")")
+		logMsg.WriteString("\033[0m")
+	}
+
+	fmt.Fprintf(&logMsg, " Verdict: %s", ev.Verdict)
+
+	// Print to terminal with timestamp
+	timestamp := ev.Time.Format("15:04:05")
+	fmt.Printf("[%s] %s\n", timestamp, logMsg.String())
+}
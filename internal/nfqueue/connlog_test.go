@@ -0,0 +1,65 @@
+package nfqueue
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"golang.org/x/sys/unix"
+)
+
+func TestLogNotices(t *testing.T) {
+	var buf bytes.Buffer
+	prev := logger.Log
+	logger.Log = slog.New(slog.NewTextHandler(&buf, nil))
+	t.Cleanup(func() { logger.Log = prev })
+
+	conn := &rules.Conn{
+		SrcIP:       net.ParseIP("192.0.2.1"),
+		SrcPort:     40000,
+		DstIP:       net.ParseIP("198.51.100.1"),
+		DstPort:     443,
+		Protocol:    unix.IPPROTO_TCP,
+		ProcessPath: "/usr/bin/curl",
+	}
+	tests := []struct {
+		name string
+		ev   Event
+		want []string // lines expected in the log, none when empty
+	}{
+		{"plain", Event{Conn: conn, Verdict: rules.Accept}, nil},
+		{
+			"listed",
+			Event{Conn: &rules.Conn{Domain: "ads.example", FilterList: "ads.txt", FilterEntry: "ads.example"}, Verdict: rules.Block},
+			[]string{`msg="domain is listed" domain=ads.example`},
+		},
+		{
+			"limited",
+			Event{Conn: conn, Verdict: rules.Drop, Rule: "curl", Limited: "rate 1/s per process /usr/bin/curl exceeded"},
+			[]string{`msg="connection over limit" rule=curl`},
+		},
+		{
+			"hash mismatch",
+			Event{Conn: conn, Verdict: rules.Accept, Rule: "curl", HashMismatch: rules.HashAllow},
+			[]string{`msg="executable does not match the pinned hash" path=/usr/bin/curl`, "policy=allow"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			logNotices(tt.ev)
+			if len(tt.want) == 0 && buf.Len() != 0 {
+				t.Errorf("logged %q", buf.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("log %q lacks %q", buf.String(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/lonelysadness/netmonitor/internal/dns"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"golang.org/x/sys/unix"
+)
+
+const dnsPort = 53
+
+var (
+	domains         = dns.NewCache()
+	dnsObserve      atomic.Bool
+	dnsRedirectPort atomic.Uint32 // 0 when queries are not redirected
+	blocklist       atomic.Pointer[dns.Blocklist]
+)
+
+func init() {
+	dnsObserve.Store(true)
+}
+
+// SetDNS configures DNS observation. With redirectPort set, allowed queries
+// to remote nameservers are marked for the NAT rule that sends them to the
+// local resolver on that port.
+func SetDNS(observe bool, redirectPort uint16) {
+	dnsObserve.Store(observe)
+	dnsRedirectPort.Store(uint32(redirectPort))
+}
+
+// SetBlocklist blocks outgoing connections to addresses resolved from the
+// listed domains
+func SetBlocklist(b *dns.Blocklist) {
+	blocklist.Store(b)
+}
+
+// Domains returns the cache of resolved addresses used to label connections
+func Domains() *dns.Cache {
+	return domains
+}
+
+// listed returns the filter list entry blocking the domain of conn. Only
+// domains the process resolved itself count: an address learned from
+// another process may be shared with unlisted domains, as CDNs do.
+func listed(conn *rules.Conn) (dns.Listing, bool) {
+	if conn.Inbound || conn.Domain == "" || !conn.OwnDomain {
+		return dns.Listing{}, false
+	}
+	return blocklist.Load().Match(conn.Domain)
+}
+
+// evaluate decides the verdict of conn. Connections to listed domains that
+// no rule matches are blocked. The block is not remembered by conntrack as
+// the address may serve unlisted domains later.
+func evaluate(rs *rules.RuleSet, conn *rules.Conn) (rules.Verdict, *rules.Rule) {
+	verdict, rule := rs.Evaluate(conn)
+	if rule == nil {
+		if _, ok := listed(conn); ok {
+			return rules.Block, nil
+		}
+	}
+	return verdict, rule
+}
+
+func isDNSPort(port uint16) bool {
+	return port == dnsPort || (port != 0 && uint32(port) == dnsRedirectPort.Load())
+}
+
+// isDNSFlow reports whether the packet belongs to DNS traffic that is
+// observed. Such flows only get temporary verdicts so that every packet,
+// including the responses, keeps passing through the queue.
+func isDNSFlow(protocol uint8, srcPort, dstPort uint16) bool {
+	if !dnsObserve.Load() || (protocol != unix.IPPROTO_UDP && protocol != unix.IPPROTO_TCP) {
+		return false
+	}
+	return isDNSPort(srcPort) || isDNSPort(dstPort)
+}
+
+// dnsPayload returns the DNS message carried by the packet, or nil when the
+// packet does not hold a complete one
+func dnsPayload(packet []byte, protocol uint8, headerLength int) []byte {
+	if len(packet) <= headerLength {
+		return nil
+	}
+	transport := packet[headerLength:]
+	switch protocol {
+	case unix.IPPROTO_UDP:
+		if len(transport) <= 8 {
+			return nil
+		}
+		return transport[8:]
+	case unix.IPPROTO_TCP:
+		if len(transport) < 20 {
+			return nil
+		}
+		offset := int(transport[12]>>4) * 4
+		if len(transport) < offset+2 {
+			return nil
+		}
+		// DNS over TCP prefixes each message with its length
+		payload := transport[offset:]
+		length := int(binary.BigEndian.Uint16(payload))
+		if len(payload) < 2+length {
+			return nil
+		}
+		return payload[2 : 2+length]
+	}
+	return nil
+}
+
+// temporary turns a verdict into the variant that is not remembered by
+// conntrack
+func temporary(v rules.Verdict) rules.Verdict {
+	switch v {
+	case rules.AcceptAlways:
+		return rules.Accept
+	case rules.BlockAlways:
+		return rules.Block
+	case rules.DropAlways:
+		return rules.Drop
+	}
+	return v
+}
+
+func allows(v rules.Verdict) bool {
+	return v == rules.Accept || v == rules.AcceptAlways
+}
+
+// acceptDNSReply records the answers of a DNS response and reports whether
+// it replies to a query that was allowed
+func acceptDNSReply(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, protocol uint8, msg []byte) bool {
+	if msg != nil {
+		if _, _, ok := domains.Response(dstIP, dstPort, msg); ok {
+			return true
+		}
+	}
+
+	// Replies on loopback pass the queue twice, the query is gone by then
+	reverseKey := getConnectionKey(dstIP, dstPort, srcIP, srcPort, protocol)
+	if entry, ok := connCache.getCachedEntry(reverseKey); ok {
+		return allows(entry.verdict)
+	}
+	return false
+}
+
+// observeQuery records an allowed outgoing query for the process that sent
+// it. It reports whether the query was rerouted to the local resolver, in
+// which case the packet already has its verdict.
+func observeQuery(pkt *Packet, conn *rules.Conn, verdict rules.Verdict, msg []byte) bool {
+	if pkt.Inbound || msg == nil || !allows(verdict) {
+		return false
+	}
+	if _, err := domains.Query(conn.PID, conn.SrcIP, conn.SrcPort, msg); err != nil {
+		return false
+	}
+
+	// The resolver's own upstream queries must never loop back to it. The
+	// mangle chain returns them by their mark before they are queued, so
+	// only the queries of this process are left to recognize here.
+	if conn.PID == os.Getpid() {
+		return false
+	}
+	if dnsRedirectPort.Load() == 0 || conn.DstIP.IsLoopback() {
+		return false
+	}
+	if err := pkt.RerouteToNameserver(); err != nil {
+		logger.Log.Warn("failed to reroute DNS query", "err", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package nfqueue
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/rules"
+)
+
+// eventBuffer is how far a subscriber can fall behind before its events are
+// dropped
+const eventBuffer = 1024
+
+// Event describes a verdict taken for a new connection
+type Event struct {
+	Time    time.Time
+	Key     string
+	Conn    *rules.Conn
+	Verdict rules.Verdict
+	Rule    string // name of the matching rule, empty for the default verdict
+	// Limited tells why the connection went over the limit of Rule and got
+	// its overflow verdict; empty for connections within the limit
+	Limited string
+	// HashMismatch is the policy applied because the executable has none
+	// of the hashes pinned by Rule; 0 when it matched or none are pinned
+	HashMismatch rules.HashPolicy
+	Org          string // organization owning the remote address
+}
+
+// SinkStats counts the events of the subscribers sharing a name
+type SinkStats struct {
+	Name      string
+	Delivered uint64
+	Dropped   uint64 // because the subscriber fell behind
+}
+
+type sinkCounters struct {
+	delivered, dropped atomic.Uint64
+}
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   = make(map[chan Event]*sinkCounters)
+	// counters outlive the subscriptions, so the stats of a sink add up
+	// across reconnects
+	counters = make(map[string]*sinkCounters)
+)
+
+// Subscribe returns a channel receiving an Event for every new connection
+// and a function ending the subscription. name groups the counters of the
+// subscription in EventStats. Events are dropped for subscribers that fall
+// behind so they never delay verdicts.
+func Subscribe(name string) (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	subscribersMu.Lock()
+	c, ok := counters[name]
+	if !ok {
+		c = &sinkCounters{}
+		counters[name] = c
+	}
+	subscribers[ch] = c
+	subscribersMu.Unlock()
+
+	return ch, func() {
+		subscribersMu.Lock()
+		defer subscribersMu.Unlock()
+		if _, ok := subscribers[ch]; ok {
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// EventStats returns the event counters of every subscriber name
+func EventStats() []SinkStats {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	stats := make([]SinkStats, 0, len(counters))
+	for name, c := range counters {
+		stats = append(stats, SinkStats{Name: name, Delivered: c.delivered.Load(), Dropped: c.dropped.Load()})
+	}
+	slices.SortFunc(stats, func(a, b SinkStats) int { return strings.Compare(a.Name, b.Name) })
+	return stats
+}
+
+func publish(ev Event) {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	for ch, c := range subscribers {
+		select {
+		case ch <- ev:
+			c.delivered.Add(1)
+		default:
+			c.dropped.Add(1)
+		}
+	}
+}
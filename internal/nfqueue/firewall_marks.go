@@ -1,5 +1,10 @@
 package nfqueue
 
+import (
+	"github.com/lonelysadness/netmonitor/internal/dns"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+)
+
 const (
 	MarkAccept       = 1700
 	MarkBlock        = 1701
@@ -7,6 +12,7 @@ const (
 	MarkAcceptAlways = 1710
 	MarkBlockAlways  = 1711
 	MarkDropAlways   = 1712
+	MarkResolver     = dns.UpstreamMark
 	MarkRerouteNS    = 1799
 )
 
@@ -18,6 +24,7 @@ var markDescriptions = map[int]string{
 	MarkAcceptAlways: "AcceptAlways",
 	MarkBlockAlways:  "BlockAlways",
 	MarkDropAlways:   "DropAlways",
+	MarkResolver:     "Resolver",
 	MarkRerouteNS:    "RerouteNS",
 }
 
@@ -27,3 +34,21 @@ func markToString(mark int) string {
 	}
 	return "unknown"
 }
+
+// verdictMarks maps rule verdicts to the firewall marks understood by the
+// iptables chains
+var verdictMarks = map[rules.Verdict]int{
+	rules.Accept:       MarkAccept,
+	rules.Block:        MarkBlock,
+	rules.Drop:         MarkDrop,
+	rules.AcceptAlways: MarkAcceptAlways,
+	rules.BlockAlways:  MarkBlockAlways,
+	rules.DropAlways:   MarkDropAlways,
+}
+
+func verdictToMark(v rules.Verdict) int {
+	if mark, ok := verdictMarks[v]; ok {
+		return mark
+	}
+	return MarkAccept
+}
@@ -0,0 +1,149 @@
+package nfqueue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/rules"
+)
+
+// limitBackoff is how long the overflow verdict of a limited connection is
+// cached, so its retransmissions do not go through the rules again
+const limitBackoff = time.Second
+
+// counterKey identifies the token bucket and the open connection counter
+// of one process or destination under one rule
+type counterKey struct {
+	rule string
+	key  string
+}
+
+// bucket is a token bucket; one token is taken per new connection
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket refills up to the burst
+}
+
+// take refills the bucket for the time passed since the last call and
+// takes a token if there is one
+func (b *bucket) take(l *rules.Limit, now time.Time) bool {
+	perSecond := float64(l.Rate.Count) / l.Rate.Period.Seconds()
+	b.tokens = min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(l.Burst) - b.tokens) / perSecond * float64(time.Second)))
+	return true
+}
+
+var (
+	bucketsMu sync.Mutex
+	buckets   = make(map[counterKey]*bucket)
+)
+
+// limitKey returns what l counts conn by, empty when it is not known
+func limitKey(l *rules.Limit, conn *rules.Conn) string {
+	if l.Per == rules.LimitDestination {
+		return destinationKey(conn)
+	}
+	return processKey(conn)
+}
+
+// overLimit checks conn against the limit of the rule accepting it. It
+// returns why conn is over the limit, or an empty string and the open
+// connection counter conn now holds, which goes into its cache entry.
+// Connections whose process or destination is not known are not limited.
+func overLimit(rule *rules.Rule, conn *rules.Conn) (string, counterKey) {
+	l := rule.Limit
+	key := limitKey(l, conn)
+	if key == "" {
+		return "", counterKey{}
+	}
+	k := counterKey{rule: rule.Name, key: key}
+
+	var held counterKey
+	if l.MaxConnections > 0 {
+		var n int
+		var ok bool
+		if held, n, ok = connCache.reserve(k, conn, l.MaxConnections); !ok {
+			return fmt.Sprintf("%d open connections per %s %s", n, l.Per, key), counterKey{}
+		}
+	}
+	if l.Rate.Count > 0 {
+		now := time.Now()
+		bucketsMu.Lock()
+		defer bucketsMu.Unlock()
+		b, ok := buckets[k]
+		if !ok {
+			b = &bucket{tokens: float64(l.Burst), last: now}
+			buckets[k] = b
+		}
+		if !b.take(l, now) {
+			connCache.unreserve(held)
+			return fmt.Sprintf("rate %s per %s %s exceeded", l.Rate, l.Per, key), counterKey{}
+		}
+	}
+	return "", held
+}
+
+// expireBuckets drops the buckets that have refilled, as they are the same
+// as new ones
+func expireBuckets() {
+	now := time.Now()
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	for k, b := range buckets {
+		if now.After(b.full) {
+			delete(buckets, k)
+		}
+	}
+}
+
+// reserve counts conn as open under k unless max connections are open
+// already. It returns the counter the cache entry of conn is to hold, and
+// how many connections were open when it fails. Both directions of a
+// connection count once: when the other one holds k already, nothing is
+// counted and the zero key is returned.
+func (c *ConnectionCache) reserve(k counterKey, conn *rules.Conn, max int) (counterKey, int, bool) {
+	reverse := getConnectionKey(conn.DstIP, conn.DstPort, conn.SrcIP, conn.SrcPort, conn.Protocol)
+	c.Lock()
+	defer c.Unlock()
+	if entry, ok := c.verdicts[reverse]; ok && entry.opened == k {
+		return counterKey{}, 0, true
+	}
+	if n := c.open[k]; n >= max {
+		return counterKey{}, n, false
+	}
+	c.open[k]++
+	return k, 0, true
+}
+
+// unreserve gives back a count taken by reserve that no entry holds
+func (c *ConnectionCache) unreserve(k counterKey) {
+	c.Lock()
+	defer c.Unlock()
+	c.release(k)
+}
+
+// remove drops the entry cached under key and gives back its open
+// connection count. c must be locked.
+func (c *ConnectionCache) remove(key string, entry *CacheEntry) {
+	delete(c.verdicts, key)
+	c.release(entry.opened)
+	entry.opened = counterKey{}
+}
+
+// release decrements the open connection counter k. The zero key counts
+// nothing. c must be locked.
+func (c *ConnectionCache) release(k counterKey) {
+	if k == (counterKey{}) {
+		return
+	}
+	if c.open[k]--; c.open[k] <= 0 {
+		delete(c.open, k)
+	}
+}
@@ -0,0 +1,215 @@
+package nfqueue
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/conntrack"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"golang.org/x/sys/unix"
+)
+
+func TestBucketTake(t *testing.T) {
+	l := &rules.Limit{Rate: rules.Rate{Count: 2, Period: time.Second}, Burst: 3}
+	start := time.Unix(1000, 0)
+	b := &bucket{tokens: float64(l.Burst), last: start}
+
+	steps := []struct {
+		after time.Duration
+		want  bool
+	}{
+		// The burst is spent at once
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false},
+		// Two tokens a second come back
+		{400 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+		{time.Second, true},
+		// Refilling stops at the burst
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, s := range steps {
+		now := start.Add(s.after)
+		if got := b.take(l, now); got != s.want {
+			t.Fatalf("step %d: take at +%s = %v, want %v (tokens %.2f)", i, s.after, got, s.want, b.tokens)
+		}
+	}
+}
+
+func TestBucketFull(t *testing.T) {
+	l := &rules.Limit{Rate: rules.Rate{Count: 10, Period: time.Second}, Burst: 10}
+	now := time.Unix(1000, 0)
+	b := &bucket{tokens: float64(l.Burst), last: now}
+	for i := 0; i < 5; i++ {
+		b.take(l, now)
+	}
+	// Five tokens at ten a second
+	if want := now.Add(500 * time.Millisecond); !b.full.Equal(want) {
+		t.Errorf("full = %s, want %s", b.full, want)
+	}
+}
+
+// useCache replaces the connection cache for the duration of the test
+func useCache(t *testing.T) *ConnectionCache {
+	t.Helper()
+	c := &ConnectionCache{
+		verdicts: make(map[string]*CacheEntry),
+		closed:   make(map[string]*CacheEntry),
+		counted:  make(map[string][2]conntrack.Counters),
+		open:     make(map[counterKey]int),
+	}
+	prev := connCache
+	connCache = c
+	t.Cleanup(func() { connCache = prev })
+	return c
+}
+
+func limitedConn(port uint16) (string, *rules.Conn) {
+	conn := &rules.Conn{
+		SrcIP:       net.ParseIP("192.0.2.1"),
+		SrcPort:     port,
+		DstIP:       net.ParseIP("198.51.100.1"),
+		DstPort:     443,
+		Protocol:    unix.IPPROTO_TCP,
+		ProcessPath: "/usr/bin/curl",
+	}
+	return getConnectionKey(conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, conn.Protocol), conn
+}
+
+// admit runs conn through the limit of rule as Callback does and reports
+// whether it was accepted
+func admit(rule *rules.Rule, key string, conn *rules.Conn) bool {
+	limited, opened := overLimit(rule, conn)
+	verdict := rule.Verdict
+	if limited != "" {
+		verdict = rule.Limit.Overflow
+	}
+	connCache.setCachedVerdict(key, conn, verdict, 0, limited == "", opened)
+	return limited == ""
+}
+
+func TestMaxConnections(t *testing.T) {
+	c := useCache(t)
+	limit := &rules.Limit{MaxConnections: 2}
+	rule := &rules.Rule{Name: "curl", Verdict: rules.Accept, Limit: limit}
+	if err := limit.Validate(rule.Verdict); err != nil {
+		t.Fatal(err)
+	}
+	other := &rules.Rule{Name: "other", Verdict: rules.Accept, Limit: limit}
+
+	key1, conn1 := limitedConn(40001)
+	key2, conn2 := limitedConn(40002)
+	key3, conn3 := limitedConn(40003)
+	if !admit(rule, key1, conn1) || !admit(rule, key2, conn2) {
+		t.Fatal("connections within the limit were refused")
+	}
+	if admit(rule, key3, conn3) {
+		t.Fatal("third connection was accepted")
+	}
+	// Connections accepted by another rule count apart
+	if !admit(other, key3, conn3) {
+		t.Fatal("connection of another rule was refused")
+	}
+
+	// The reply direction of an open connection does not count again
+	reverse := getConnectionKey(conn1.DstIP, conn1.DstPort, conn1.SrcIP, conn1.SrcPort, conn1.Protocol)
+	reply := &rules.Conn{
+		SrcIP: conn1.DstIP, SrcPort: conn1.DstPort,
+		DstIP: conn1.SrcIP, DstPort: conn1.SrcPort,
+		Protocol: conn1.Protocol, Inbound: true, ProcessPath: conn1.ProcessPath,
+	}
+	if !admit(rule, reverse, reply) {
+		t.Fatal("reply direction of an open connection was refused")
+	}
+	if n := c.open[counterKey{rule: "curl", key: "/usr/bin/curl"}]; n != 2 {
+		t.Errorf("open = %d, want 2", n)
+	}
+
+	// Closing a connection frees its place
+	c.track(conntrack.Event{Type: conntrack.EventDestroy, Entry: conntrack.Entry{Orig: conntrack.Tuple{
+		Protocol: conn1.Protocol,
+		Src:      conn1.SrcIP, SrcPort: conn1.SrcPort,
+		Dst: conn1.DstIP, DstPort: conn1.DstPort,
+	}}})
+	if !admit(rule, key3, conn3) {
+		t.Fatal("connection refused after another one closed")
+	}
+	if admit(rule, key1, conn1) {
+		t.Fatal("connection accepted over the limit")
+	}
+
+	// Expired entries give their count back when they are dropped
+	for _, entry := range c.verdicts {
+		entry.expiry = time.Time{}
+	}
+	c.cleanup()
+	if len(c.open) != 0 {
+		t.Errorf("counters left after cleanup: %v", c.open)
+	}
+}
+
+func TestFlushReleasesConnections(t *testing.T) {
+	c := useCache(t)
+	limit := &rules.Limit{MaxConnections: 2}
+	rule := &rules.Rule{Name: "curl", Verdict: rules.Accept, Limit: limit}
+	if err := limit.Validate(rule.Verdict); err != nil {
+		t.Fatal(err)
+	}
+
+	key1, conn1 := limitedConn(42001)
+	key2, conn2 := limitedConn(42002)
+	key3, conn3 := limitedConn(42003)
+	if !admit(rule, key1, conn1) || !admit(rule, key2, conn2) {
+		t.Fatal("connections within the limit were refused")
+	}
+	if admit(rule, key3, conn3) {
+		t.Fatal("third connection was accepted")
+	}
+
+	if n := FlushCache(); n != 3 {
+		t.Errorf("FlushCache() = %d, want 3", n)
+	}
+	if len(c.open) != 0 {
+		t.Errorf("counters left after a flush: %v", c.open)
+	}
+	if !admit(rule, key1, conn1) || !admit(rule, key2, conn2) {
+		t.Fatal("connections refused after a flush")
+	}
+	if admit(rule, key3, conn3) {
+		t.Fatal("third connection was accepted after a flush")
+	}
+}
+
+func TestRateWithMaxConnections(t *testing.T) {
+	c := useCache(t)
+	t.Cleanup(func() {
+		bucketsMu.Lock()
+		clear(buckets)
+		bucketsMu.Unlock()
+	})
+	limit := &rules.Limit{Rate: rules.Rate{Count: 1, Period: time.Hour}, MaxConnections: 5}
+	rule := &rules.Rule{Name: "rated", Verdict: rules.Accept, Limit: limit}
+	if err := limit.Validate(rule.Verdict); err != nil {
+		t.Fatal(err)
+	}
+
+	key1, conn1 := limitedConn(41001)
+	key2, conn2 := limitedConn(41002)
+	if !admit(rule, key1, conn1) {
+		t.Fatal("first connection was refused")
+	}
+	if admit(rule, key2, conn2) {
+		t.Fatal("connection over the rate was accepted")
+	}
+	// The refused connection holds no open count
+	if n := c.open[counterKey{rule: "rated", key: "/usr/bin/curl"}]; n != 1 {
+		t.Errorf("open = %d, want 1", n)
+	}
+}
@@ -33,6 +33,15 @@ type QueueStats struct {
 	ProcessingTime   time.Duration
 }
 
+// QueueStatsSnapshot is a point in time copy of a queue's statistics
+type QueueStatsSnapshot struct {
+	QueueID          uint16
+	PacketsProcessed uint64
+	PacketsDropped   uint64
+	ProcessingTime   time.Duration
+	PendingVerdicts  uint64
+}
+
 func NewQueue(qid uint16, v6 bool, callback func(Packet) int) (*Queue, error) {
 	afFamily := unix.AF_INET
 	if v6 {
@@ -76,12 +85,12 @@ func (q *Queue) open(ctx context.Context, callback func(Packet) int) error {
 
 	nf, err := nfqueue.Open(cfg)
 	if err != nil {
-		logger.Log.Printf("nfqueue: failed to open queue %d: %s", q.id, err)
+		logger.Log.Error("nfqueue: failed to open queue", "queue", q.id, "err", err)
 		return err
 	}
 
 	if err := nf.RegisterWithErrorFunc(ctx, q.packetHandler(ctx, callback), q.handleError); err != nil {
-		logger.Log.Printf("nfqueue: failed to register error function for queue %d: %s", q.id, err)
+		logger.Log.Error("nfqueue: failed to register error function", "queue", q.id, "err", err)
 		_ = nf.Close()
 		return err
 	}
@@ -111,22 +120,27 @@ func (q *Queue) packetHandler(ctx context.Context, callback func(Packet) int) fu
 			verdictPending: abool.New(),
 			Data:           *attrs.Payload, // Dereference the pointer to get the byte slice
 		}
+		pkt.SeenAt = start
+		pkt.Inbound = attrs.Hook != nil && *attrs.Hook == unix.NF_INET_LOCAL_IN
 
 		select {
 		case q.packets <- pkt:
-			go callback(pkt)
+			go q.handle(pkt, callback)
 		case <-ctx.Done():
 			return 0
 		case <-time.After(time.Second):
-			logger.Log.Printf("nfqueue: failed to queue packet, slowing down intake")
+			logger.Log.Warn("nfqueue: failed to queue packet, slowing down intake")
 			time.Sleep(10 * time.Millisecond)
 			select {
 			case q.packets <- pkt:
-				go callback(pkt)
+				go q.handle(pkt, callback)
 			case <-ctx.Done():
 				return 0
 			case <-time.After(time.Second):
-				logger.Log.Printf("nfqueue: failed to queue packet again, dropping")
+				logger.Log.Warn("nfqueue: failed to queue packet again, dropping")
+				q.stats.Lock()
+				q.stats.PacketsDropped++
+				q.stats.Unlock()
 			}
 		}
 
@@ -134,6 +148,13 @@ func (q *Queue) packetHandler(ctx context.Context, callback func(Packet) int) fu
 	}
 }
 
+// handle runs callback for pkt and frees its slot in q.packets, which bounds
+// the packets waiting for a verdict
+func (q *Queue) handle(pkt Packet, callback func(Packet) int) {
+	defer func() { <-q.packets }()
+	callback(pkt)
+}
+
 func (q *Queue) handleError(e error) int {
 	if opError, ok := e.(interface {
 		Timeout() bool
@@ -146,7 +167,7 @@ func (q *Queue) handleError(e error) int {
 	}
 
 	if !strings.HasSuffix(e.Error(), "use of closed file") {
-		logger.Log.Printf("nfqueue: encountered error while receiving packets: %s\n", e.Error())
+		logger.Log.Error("nfqueue: encountered error while receiving packets", "err", e)
 	}
 
 	if nf := q.getNfq(); nf != nil {
@@ -172,14 +193,32 @@ func (q *Queue) monitor(ctx context.Context, callback func(Packet) int) {
 				if err == nil {
 					break
 				}
-				logger.Log.Printf("Failed to open nfqueue: %s", err)
+				logger.Log.Error("failed to open nfqueue", "err", err)
 				time.Sleep(100 * time.Millisecond)
 			}
-			logger.Log.Println("Reopened nfqueue")
+			logger.Log.Info("reopened nfqueue")
 		}
 	}
 }
 
+// ID returns the nfqueue number
+func (q *Queue) ID() uint16 {
+	return q.id
+}
+
+// Stats returns a snapshot of the queue statistics
+func (q *Queue) Stats() QueueStatsSnapshot {
+	q.stats.Lock()
+	defer q.stats.Unlock()
+	return QueueStatsSnapshot{
+		QueueID:          q.id,
+		PacketsProcessed: q.stats.PacketsProcessed,
+		PacketsDropped:   q.stats.PacketsDropped,
+		ProcessingTime:   q.stats.ProcessingTime,
+		PendingVerdicts:  atomic.LoadUint64(&q.pendingVerdicts),
+	}
+}
+
 func (q *Queue) Run(ctx context.Context) {
 	<-ctx.Done()
 	q.Destroy()
@@ -189,7 +228,7 @@ func (q *Queue) Destroy() {
 	q.cancelSocketCallback()
 	if nf := q.getNfq(); nf != nil {
 		if err := nf.Close(); err != nil {
-			logger.Log.Printf("nfqueue: failed to close queue %d: %s", q.id, err)
+			logger.Log.Warn("nfqueue: failed to close queue", "queue", q.id, "err", err)
 		}
 	}
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/florianl/go-nfqueue"
 	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/rules"
 	"github.com/tevino/abool"
 	"golang.org/x/sys/unix"
 )
@@ -57,8 +58,6 @@ func (pkt *Packet) ID() string {
 }
 
 func (pkt *Packet) LoadPacketData() error {
-	// Add detailed logging for packet data loading
-	logger.Log.Printf("Loading packet data for packet ID: %d", pkt.pktID)
 	// Implement actual packet data loading logic if needed
 	return nil
 }
@@ -90,8 +89,8 @@ func (pkt *Packet) setMark(mark int) error {
 				continue
 			}
 
-			logger.Log.Printf("nfqueue: failed to set verdict %s for %s (%s -> %s): %s",
-				markToString(mark), pkt.ID(), pkt.SrcIP, pkt.DstIP, err)
+			logger.Log.Warn("nfqueue: failed to set verdict", "mark", markToString(mark),
+				"packet", pkt.ID(), "src", pkt.SrcIP, "dst", pkt.DstIP, "err", err)
 			return err
 		}
 		break
@@ -100,12 +99,10 @@ func (pkt *Packet) setMark(mark int) error {
 }
 
 func (pkt *Packet) Accept() error {
-	logger.Log.Printf("Accepting packet ID: %d", pkt.pktID)
 	defer putPacket(pkt) // Ensure packet is put back to the pool
 	return pkt.mark(MarkAccept)
 }
 func (pkt *Packet) Block() error {
-	logger.Log.Printf("Blocking packet ID: %d", pkt.pktID)
 	defer putPacket(pkt) // Ensure packet is put back to the pool
 	if pkt.Protocol == unix.IPPROTO_ICMP {
 		return pkt.mark(MarkDrop)
@@ -114,12 +111,10 @@ func (pkt *Packet) Block() error {
 }
 
 func (pkt *Packet) Drop() error {
-	logger.Log.Printf("Dropping packet ID: %d", pkt.pktID)
 	return pkt.mark(MarkDrop)
 }
 
 func (pkt *Packet) PermanentAccept() error {
-	logger.Log.Printf("Permanently accepting packet ID: %d", pkt.pktID)
 	if !pkt.Base.Inbound && pkt.DstIP.IsLoopback() {
 		return pkt.Accept()
 	}
@@ -127,7 +122,6 @@ func (pkt *Packet) PermanentAccept() error {
 }
 
 func (pkt *Packet) PermanentBlock() error {
-	logger.Log.Printf("Permanently blocking packet ID: %d", pkt.pktID)
 	if pkt.Protocol == unix.IPPROTO_ICMP || pkt.Protocol == unix.IPPROTO_ICMPV6 {
 		return pkt.mark(MarkDropAlways)
 	}
@@ -135,11 +129,28 @@ func (pkt *Packet) PermanentBlock() error {
 }
 
 func (pkt *Packet) PermanentDrop() error {
-	logger.Log.Printf("Permanently dropping packet ID: %d", pkt.pktID)
 	return pkt.mark(MarkDropAlways)
 }
 
+// setVerdict applies a rule verdict using the matching packet action
+func (pkt *Packet) setVerdict(v rules.Verdict) error {
+	switch v {
+	case rules.Accept:
+		return pkt.Accept()
+	case rules.Block:
+		return pkt.Block()
+	case rules.Drop:
+		return pkt.Drop()
+	case rules.AcceptAlways:
+		return pkt.PermanentAccept()
+	case rules.BlockAlways:
+		return pkt.PermanentBlock()
+	case rules.DropAlways:
+		return pkt.PermanentDrop()
+	}
+	return fmt.Errorf("unsupported verdict %s", v)
+}
+
 func (pkt *Packet) RerouteToNameserver() error {
-	logger.Log.Printf("Rerouting packet ID: %d to nameserver", pkt.pktID)
 	return pkt.mark(MarkRerouteNS)
 }
@@ -0,0 +1,267 @@
+package nfqueue
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/accounting"
+	"github.com/lonelysadness/netmonitor/internal/conntrack"
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+)
+
+const (
+	// closedRetention is how long ended connections stay listed
+	closedRetention = time.Minute
+	// resyncInterval is how often the conntrack table is dumped to refresh
+	// the counters and catch the ends of connections whose events were lost
+	resyncInterval = 10 * time.Second
+)
+
+var (
+	// tracking is set while conntrack events are received. Without them
+	// the cached verdicts fall back to expiring after cacheDuration.
+	tracking atomic.Bool
+	meter    = accounting.NewMeter()
+)
+
+// Traffic returns the meter summing the traffic of connections
+func Traffic() *accounting.Meter {
+	return meter
+}
+
+// Flow is the life of a connection as conntrack reports it. Sent and
+// Received are seen from this host.
+type Flow struct {
+	Opened   time.Time
+	Closed   time.Time // zero while the connection is open
+	State    string
+	Sent     conntrack.Counters
+	Received conntrack.Counters
+}
+
+// TrackConnections follows the conntrack table until ctx is done: cached
+// verdicts get the state and traffic of their connection and are dropped
+// when the connection ends. When events cannot be received the cache keeps
+// expiring verdicts after cacheDuration.
+func TrackConnections(ctx context.Context) {
+	if err := conntrack.EnableAccounting(); err != nil {
+		logger.Log.Warn("connection traffic may not be counted", "err", err)
+	}
+
+	tracking.Store(true)
+	defer tracking.Store(false)
+
+	resyncCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go resync(resyncCtx)
+
+	err := conntrack.Listen(ctx, connCache.track, func() {
+		logger.Log.Warn("lost conntrack events, connection states are stale until the next resync")
+	})
+	if err != nil {
+		logger.Log.Error("connection tracking stopped, cached verdicts expire again", "err", err)
+	}
+}
+
+// resync dumps the conntrack table every resyncInterval until ctx is done
+func resync(ctx context.Context) {
+	ct, err := conntrack.Dial()
+	if err != nil {
+		logger.Log.Warn("not refreshing connection states", "err", err)
+		return
+	}
+	defer ct.Close()
+
+	// Traffic moved before netmonitor started is not counted
+	if entries, err := ct.Dump(); err == nil {
+		connCache.resync(entries, time.Now())
+	}
+
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			started := time.Now()
+			entries, err := ct.Dump()
+			if err != nil {
+				logger.Log.Warn("failed to dump conntrack table", "err", err)
+				continue
+			}
+			connCache.resync(entries, started)
+		}
+	}
+}
+
+// entryKeys returns the cache keys of both directions of e, the one of
+// e.Orig first
+func entryKeys(e *conntrack.Entry) [2]string {
+	t := e.Orig
+	return [2]string{
+		getConnectionKey(t.Src, t.SrcPort, t.Dst, t.DstPort, t.Protocol),
+		getConnectionKey(t.Dst, t.DstPort, t.Src, t.SrcPort, t.Protocol),
+	}
+}
+
+// track applies a conntrack event to the entries of its connection
+func (c *ConnectionCache) track(ev conntrack.Event) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	keys := entryKeys(&ev.Entry)
+	c.account(&ev.Entry, keys, now)
+	for i, key := range keys {
+		entry, ok := c.verdicts[key]
+		if !ok {
+			continue
+		}
+		entry.update(&ev.Entry, i == 0, now)
+		if ev.Type == conntrack.EventDestroy {
+			entry.close(&ev.Entry, now)
+			c.remove(key, entry)
+			c.closed[key] = entry
+		}
+	}
+	if ev.Type == conntrack.EventDestroy {
+		delete(c.counted, keys[0])
+	}
+}
+
+// resync updates the entries from a dump of the conntrack table started at
+// dumped. Tracked entries missing from the table have ended without an
+// event reaching us.
+func (c *ConnectionCache) resync(entries []conntrack.Entry, dumped time.Time) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	present := make(map[string]bool, len(entries))
+	for i := range entries {
+		keys := entryKeys(&entries[i])
+		present[keys[0]] = true
+		c.account(&entries[i], keys, now)
+		for j, key := range keys {
+			if entry, ok := c.verdicts[key]; ok {
+				entry.update(&entries[i], j == 0, now)
+			}
+		}
+	}
+	for key := range c.counted {
+		if !present[key] {
+			delete(c.counted, key)
+		}
+	}
+	for key, entry := range c.verdicts {
+		if entry.flow != nil && entry.seen.Before(dumped) {
+			entry.close(nil, now)
+			c.remove(key, entry)
+			c.closed[key] = entry
+		}
+	}
+}
+
+// update copies the state of ct into the flow of the entry. orig tells
+// whether the entry is keyed in the direction of ct.Orig.
+func (e *CacheEntry) update(ct *conntrack.Entry, orig bool, now time.Time) {
+	if e.flow == nil {
+		e.flow = &Flow{Opened: now}
+		if !ct.Start.IsZero() {
+			e.flow.Opened = ct.Start
+		}
+	}
+	e.seen = now
+	e.flow.State = ct.State()
+	// The original direction is sent by the local end of outbound
+	// connections and received by the one of inbound connections
+	if orig != e.conn.Inbound {
+		e.flow.Sent, e.flow.Received = ct.OrigCounters, ct.ReplyCounters
+	} else {
+		e.flow.Sent, e.flow.Received = ct.ReplyCounters, ct.OrigCounters
+	}
+}
+
+// close marks the flow of the entry as ended, at the stop time of ct when
+// conntrack recorded one
+func (e *CacheEntry) close(ct *conntrack.Entry, now time.Time) {
+	if e.flow == nil {
+		e.flow = &Flow{Opened: now}
+	}
+	e.flow.Closed = now
+	if ct != nil && !ct.Stop.IsZero() {
+		e.flow.Closed = ct.Stop
+	}
+	e.flow.State = "CLOSED"
+}
+
+// account adds the traffic of ct since it was last counted to the meter,
+// for the process and destination of the cached entry of either of its
+// keys. Traffic of connections without an entry is only remembered as
+// counted.
+func (c *ConnectionCache) account(ct *conntrack.Entry, keys [2]string, now time.Time) {
+	prev := c.counted[keys[0]]
+	c.counted[keys[0]] = [2]conntrack.Counters{ct.OrigCounters, ct.ReplyCounters}
+	orig, reply := since(ct.OrigCounters, prev[0]), since(ct.ReplyCounters, prev[1])
+
+	for i, key := range keys {
+		entry, ok := c.verdicts[key]
+		if !ok {
+			continue
+		}
+		sent, received := orig, reply
+		if (i == 0) == entry.conn.Inbound {
+			sent, received = reply, orig
+		}
+		meter.Add(now, trafficKeys(entry.conn), accounting.Traffic{
+			BytesIn:    received.Bytes,
+			BytesOut:   sent.Bytes,
+			PacketsIn:  received.Packets,
+			PacketsOut: sent.Packets,
+		})
+		return
+	}
+}
+
+// since returns the traffic counted by cur after prev. Counters lower than
+// before belong to a new connection with the same tuple.
+func since(cur, prev conntrack.Counters) conntrack.Counters {
+	if cur.Bytes < prev.Bytes || cur.Packets < prev.Packets {
+		return cur
+	}
+	return conntrack.Counters{Bytes: cur.Bytes - prev.Bytes, Packets: cur.Packets - prev.Packets}
+}
+
+// trafficKeys returns the groups the traffic of conn is counted in
+func trafficKeys(conn *rules.Conn) accounting.Keys {
+	keys := accounting.Keys{
+		Process:     processKey(conn),
+		Destination: destinationKey(conn),
+		Country:     conn.Country,
+	}
+	if conn.ASN != 0 {
+		keys.ASN = fmt.Sprintf("AS%d", conn.ASN)
+	}
+	return keys
+}
+
+// processKey names the executable of conn, by path when it is known
+func processKey(conn *rules.Conn) string {
+	if conn.ProcessPath != "" {
+		return conn.ProcessPath
+	}
+	return conn.ProcessName
+}
+
+// destinationKey names the remote end of conn, by domain when it is known
+func destinationKey(conn *rules.Conn) string {
+	if conn.Domain != "" {
+		return conn.Domain
+	}
+	if remote, _ := conn.Remote(); remote != nil {
+		return remote.String()
+	}
+	return ""
+}
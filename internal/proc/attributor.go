@@ -0,0 +1,141 @@
+package proc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Tuple identifies a connection from its local end
+type Tuple struct {
+	Protocol   uint8
+	LocalIP    net.IP
+	LocalPort  uint16
+	RemoteIP   net.IP
+	RemotePort uint16
+}
+
+// ConnectionDetails contains information about a network connection
+type ConnectionDetails struct {
+	PID         int
+	ProcessName string
+	UID         int      // owner of the socket, -1 when unknown
+	Source      string   // name of the backend that found the process
+	Process     *Process // nil when /proc has no entry for PID
+}
+
+// Attributor finds the process owning the local end of a connection
+type Attributor interface {
+	// Name identifies the backend in logs and metrics
+	Name() string
+	Attribute(t Tuple) (*ConnectionDetails, error)
+}
+
+// BackendStats counts the lookups of one backend in a chain
+type BackendStats struct {
+	Name   string
+	Hits   uint64
+	Misses uint64
+}
+
+type backend struct {
+	Attributor
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// Chain asks its backends in order and returns the first answer
+type Chain struct {
+	backends []*backend
+}
+
+// NewChain creates a chain asking the backends in the given order
+func NewChain(backends ...Attributor) *Chain {
+	c := &Chain{}
+	for _, a := range backends {
+		c.backends = append(c.backends, &backend{Attributor: a})
+	}
+	return c
+}
+
+// NewAttributor probes the backends the system supports and chains them from
+// the most to the least precise: eBPF, sock_diag, then procfs. The returned
+// error lists the backends that are unavailable; the chain is usable anyway.
+func NewAttributor() (*Chain, error) {
+	var errs error
+	var backends []Attributor
+
+	if a, err := NewEBPFAttributor(); err != nil {
+		errs = multierror.Append(errs, err)
+	} else {
+		backends = append(backends, a)
+	}
+	if a, err := NewSockDiagAttributor(); err != nil {
+		errs = multierror.Append(errs, err)
+	} else {
+		backends = append(backends, a)
+	}
+	backends = append(backends, NewProcfsAttributor())
+
+	return NewChain(backends...), errs
+}
+
+// Name lists the backends of the chain
+func (c *Chain) Name() string {
+	names := make([]string, 0, len(c.backends))
+	for _, b := range c.backends {
+		names = append(names, b.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Attribute returns the answer of the first backend that finds the process
+func (c *Chain) Attribute(t Tuple) (*ConnectionDetails, error) {
+	var errs error
+	for _, b := range c.backends {
+		details, err := b.Attribute(t)
+		if err != nil {
+			b.misses.Add(1)
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		b.hits.Add(1)
+		details.Source = b.Name()
+		details.Process, _ = GetProcess(details.PID)
+		return details, nil
+	}
+	if errs == nil {
+		errs = errors.New("no attribution backend configured")
+	}
+	return nil, errs
+}
+
+// Stats returns the hit and miss counters of each backend in chain order
+func (c *Chain) Stats() []BackendStats {
+	stats := make([]BackendStats, 0, len(c.backends))
+	for _, b := range c.backends {
+		stats = append(stats, BackendStats{
+			Name:   b.Name(),
+			Hits:   b.hits.Load(),
+			Misses: b.misses.Load(),
+		})
+	}
+	return stats
+}
+
+// Close releases the backends that hold kernel resources
+func (c *Chain) Close() error {
+	var errs error
+	for _, b := range c.backends {
+		if closer, ok := b.Attributor.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	return errs
+}
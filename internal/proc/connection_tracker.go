@@ -2,40 +2,51 @@ package proc
 
 import (
 	"fmt"
-	"net"
 
 	"github.com/lonelysadness/netmonitor/pkg/ebpf"
 )
 
-type ConnectionIdentifier struct {
+// ebpfAttributor asks the kernel probes that recorded the connection
+type ebpfAttributor struct {
 	tracker *ebpf.ConnectionTracker
 }
 
-func NewConnectionIdentifier() (*ConnectionIdentifier, error) {
+// NewEBPFAttributor loads the eBPF connection tracker. It fails when the
+// kernel or the privileges of the process do not allow it.
+func NewEBPFAttributor() (Attributor, error) {
 	tracker, err := ebpf.NewConnectionTracker()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create connection tracker: %w", err)
 	}
 
-	return &ConnectionIdentifier{
+	return &ebpfAttributor{
 		tracker: tracker,
 	}, nil
 }
 
-func (ci *ConnectionIdentifier) Close() error {
-	return ci.tracker.Close()
+func (a *ebpfAttributor) Name() string {
+	return "ebpf"
 }
 
-func (ci *ConnectionIdentifier) IdentifyConnection(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, protocol uint8) (*ConnectionDetails, error) {
-	// For this example, we'll just look up by PID
-	// In a full implementation, you'd want to match by IP/port as well
-	info, err := ci.tracker.GetConnectionInfo(uint32(srcPort)) // Using srcPort as PID for demo
+func (a *ebpfAttributor) Close() error {
+	return a.tracker.Close()
+}
+
+func (a *ebpfAttributor) Attribute(t Tuple) (*ConnectionDetails, error) {
+	info, err := a.tracker.Lookup(ebpf.Tuple{
+		Protocol:   t.Protocol,
+		LocalIP:    t.LocalIP,
+		LocalPort:  t.LocalPort,
+		RemoteIP:   t.RemoteIP,
+		RemotePort: t.RemotePort,
+	})
 	if err != nil {
-		return &ConnectionDetails{}, err
+		return nil, err
 	}
 
 	return &ConnectionDetails{
 		PID:         int(info.PID),
-		ProcessName: string(info.Comm[:]),
+		ProcessName: info.Name(),
+		UID:         int(info.UID),
 	}, nil
 }
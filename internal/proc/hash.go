@@ -0,0 +1,95 @@
+package proc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// hashTTL is how long a hash is kept after it was last asked for
+const hashTTL = time.Hour
+
+// fileID identifies one version of a file. A replaced or rewritten binary
+// gets a new inode or modification time and is hashed again.
+type fileID struct {
+	dev   uint64
+	ino   uint64
+	mtime int64
+	size  int64
+}
+
+type cachedHash struct {
+	sum  string
+	used time.Time
+}
+
+var hashes = struct {
+	sync.Mutex
+	byFile map[fileID]*cachedHash
+}{
+	byFile: make(map[fileID]*cachedHash),
+}
+
+// ExecutableHash returns the hex SHA-256 of the executable running as pid.
+// The binary is read through /proc/<pid>/exe, which is the file the process
+// was started from even if the path now points to another one.
+func ExecutableHash(pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unexpected stat type for pid %d", pid)
+	}
+	id := fileID{
+		dev:   uint64(stat.Dev),
+		ino:   stat.Ino,
+		mtime: info.ModTime().UnixNano(),
+		size:  info.Size(),
+	}
+
+	hashes.Lock()
+	cached, ok := hashes.byFile[id]
+	if ok {
+		cached.used = time.Now()
+	}
+	hashes.Unlock()
+	if ok {
+		return cached.sum, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash executable of pid %d: %w", pid, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	hashes.Lock()
+	hashes.byFile[id] = &cachedHash{sum: sum, used: time.Now()}
+	hashes.Unlock()
+	return sum, nil
+}
+
+// forgetUnusedHashes drops the hashes not asked for within hashTTL before
+// now, such as those of binaries that were replaced
+func forgetUnusedHashes(now time.Time) {
+	hashes.Lock()
+	defer hashes.Unlock()
+	for id, cached := range hashes.byFile {
+		if now.Sub(cached.used) > hashTTL {
+			delete(hashes.byFile, id)
+		}
+	}
+}
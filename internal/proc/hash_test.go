@@ -0,0 +1,43 @@
+package proc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExecutableHash(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(b)
+	want := hex.EncodeToString(sum[:])
+
+	got, err := ExecutableHash(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("ExecutableHash() = %s, want %s", got, want)
+	}
+	if n := len(hashes.byFile); n != 1 {
+		t.Fatalf("%d hashes cached, want 1", n)
+	}
+
+	// Hashes in use are kept, unused ones dropped
+	forgetUnusedHashes(time.Now().Add(hashTTL / 2))
+	if n := len(hashes.byFile); n != 1 {
+		t.Errorf("%d hashes cached after half the TTL, want 1", n)
+	}
+	forgetUnusedHashes(time.Now().Add(2 * hashTTL))
+	if n := len(hashes.byFile); n != 0 {
+		t.Errorf("%d hashes cached after the TTL, want none", n)
+	}
+}
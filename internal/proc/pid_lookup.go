@@ -2,7 +2,6 @@ package proc
 
 import (
 	"fmt"
-	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -138,7 +137,7 @@ func findPidByInode(inode string) (int, string, error) {
 				continue
 			}
 
-			if strings.Contains(link, inode) {
+			if link == "socket:["+inode+"]" {
 				commPath := fmt.Sprintf("/proc/%s/comm", pid)
 				comm, err := os.ReadFile(commPath)
 				if err != nil {
@@ -196,33 +195,42 @@ func (pc *ProcessCache) get(inode string) (*ProcessInfo, bool) {
 	return info, exists
 }
 
-// ConnectionIdentifier provides methods to identify process information for network connections
-type ConnectionIdentifier struct{}
+// procfsAttributor scans /proc/net and the file descriptors of every process.
+// It needs nothing but procfs and is the last resort of the chain.
+type procfsAttributor struct{}
 
-// ConnectionDetails contains information about a network connection
-type ConnectionDetails struct {
-	PID         int
-	ProcessName string
+// NewProcfsAttributor creates the /proc based backend
+func NewProcfsAttributor() Attributor {
+	return procfsAttributor{}
 }
 
-// NewConnectionIdentifier creates a new ConnectionIdentifier
-func NewConnectionIdentifier() (*ConnectionIdentifier, error) {
-	return &ConnectionIdentifier{}, nil
+func (procfsAttributor) Name() string {
+	return "procfs"
 }
 
-// IdentifyConnection looks up the process information for a given connection
-func (ci *ConnectionIdentifier) IdentifyConnection(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, protocol uint8) (*ConnectionDetails, error) {
-	// Convert protocol number to int
-	protocolInt := int(protocol)
-
-	// Use the existing ParseProcNetFile function
-	pid, processName, err := ParseProcNetFile(srcIP.String(), srcPort, protocolInt)
+func (procfsAttributor) Attribute(t Tuple) (*ConnectionDetails, error) {
+	pid, name, err := ParseProcNetFile(t.LocalIP.String(), t.LocalPort, int(t.Protocol))
 	if err != nil {
-		return &ConnectionDetails{}, err
+		return nil, err
 	}
 
 	return &ConnectionDetails{
 		PID:         pid,
-		ProcessName: processName,
+		ProcessName: name,
+		UID:         -1,
 	}, nil
 }
+
+// processName returns the command name of pid
+func processName(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// ExecutablePath returns the path of the executable running as pid
+func ExecutablePath(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+}
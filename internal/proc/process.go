@@ -0,0 +1,282 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userHZ is the unit of the times in /proc/<pid>/stat, fixed by the kernel ABI
+const userHZ = 100
+
+// maxAncestors bounds the parent walk in case /proc changes under it
+const maxAncestors = 64
+
+// Process identifies a running program
+type Process struct {
+	PID       int
+	PPID      int
+	Name      string // comm, truncated to 15 characters by the kernel
+	Path      string // executable
+	Cmdline   []string
+	UID       int // real UID
+	GID       int // real GID
+	User      string
+	Started   time.Time
+	Cgroup    string
+	Unit      string // systemd unit or scope, if any
+	Container string // container ID, if any
+	Ancestors []Ancestor
+
+	startTicks uint64
+}
+
+// Ancestor is one process in the parent chain, nearest first
+type Ancestor struct {
+	PID  int
+	Name string
+	Path string
+}
+
+// processes caches processes by PID. An entry is only reused while the
+// start time, comm and executable still match, so a recycled PID or a
+// process that called execve is loaded again.
+var processes = struct {
+	sync.Mutex
+	byPID map[int]*Process
+	users map[int]string
+}{
+	byPID: make(map[int]*Process),
+	users: make(map[int]string),
+}
+
+var (
+	bootTimeOnce sync.Once
+	bootTime     time.Time
+)
+
+// containerID finds the 64 hex digit IDs used by docker, podman and
+// containerd in cgroup paths
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// GetProcess returns the identity of pid including its ancestors
+func GetProcess(pid int) (*Process, error) {
+	p, err := loadProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The chain is walked every time since processes get reparented when
+	// their parent exits
+	cp := *p
+	cp.Ancestors = []Ancestor{}
+	for ppid := p.PPID; ppid > 0 && len(cp.Ancestors) < maxAncestors; {
+		parent, err := loadProcess(ppid)
+		if err != nil {
+			break
+		}
+		cp.Ancestors = append(cp.Ancestors, Ancestor{PID: parent.PID, Name: parent.Name, Path: parent.Path})
+		ppid = parent.PPID
+	}
+	return &cp, nil
+}
+
+// loadProcess returns the cached process or reads it from /proc
+func loadProcess(pid int) (*Process, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	name, ppid, startTicks, err := parseStat(stat)
+	if err != nil {
+		return nil, fmt.Errorf("pid %d: %w", pid, err)
+	}
+
+	// execve keeps the PID and the start time but changes the executable
+	// and, unless the new one has the same base name, comm
+	path, _ := ExecutablePath(pid)
+
+	processes.Lock()
+	if p, ok := processes.byPID[pid]; ok && p.startTicks == startTicks && p.Name == name && p.Path == path {
+		processes.Unlock()
+		return p, nil
+	}
+	processes.Unlock()
+
+	p := &Process{
+		PID:        pid,
+		PPID:       ppid,
+		Name:       name,
+		UID:        -1,
+		GID:        -1,
+		Path:       path,
+		Started:    bootTimeOf().Add(time.Duration(startTicks) * time.Second / userHZ),
+		startTicks: startTicks,
+	}
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		p.Cmdline = strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	}
+	p.UID, p.GID = readIDs(pid)
+	if p.UID >= 0 {
+		p.User = username(p.UID)
+	}
+	p.Cgroup = readCgroup(pid)
+	p.Unit, p.Container = parseCgroup(p.Cgroup)
+
+	processes.Lock()
+	processes.byPID[pid] = p
+	processes.Unlock()
+	return p, nil
+}
+
+// parseStat extracts comm, the parent PID and the start time from
+// /proc/<pid>/stat. comm may contain spaces and parentheses, so the fields
+// are counted from its closing parenthesis.
+func parseStat(stat []byte) (string, int, uint64, error) {
+	open := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return "", 0, 0, fmt.Errorf("malformed stat")
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return "", 0, 0, fmt.Errorf("malformed stat")
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, 0, err
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return string(stat[open+1 : end]), ppid, start, nil
+}
+
+// readIDs returns the real UID and GID from /proc/<pid>/status
+func readIDs(pid int) (int, int) {
+	uid, gid := -1, -1
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return uid, gid
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Uid:":
+			uid, _ = strconv.Atoi(fields[1])
+		case "Gid:":
+			gid, _ = strconv.Atoi(fields[1])
+			return uid, gid
+		}
+	}
+	return uid, gid
+}
+
+// readCgroup returns the unified cgroup path, or the systemd hierarchy on
+// cgroup v1 systems
+func readCgroup(pid int) string {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+
+	var fallback string
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			return parts[2]
+		case parts[1] == "name=systemd":
+			fallback = parts[2]
+		case fallback == "":
+			fallback = parts[2]
+		}
+	}
+	return fallback
+}
+
+// parseCgroup finds the innermost systemd unit and a container ID in a cgroup
+// path
+func parseCgroup(cgroup string) (string, string) {
+	var unit string
+	for _, elem := range strings.Split(cgroup, "/") {
+		if strings.HasSuffix(elem, ".service") || strings.HasSuffix(elem, ".scope") {
+			unit = elem
+		}
+	}
+	container := containerID.FindString(cgroup)
+	if container != "" && strings.Contains(unit, container) {
+		// docker-<id>.scope names the container, not a real unit
+		unit = ""
+	}
+	return unit, container
+}
+
+// username resolves uid, remembering the answer
+func username(uid int) string {
+	processes.Lock()
+	name, ok := processes.users[uid]
+	processes.Unlock()
+	if ok {
+		return name
+	}
+
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	processes.Lock()
+	processes.users[uid] = name
+	processes.Unlock()
+	return name
+}
+
+// bootTimeOf returns the boot time from /proc/stat
+func bootTimeOf() time.Time {
+	bootTimeOnce.Do(func() {
+		content, err := os.ReadFile("/proc/stat")
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if rest, ok := strings.CutPrefix(line, "btime "); ok {
+				if sec, err := strconv.ParseInt(strings.TrimSpace(rest), 10, 64); err == nil {
+					bootTime = time.Unix(sec, 0)
+				}
+				return
+			}
+		}
+	})
+	return bootTime
+}
+
+// ForgetExited drops cached processes and socket owners that are no longer
+// running, and the hashes of executables no longer asked for
+func ForgetExited() {
+	sockets.forgetExited()
+	forgetUnusedHashes(time.Now())
+
+	processes.Lock()
+	defer processes.Unlock()
+	for pid := range processes.byPID {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+			delete(processes.byPID, pid)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package proc
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		stat  string
+		name  string
+		ppid  int
+		start uint64
+	}{
+		{"1234 (curl) S 1 1234 1234 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 98765 1000 100",
+			"curl", 1, 98765},
+		{"42 (a (b) c) R 7 42 42 0 -1 0 0 0 0 0 0 0 0 0 20 0 1 0 5 0 0",
+			"a (b) c", 7, 5},
+		{"9 () S 2 0 0 0 -1 0 0 0 0 0 0 0 0 0 20 0 1 0 11 0 0",
+			"", 2, 11},
+	}
+	for _, tt := range tests {
+		name, ppid, start, err := parseStat([]byte(tt.stat))
+		if err != nil {
+			t.Errorf("parseStat(%q): %v", tt.stat, err)
+			continue
+		}
+		if name != tt.name || ppid != tt.ppid || start != tt.start {
+			t.Errorf("parseStat(%q) = %q, %d, %d, want %q, %d, %d", tt.stat, name, ppid, start, tt.name, tt.ppid, tt.start)
+		}
+	}
+
+	for _, stat := range []string{
+		"",
+		"1234 curl S 1",
+		"1234 (curl) S 1 2 3",
+		"1234 (curl) S x 1234 1234 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 98765 1000 100",
+		"1234 (curl) S 1 1234 1234 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 -5 1000 100",
+	} {
+		if _, _, _, err := parseStat([]byte(stat)); err == nil {
+			t.Errorf("parseStat(%q) accepted", stat)
+		}
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		cgroup    string
+		unit      string
+		container string
+	}{
+		{"/system.slice/nginx.service", "nginx.service", ""},
+		{"/user.slice/user-1000.slice/user@1000.service/app.slice/app-firefox-1234.scope", "app-firefox-1234.scope", ""},
+		{"/system.slice/docker-" + id + ".scope", "", id},
+		{"/kubepods/besteffort/pod1/" + id, "", id},
+		{"/system.slice/containerd.service/kubepods-pod1.slice:cri-containerd:" + id, "containerd.service", id},
+		{"/", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		unit, container := parseCgroup(tt.cgroup)
+		if unit != tt.unit || container != tt.container {
+			t.Errorf("parseCgroup(%q) = %q, %q, want %q, %q", tt.cgroup, unit, container, tt.unit, tt.container)
+		}
+	}
+}
+
+func TestGetProcessSelf(t *testing.T) {
+	p, err := GetProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, _ := os.Executable()
+	if p.Path != exe || p.UID != os.Getuid() || p.PPID != os.Getppid() {
+		t.Errorf("got path %q uid %d ppid %d", p.Path, p.UID, p.PPID)
+	}
+	if len(p.Ancestors) == 0 || p.Ancestors[0].PID != os.Getppid() {
+		t.Errorf("ancestors = %+v", p.Ancestors)
+	}
+}
+
+// TestLoadProcessAfterExec checks that a process is loaded again once it
+// runs another executable under the same PID
+func TestLoadProcessAfterExec(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command("sh", "-c", "read line; exec "+sleep+" 10")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	pid := cmd.Process.Pid
+	before, err := loadProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin.Write([]byte("\n"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		after, err := loadProcess(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Name == "sleep" {
+			if after.Path == before.Path || after.startTicks != before.startTicks {
+				t.Errorf("path %q -> %q, start %d -> %d", before.Path, after.Path, before.startTicks, after.startTicks)
+			}
+			if len(after.Cmdline) != 2 || after.Cmdline[1] != "10" {
+				t.Errorf("cmdline = %q", after.Cmdline)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("cached process kept after exec")
+}
@@ -0,0 +1,382 @@
+package proc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// SocketInfo is the kernel's view of a socket found through sock_diag
+type SocketInfo struct {
+	UID   uint32
+	Inode uint32
+}
+
+var errSocketNotFound = errors.New("socket not found")
+
+const (
+	inetDiagReqLen = 56
+	inetDiagMsgLen = 72
+	// inetDiagNoCookie tells the kernel not to check the socket cookie
+	inetDiagNoCookie = ^uint32(0)
+	allTCPStates     = ^uint32(0)
+)
+
+// sockDiag queries sockets by their 5-tuple over NETLINK_SOCK_DIAG
+type sockDiag struct {
+	sync.Mutex
+	conn *netlink.Conn
+}
+
+var diag = &sockDiag{}
+
+// LookupSocket returns the owner UID and inode of the local socket that
+// talks from local:localPort to remote:remotePort
+func LookupSocket(protocol uint8, local net.IP, localPort uint16, remote net.IP, remotePort uint16) (*SocketInfo, error) {
+	return diag.lookup(protocol, local, localPort, remote, remotePort)
+}
+
+func (d *sockDiag) lookup(protocol uint8, local net.IP, localPort uint16, remote net.IP, remotePort uint16) (*SocketInfo, error) {
+	if protocol != unix.IPPROTO_TCP && protocol != unix.IPPROTO_UDP {
+		return nil, fmt.Errorf("unsupported protocol: %d", protocol)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.conn == nil {
+		conn, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sock_diag socket: %w", err)
+		}
+		d.conn = conn
+	}
+
+	family := uint8(unix.AF_INET6)
+	if local.To4() != nil {
+		family = unix.AF_INET
+	}
+
+	// The exact lookup finds TCP sockets and UDP sockets, connected or
+	// not, the way the kernel routes packets to them. A dump of the family
+	// is the fallback for the sockets it misses, such as UDP sockets bound
+	// to a device.
+	info, err := d.exact(family, protocol, local, localPort, remote, remotePort)
+	if err == nil || !errors.Is(err, errSocketNotFound) {
+		return info, err
+	}
+	return d.dump(family, protocol, local, localPort, remote, remotePort)
+}
+
+func (d *sockDiag) exact(family, protocol uint8, local net.IP, localPort uint16, remote net.IP, remotePort uint16) (*SocketInfo, error) {
+	return d.execute(exactRequest(family, protocol, local, localPort, remote, remotePort))
+}
+
+// exactRequest builds the request for the socket at local:localPort talking
+// to remote:remotePort. The kernel looks UDP sockets up with the source and
+// destination of the request swapped, as the sender and the receiver of a
+// packet, so they are given that way.
+func exactRequest(family, protocol uint8, local net.IP, localPort uint16, remote net.IP, remotePort uint16) []byte {
+	if protocol == unix.IPPROTO_UDP {
+		return diagRequest(family, protocol, remote, remotePort, local, localPort)
+	}
+	return diagRequest(family, protocol, local, localPort, remote, remotePort)
+}
+
+func (d *sockDiag) execute(req []byte) (*SocketInfo, error) {
+	msgs, err := d.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.SOCK_DIAG_BY_FAMILY,
+			Flags: netlink.Request,
+		},
+		Data: req,
+	})
+	if err != nil {
+		if netlink.IsNotExist(err) {
+			return nil, errSocketNotFound
+		}
+		d.reset()
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		if info, ok := parseDiagMsg(msg.Data); ok {
+			return &info.SocketInfo, nil
+		}
+	}
+	return nil, errSocketNotFound
+}
+
+func (d *sockDiag) dump(family, protocol uint8, local net.IP, localPort uint16, remote net.IP, remotePort uint16) (*SocketInfo, error) {
+	msgs, err := d.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.SOCK_DIAG_BY_FAMILY,
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: diagRequest(family, protocol, nil, 0, nil, 0),
+	})
+	if err != nil {
+		d.reset()
+		return nil, err
+	}
+
+	// Prefer a socket connected to the remote end over a wildcard match
+	var wildcard *SocketInfo
+	for _, msg := range msgs {
+		info, ok := parseDiagMsg(msg.Data)
+		if !ok || info.localPort != localPort {
+			continue
+		}
+		if !info.local.IsUnspecified() && !info.local.Equal(local) {
+			continue
+		}
+		if info.remotePort == remotePort && info.remote.Equal(remote) {
+			return &info.SocketInfo, nil
+		}
+		if info.remotePort == 0 && info.remote.IsUnspecified() && wildcard == nil {
+			wildcard = &info.SocketInfo
+		}
+	}
+	if wildcard != nil {
+		return wildcard, nil
+	}
+	return nil, errSocketNotFound
+}
+
+// probe checks that the kernel answers sock_diag requests
+func (d *sockDiag) probe() error {
+	_, err := d.lookup(unix.IPPROTO_UDP, net.IPv4zero, 0, net.IPv4zero, 0)
+	if errors.Is(err, errSocketNotFound) {
+		return nil
+	}
+	return err
+}
+
+// reset drops the netlink socket after an error so the next lookup starts
+// with a fresh one
+func (d *sockDiag) reset() {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+// diagRequest builds a struct inet_diag_req_v2
+func diagRequest(family, protocol uint8, local net.IP, localPort uint16, remote net.IP, remotePort uint16) []byte {
+	b := make([]byte, inetDiagReqLen)
+	b[0] = family
+	b[1] = protocol
+	binary.NativeEndian.PutUint32(b[4:8], allTCPStates)
+
+	// struct inet_diag_sockid, ports and addresses in network byte order
+	binary.BigEndian.PutUint16(b[8:10], localPort)
+	binary.BigEndian.PutUint16(b[10:12], remotePort)
+	putDiagAddr(b[12:28], local)
+	putDiagAddr(b[28:44], remote)
+	binary.NativeEndian.PutUint32(b[48:52], inetDiagNoCookie)
+	binary.NativeEndian.PutUint32(b[52:56], inetDiagNoCookie)
+	return b
+}
+
+func putDiagAddr(b []byte, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(b, ip4)
+		return
+	}
+	copy(b, ip.To16())
+}
+
+type diagSocket struct {
+	SocketInfo
+	local      net.IP
+	localPort  uint16
+	remote     net.IP
+	remotePort uint16
+}
+
+// parseDiagMsg decodes a struct inet_diag_msg
+func parseDiagMsg(b []byte) (diagSocket, bool) {
+	var s diagSocket
+	if len(b) < inetDiagMsgLen {
+		return s, false
+	}
+
+	addrLen := net.IPv6len
+	if b[0] == unix.AF_INET {
+		addrLen = net.IPv4len
+	}
+	s.localPort = binary.BigEndian.Uint16(b[4:6])
+	s.remotePort = binary.BigEndian.Uint16(b[6:8])
+	s.local = net.IP(append([]byte(nil), b[8:8+addrLen]...))
+	s.remote = net.IP(append([]byte(nil), b[24:24+addrLen]...))
+	s.UID = binary.NativeEndian.Uint32(b[64:68])
+	s.Inode = binary.NativeEndian.Uint32(b[68:72])
+	return s, true
+}
+
+// sockDiagAttributor looks the socket up through sock_diag and its owner in
+// the inode index
+type sockDiagAttributor struct{}
+
+// NewSockDiagAttributor creates the sock_diag backend if the kernel supports
+// it
+func NewSockDiagAttributor() (Attributor, error) {
+	if err := diag.probe(); err != nil {
+		return nil, fmt.Errorf("sock_diag unavailable: %w", err)
+	}
+	return sockDiagAttributor{}, nil
+}
+
+func (sockDiagAttributor) Name() string {
+	return "sock_diag"
+}
+
+func (sockDiagAttributor) Attribute(t Tuple) (*ConnectionDetails, error) {
+	info, err := LookupSocket(t.Protocol, t.LocalIP, t.LocalPort, t.RemoteIP, t.RemotePort)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := PIDForInode(info.Inode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConnectionDetails{
+		PID:         pid,
+		ProcessName: processName(pid),
+		UID:         int(info.UID),
+	}, nil
+}
+
+// inodeIndex maps socket inodes to the PIDs holding them. A lookup that
+// misses rescans the processes known to hold sockets before the rest of
+// /proc. Every scan of a process replaces the inodes recorded for it, so
+// closed sockets leave the index, and exited processes are dropped by
+// ForgetExited.
+type inodeIndex struct {
+	sync.Mutex
+	owners map[uint32]int
+	known  map[int][]uint32 // the socket inodes of each process, as last scanned
+}
+
+var sockets = &inodeIndex{
+	owners: make(map[uint32]int),
+	known:  make(map[int][]uint32),
+}
+
+// PIDForInode returns the PID of a process holding the socket inode
+func PIDForInode(inode uint32) (int, error) {
+	return sockets.lookup(inode)
+}
+
+func (x *inodeIndex) lookup(inode uint32) (int, error) {
+	x.Lock()
+	defer x.Unlock()
+
+	if pid, ok := x.owners[inode]; ok {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+			return pid, nil
+		}
+		x.forget(pid)
+	}
+
+	// scan replaces the entries of x.known, so range over a copy
+	known := make([]int, 0, len(x.known))
+	for pid := range x.known {
+		known = append(known, pid)
+	}
+	for _, pid := range known {
+		if x.scan(pid, inode) {
+			return pid, nil
+		}
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if _, ok := x.known[pid]; ok {
+			continue
+		}
+		if x.scan(pid, inode) {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no PID found for inode: %d", inode)
+}
+
+// scan records the socket inodes held by pid in place of the ones recorded
+// before and reports whether inode is one of them
+func (x *inodeIndex) scan(pid int, inode uint32) bool {
+	x.forget(pid)
+	fdPath := fmt.Sprintf("/proc/%d/fd", pid)
+	fdEntries, err := os.ReadDir(fdPath)
+	if err != nil {
+		return false
+	}
+
+	var held []uint32
+	for _, fdEntry := range fdEntries {
+		link, err := os.Readlink(fdPath + "/" + fdEntry.Name())
+		if err != nil {
+			continue
+		}
+		if n, ok := socketInode(link); ok {
+			held = append(held, n)
+			x.owners[n] = pid
+		}
+	}
+	if len(held) > 0 {
+		x.known[pid] = held
+	}
+	return slices.Contains(held, inode)
+}
+
+// socketInode parses the target of a file descriptor link to a socket,
+// socket:[<inode>]
+func socketInode(link string) (uint32, bool) {
+	s, ok := strings.CutPrefix(link, "socket:[")
+	if !ok {
+		return 0, false
+	}
+	s, ok = strings.CutSuffix(s, "]")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err == nil
+}
+
+// forget drops the inodes recorded for pid
+func (x *inodeIndex) forget(pid int) {
+	for _, inode := range x.known[pid] {
+		if x.owners[inode] == pid {
+			delete(x.owners, inode)
+		}
+	}
+	delete(x.known, pid)
+}
+
+// forgetExited drops the processes that are no longer running
+func (x *inodeIndex) forgetExited() {
+	x.Lock()
+	defer x.Unlock()
+	for pid := range x.known {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+			x.forget(pid)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package proc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// native appends v in host byte order, as the kernel expects the states,
+// cookies, UID and inode
+func native(b []byte, v uint32) []byte {
+	return binary.NativeEndian.AppendUint32(b, v)
+}
+
+func TestDiagRequest(t *testing.T) {
+	got := diagRequest(unix.AF_INET, unix.IPPROTO_TCP,
+		net.ParseIP("192.168.1.2"), 40000, net.ParseIP("1.2.3.4"), 443)
+
+	want := []byte{unix.AF_INET, unix.IPPROTO_TCP, 0, 0}
+	want = native(want, allTCPStates)
+	want = append(want, 0x9c, 0x40, 0x01, 0xbb) // ports 40000, 443
+	want = append(want, 192, 168, 1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	want = append(want, 1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	want = append(want, 0, 0, 0, 0) // interface
+	want = native(want, inetDiagNoCookie)
+	want = native(want, inetDiagNoCookie)
+	if !bytes.Equal(got, want) {
+		t.Errorf("request\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestDiagRequestIPv6(t *testing.T) {
+	got := diagRequest(unix.AF_INET6, unix.IPPROTO_UDP, net.ParseIP("fe80::1"), 53, net.ParseIP("2001:db8::2"), 5353)
+	if got[0] != unix.AF_INET6 || got[1] != unix.IPPROTO_UDP {
+		t.Errorf("family and protocol = %d, %d", got[0], got[1])
+	}
+	if !net.IP(got[12:28]).Equal(net.ParseIP("fe80::1")) || !net.IP(got[28:44]).Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("addresses = %x, %x", got[12:28], got[28:44])
+	}
+}
+
+func TestExactRequestSwapsUDP(t *testing.T) {
+	local, remote := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	tcp := exactRequest(unix.AF_INET, unix.IPPROTO_TCP, local, 1000, remote, 2000)
+	udp := exactRequest(unix.AF_INET, unix.IPPROTO_UDP, local, 1000, remote, 2000)
+	if binary.BigEndian.Uint16(tcp[8:10]) != 1000 || !net.IP(tcp[12:16]).Equal(local) {
+		t.Errorf("TCP request source = %x", tcp[8:28])
+	}
+	if binary.BigEndian.Uint16(udp[8:10]) != 2000 || !net.IP(udp[12:16]).Equal(remote) ||
+		binary.BigEndian.Uint16(udp[10:12]) != 1000 || !net.IP(udp[28:32]).Equal(local) {
+		t.Errorf("UDP request = %x", udp[8:44])
+	}
+}
+
+func TestParseDiagMsg(t *testing.T) {
+	msg := []byte{unix.AF_INET, 1, 0, 0} // family, state, timer, retrans
+	msg = append(msg, 0x9c, 0x40, 0x01, 0xbb)
+	msg = append(msg, 192, 168, 1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	msg = append(msg, 1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	msg = append(msg, 0, 0, 0, 0)             // interface
+	msg = append(msg, 1, 2, 3, 4, 5, 6, 7, 8) // cookie
+	msg = append(msg, make([]byte, 12)...)    // expires, rqueue, wqueue
+	msg = native(msg, 1000)
+	msg = native(msg, 123456)
+
+	s, ok := parseDiagMsg(msg)
+	if !ok {
+		t.Fatal("message rejected")
+	}
+	if s.localPort != 40000 || s.remotePort != 443 ||
+		!s.local.Equal(net.ParseIP("192.168.1.2")) || !s.remote.Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("socket %s:%d -> %s:%d", s.local, s.localPort, s.remote, s.remotePort)
+	}
+	if s.UID != 1000 || s.Inode != 123456 {
+		t.Errorf("uid %d inode %d, want 1000 123456", s.UID, s.Inode)
+	}
+
+	if _, ok := parseDiagMsg(msg[:inetDiagMsgLen-1]); ok {
+		t.Error("short message accepted")
+	}
+}
+
+func TestSocketInode(t *testing.T) {
+	tests := []struct {
+		link  string
+		inode uint32
+		ok    bool
+	}{
+		{"socket:[12345]", 12345, true},
+		{"socket:[1234]", 1234, true},
+		{"pipe:[12345]", 0, false},
+		{"socket:[12345", 0, false},
+		{"socket:[x]", 0, false},
+		{"/dev/null", 0, false},
+	}
+	for _, tt := range tests {
+		inode, ok := socketInode(tt.link)
+		if ok != tt.ok || inode != tt.inode {
+			t.Errorf("socketInode(%q) = %d, %v, want %d, %v", tt.link, inode, ok, tt.inode, tt.ok)
+		}
+	}
+}
+
+// loopbackPair connects a socket of protocol over loopback and returns the
+// tuple of its local end
+func loopbackPair(tb testing.TB, network string) Tuple {
+	tb.Helper()
+	var local, remote net.Addr
+	switch network {
+	case "tcp":
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { ln.Close() })
+		conn, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { conn.Close() })
+		local, remote = conn.LocalAddr(), conn.RemoteAddr()
+	case "udp":
+		conn, err := net.Dial("udp4", "127.0.0.1:9")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { conn.Close() })
+		local, remote = conn.LocalAddr(), conn.RemoteAddr()
+	}
+	t := Tuple{Protocol: unix.IPPROTO_TCP}
+	if network == "udp" {
+		t.Protocol = unix.IPPROTO_UDP
+	}
+	switch l := local.(type) {
+	case *net.TCPAddr:
+		r := remote.(*net.TCPAddr)
+		t.LocalIP, t.LocalPort, t.RemoteIP, t.RemotePort = l.IP, uint16(l.Port), r.IP, uint16(r.Port)
+	case *net.UDPAddr:
+		r := remote.(*net.UDPAddr)
+		t.LocalIP, t.LocalPort, t.RemoteIP, t.RemotePort = l.IP, uint16(l.Port), r.IP, uint16(r.Port)
+	}
+	return t
+}
+
+func sockDiagOrSkip(tb testing.TB) Attributor {
+	tb.Helper()
+	a, err := NewSockDiagAttributor()
+	if err != nil {
+		tb.Skip(err)
+	}
+	return a
+}
+
+func TestSockDiagAttribute(t *testing.T) {
+	a := sockDiagOrSkip(t)
+	for _, network := range []string{"tcp", "udp"} {
+		details, err := a.Attribute(loopbackPair(t, network))
+		if err != nil {
+			t.Errorf("%s: %v", network, err)
+			continue
+		}
+		if details.PID != os.Getpid() || details.UID != os.Getuid() {
+			t.Errorf("%s: PID %d UID %d, want %d %d", network, details.PID, details.UID, os.Getpid(), os.Getuid())
+		}
+	}
+}
+
+// TestSockDiagExactUDP checks that connected UDP sockets are found without
+// dumping every socket of the family
+func TestSockDiagExactUDP(t *testing.T) {
+	sockDiagOrSkip(t)
+	tuple := loopbackPair(t, "udp")
+	diag.Lock()
+	defer diag.Unlock()
+	if _, err := diag.exact(unix.AF_INET, tuple.Protocol, tuple.LocalIP, tuple.LocalPort, tuple.RemoteIP, tuple.RemotePort); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkAttribute(b *testing.B, a Attributor, network string) {
+	t := loopbackPair(b, network)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Attribute(t); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSockDiagTCP(b *testing.B) { benchmarkAttribute(b, sockDiagOrSkip(b), "tcp") }
+func BenchmarkSockDiagUDP(b *testing.B) { benchmarkAttribute(b, sockDiagOrSkip(b), "udp") }
+func BenchmarkProcfsTCP(b *testing.B)   { benchmarkAttribute(b, NewProcfsAttributor(), "tcp") }
+func BenchmarkProcfsUDP(b *testing.B)   { benchmarkAttribute(b, NewProcfsAttributor(), "udp") }
@@ -0,0 +1,302 @@
+package prompt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/logger"
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"github.com/lonelysadness/netmonitor/pkg/utils"
+)
+
+// Scope defines how far a decision reaches beyond the connection that
+// triggered the prompt
+type Scope int
+
+const (
+	// Once applies the verdict to this connection only
+	Once Scope = iota
+	// Always applies the verdict to this process talking to this destination
+	Always
+	// Process applies the verdict to every connection of this process
+	Process
+	// Destination applies the verdict to every connection to this destination
+	Destination
+)
+
+var scopeNames = map[Scope]string{
+	Once:        "once",
+	Always:      "always",
+	Process:     "process",
+	Destination: "destination",
+}
+
+func (s Scope) String() string {
+	if name, ok := scopeNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseScope converts a scope name into a Scope
+func ParseScope(s string) (Scope, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for scope, n := range scopeNames {
+		if n == name {
+			return scope, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scope %q", s)
+}
+
+// Decision is the answer to a prompt
+type Decision struct {
+	Verdict rules.Verdict
+	Scope   Scope
+	// TimedOut is set when nobody answered and the fallback was used
+	TimedOut bool
+}
+
+// Rule returns the rule that makes the decision on the prompt with the
+// given id stick for conn, or nil for decisions that only cover a single
+// connection. The rule is named after the prompt and what it covers, so
+// the names of learned rules are unique.
+func (d Decision) Rule(id string, conn *rules.Conn) *rules.Rule {
+	if d.TimedOut || d.Scope == Once {
+		return nil
+	}
+
+	remoteIP, remotePort := conn.Remote()
+	process := conn.ProcessPath
+	if process == "" {
+		process = conn.ProcessName
+	}
+
+	var m rules.Match
+	var covers string
+	switch d.Scope {
+	case Always:
+		if process == "" {
+			return nil
+		}
+		m.Processes = []string{process}
+		m.Destinations = []*net.IPNet{hostNetwork(remoteIP)}
+		m.Ports = []rules.PortRange{{From: remotePort, To: remotePort}}
+		m.Protocols = []uint8{conn.Protocol}
+		covers = fmt.Sprintf("%s to %s/%s", process,
+			net.JoinHostPort(remoteIP.String(), strconv.Itoa(int(remotePort))), utils.GetProtocolName(conn.Protocol))
+	case Process:
+		if process == "" {
+			return nil
+		}
+		m.Processes = []string{process}
+		covers = process
+	case Destination:
+		m.Destinations = []*net.IPNet{hostNetwork(remoteIP)}
+		covers = remoteIP.String()
+	}
+
+	// Pin the binary the user answered for, so a replaced executable is
+	// asked about again
+	if len(m.Processes) > 0 && conn.ExeHash != nil {
+		if hash, err := conn.ExeHash(); err == nil {
+			m.SHA256 = []string{hash}
+		}
+	}
+
+	return &rules.Rule{
+		Name:           fmt.Sprintf("prompt %s: %s %s %s", id, d.Verdict, d.Scope, covers),
+		Match:          m,
+		Verdict:        permanent(d.Verdict),
+		OnHashMismatch: rules.HashPrompt,
+	}
+}
+
+// permanent turns a verdict into the variant remembered by conntrack
+func permanent(v rules.Verdict) rules.Verdict {
+	switch v {
+	case rules.Accept:
+		return rules.AcceptAlways
+	case rules.Block:
+		return rules.BlockAlways
+	case rules.Drop:
+		return rules.DropAlways
+	}
+	return v
+}
+
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Request is a connection waiting for a decision
+type Request struct {
+	ID       string
+	Conn     *rules.Conn
+	Created  time.Time
+	Deadline time.Time
+
+	key      string
+	done     chan struct{}
+	decision Decision
+}
+
+var ErrNotPending = errors.New("no pending prompt with this id")
+
+// Manager parks connections until they are answered or time out
+type Manager struct {
+	sync.Mutex
+	pending     map[string]*Request
+	byKey       map[string]*Request
+	subscribers map[chan *Request]struct{}
+	nextID      uint64
+	timeout     time.Duration
+	fallback    rules.Verdict
+	learn       func(*rules.Rule) error
+}
+
+// NewManager creates a Manager that applies fallback to connections left
+// unanswered for timeout. learn receives the rule of every decision that
+// reaches beyond a single connection.
+func NewManager(timeout time.Duration, fallback rules.Verdict, learn func(*rules.Rule) error) *Manager {
+	return &Manager{
+		learn:       learn,
+		pending:     make(map[string]*Request),
+		byKey:       make(map[string]*Request),
+		subscribers: make(map[chan *Request]struct{}),
+		timeout:     timeout,
+		fallback:    fallback,
+	}
+}
+
+// Configure changes the timeout and fallback for future prompts
+func (m *Manager) Configure(timeout time.Duration, fallback rules.Verdict) {
+	m.Lock()
+	defer m.Unlock()
+	m.timeout = timeout
+	m.fallback = fallback
+}
+
+// Ask publishes a prompt for conn and blocks until it is answered or times
+// out. Concurrent calls with the same key share one prompt.
+func (m *Manager) Ask(key string, conn *rules.Conn) Decision {
+	m.Lock()
+	req, exists := m.byKey[key]
+	if !exists {
+		m.nextID++
+		now := time.Now()
+		req = &Request{
+			ID:       strconv.FormatUint(m.nextID, 10),
+			Conn:     conn,
+			Created:  now,
+			Deadline: now.Add(m.timeout),
+			key:      key,
+			done:     make(chan struct{}),
+		}
+		m.pending[req.ID] = req
+		m.byKey[key] = req
+		m.publish(req)
+	}
+	fallback := m.fallback
+	m.Unlock()
+
+	timer := time.NewTimer(time.Until(req.Deadline))
+	defer timer.Stop()
+
+	select {
+	case <-req.done:
+		return req.decision
+	case <-timer.C:
+		m.resolve(req, Decision{Verdict: fallback, Scope: Once, TimedOut: true})
+		<-req.done
+		return req.decision
+	}
+}
+
+// Answer resolves the pending prompt with the given id
+func (m *Manager) Answer(id string, d Decision) error {
+	if d.Verdict == rules.Prompt || d.Verdict.String() == "unknown" {
+		return fmt.Errorf("invalid verdict %s for a prompt", d.Verdict)
+	}
+
+	m.Lock()
+	req, ok := m.pending[id]
+	m.Unlock()
+	if !ok {
+		return ErrNotPending
+	}
+	if !m.resolve(req, d) {
+		return ErrNotPending
+	}
+	return nil
+}
+
+// resolve records the decision unless the request was already resolved
+func (m *Manager) resolve(req *Request, d Decision) bool {
+	m.Lock()
+	if _, ok := m.pending[req.ID]; !ok {
+		m.Unlock()
+		return false
+	}
+	delete(m.pending, req.ID)
+	delete(m.byKey, req.key)
+	m.Unlock()
+
+	// Install the rule before waking up the parked packets so that packets
+	// of other connections covered by it no longer prompt
+	if rule := d.Rule(req.ID, req.Conn); rule != nil && m.learn != nil {
+		if err := m.learn(rule); err != nil {
+			logger.Log.Warn("decision only applies to the prompted connection", "prompt", req.ID, "err", err)
+		}
+	}
+	req.decision = d
+	close(req.done)
+	return true
+}
+
+// Pending returns the prompts waiting for a decision
+func (m *Manager) Pending() []*Request {
+	m.Lock()
+	defer m.Unlock()
+	reqs := make([]*Request, 0, len(m.pending))
+	for _, req := range m.pending {
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+// Subscribe returns a channel receiving every new prompt and a function to
+// stop the subscription. Slow subscribers miss prompts rather than delaying
+// packets; Pending always has the full list.
+func (m *Manager) Subscribe() (<-chan *Request, func()) {
+	ch := make(chan *Request, 16)
+	m.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.Unlock()
+
+	return ch, func() {
+		m.Lock()
+		defer m.Unlock()
+		if _, ok := m.subscribers[ch]; ok {
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (m *Manager) publish(req *Request) {
+	for ch := range m.subscribers {
+		select {
+		case ch <- req:
+		default:
+		}
+	}
+}
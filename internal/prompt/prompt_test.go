@@ -0,0 +1,80 @@
+package prompt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lonelysadness/netmonitor/internal/rules"
+	"golang.org/x/sys/unix"
+)
+
+func testConn() *rules.Conn {
+	return &rules.Conn{
+		SrcIP:       net.ParseIP("192.168.1.2"),
+		SrcPort:     40000,
+		DstIP:       net.ParseIP("1.2.3.4"),
+		DstPort:     443,
+		Protocol:    unix.IPPROTO_TCP,
+		ProcessName: "curl",
+		ProcessPath: "/usr/bin/curl",
+	}
+}
+
+func TestDecisionRuleNames(t *testing.T) {
+	conn := testConn()
+	tests := []struct {
+		id       string
+		decision Decision
+		want     string
+	}{
+		{"1", Decision{Verdict: rules.Accept, Scope: Always}, "prompt 1: accept always /usr/bin/curl to 1.2.3.4:443/TCP"},
+		{"2", Decision{Verdict: rules.Block, Scope: Process}, "prompt 2: block process /usr/bin/curl"},
+		{"3", Decision{Verdict: rules.Drop, Scope: Destination}, "prompt 3: drop destination 1.2.3.4"},
+	}
+	for _, tt := range tests {
+		rule := tt.decision.Rule(tt.id, conn)
+		if rule == nil {
+			t.Errorf("%v: no rule", tt.decision)
+			continue
+		}
+		if rule.Name != tt.want {
+			t.Errorf("name = %q, want %q", rule.Name, tt.want)
+		}
+	}
+
+	if rule := (Decision{Verdict: rules.Accept, Scope: Once}).Rule("4", conn); rule != nil {
+		t.Errorf("once decision learned %q", rule.Name)
+	}
+	if rule := (Decision{Verdict: rules.Accept, Scope: Process, TimedOut: true}).Rule("5", conn); rule != nil {
+		t.Errorf("timed out decision learned %q", rule.Name)
+	}
+}
+
+func TestAnswerLearnsRule(t *testing.T) {
+	var learned []*rules.Rule
+	m := NewManager(time.Minute, rules.Block, func(r *rules.Rule) error {
+		learned = append(learned, r)
+		return nil
+	})
+
+	done := make(chan Decision)
+	go func() { done <- m.Ask("key", testConn()) }()
+	var pending []*Request
+	for len(pending) == 0 {
+		time.Sleep(time.Millisecond)
+		pending = m.Pending()
+	}
+	if err := m.Answer(pending[0].ID, Decision{Verdict: rules.Accept, Scope: Process}); err != nil {
+		t.Fatal(err)
+	}
+	if d := <-done; d.Verdict != rules.Accept {
+		t.Errorf("verdict = %s, want accept", d.Verdict)
+	}
+	if len(learned) != 1 || learned[0].Verdict != rules.AcceptAlways {
+		t.Fatalf("learned %v", learned)
+	}
+	if err := m.Answer(pending[0].ID, Decision{Verdict: rules.Block}); err != ErrNotPending {
+		t.Errorf("second answer: %v, want ErrNotPending", err)
+	}
+}
@@ -0,0 +1,126 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LimitKey is what a Limit counts connections by
+type LimitKey int
+
+const (
+	// LimitProcess counts the connections of each executable
+	LimitProcess LimitKey = iota + 1
+	// LimitDestination counts the connections to each domain, or remote
+	// address when the domain is not known
+	LimitDestination
+)
+
+var limitKeyNames = map[LimitKey]string{
+	LimitProcess:     "process",
+	LimitDestination: "destination",
+}
+
+func (k LimitKey) String() string {
+	if name, ok := limitKeyNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseLimitKey converts "process" or "destination" into a LimitKey
+func ParseLimitKey(s string) (LimitKey, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for k, n := range limitKeyNames {
+		if n == name {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown limit key %q, expected process or destination", s)
+}
+
+// Rate is a number of connections per period
+type Rate struct {
+	Count  int
+	Period time.Duration
+}
+
+var ratePeriods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+func (r Rate) String() string {
+	for unit, period := range ratePeriods {
+		if r.Period == period {
+			return fmt.Sprintf("%d/%s", r.Count, unit)
+		}
+	}
+	return fmt.Sprintf("%d/%s", r.Count, r.Period)
+}
+
+// ParseRate parses a rate such as "10/s", "30/m" or "100/h"
+func ParseRate(s string) (Rate, error) {
+	count, unit, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected a count per s, m or h such as 10/s", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, the count must be a positive integer", s)
+	}
+	period, ok := ratePeriods[strings.ToLower(unit)]
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected a count per s, m or h such as 10/s", s)
+	}
+	return Rate{Count: n, Period: period}, nil
+}
+
+// Limit caps the connections a rule accepts. Connections over the limit
+// get the Overflow verdict instead of the one of the rule.
+type Limit struct {
+	Per LimitKey
+	// Rate caps new connections with a token bucket holding Burst tokens;
+	// a zero Rate leaves new connections unlimited
+	Rate  Rate
+	Burst int
+	// MaxConnections caps the open connections; 0 leaves them unlimited
+	MaxConnections int
+	Overflow       Verdict // Block or Drop
+}
+
+// Validate checks that l limits something and fills in the defaults: per
+// process, a burst of one period worth of connections and the Block
+// verdict. verdict is the verdict of the rule l belongs to.
+func (l *Limit) Validate(verdict Verdict) error {
+	if l.Rate.Count == 0 && l.MaxConnections == 0 {
+		return errors.New("limit needs a rate or max_connections")
+	}
+	if l.Rate.Count == 0 && l.Burst != 0 {
+		return errors.New("burst needs a rate")
+	}
+	if l.Burst < 0 || l.MaxConnections < 0 {
+		return errors.New("burst and max_connections cannot be negative")
+	}
+	if verdict != Accept && verdict != AcceptAlways {
+		return fmt.Errorf("only accepting rules can limit connections, verdict is %s", verdict)
+	}
+	switch l.Overflow {
+	case 0:
+		l.Overflow = Block
+	case Block, Drop:
+	default:
+		return fmt.Errorf("overflow verdict must be block or drop, found %s", l.Overflow)
+	}
+	if l.Per == 0 {
+		l.Per = LimitProcess
+	}
+	if l.Rate.Count != 0 && l.Burst == 0 {
+		l.Burst = l.Rate.Count
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitValidate(t *testing.T) {
+	perSecond := Rate{Count: 10, Period: time.Second}
+	tests := []struct {
+		name    string
+		limit   Limit
+		verdict Verdict
+		want    Limit  // after the defaults are filled in
+		err     string // part of the error, "" for none
+	}{
+		{
+			name:    "rate defaults",
+			limit:   Limit{Rate: perSecond},
+			verdict: Accept,
+			want:    Limit{Per: LimitProcess, Rate: perSecond, Burst: 10, Overflow: Block},
+		},
+		{
+			name:    "max connections defaults",
+			limit:   Limit{MaxConnections: 4},
+			verdict: AcceptAlways,
+			want:    Limit{Per: LimitProcess, MaxConnections: 4, Overflow: Block},
+		},
+		{
+			name:    "explicit values kept",
+			limit:   Limit{Per: LimitDestination, Rate: perSecond, Burst: 50, MaxConnections: 8, Overflow: Drop},
+			verdict: Accept,
+			want:    Limit{Per: LimitDestination, Rate: perSecond, Burst: 50, MaxConnections: 8, Overflow: Drop},
+		},
+		{name: "nothing limited", limit: Limit{}, verdict: Accept, err: "needs a rate or max_connections"},
+		{name: "burst without rate", limit: Limit{MaxConnections: 1, Burst: 5}, verdict: Accept, err: "burst needs a rate"},
+		{name: "negative burst", limit: Limit{Rate: perSecond, Burst: -1}, verdict: Accept, err: "cannot be negative"},
+		{name: "negative max", limit: Limit{Rate: perSecond, MaxConnections: -1}, verdict: Accept, err: "cannot be negative"},
+		{name: "blocking rule", limit: Limit{Rate: perSecond}, verdict: Block, err: "only accepting rules"},
+		{name: "accepting overflow", limit: Limit{Rate: perSecond, Overflow: Accept}, verdict: Accept, err: "must be block or drop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tt.limit
+			err := l.Validate(tt.verdict)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Validate() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			if l != tt.want {
+				t.Errorf("Validate() filled in %+v, want %+v", l, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rate
+		ok   bool
+	}{
+		{"10/s", Rate{10, time.Second}, true},
+		{" 30/M ", Rate{30, time.Minute}, true},
+		{"100/h", Rate{100, time.Hour}, true},
+		{"0/s", Rate{}, false},
+		{"-1/s", Rate{}, false},
+		{"10", Rate{}, false},
+		{"10/d", Rate{}, false},
+		{"x/s", Rate{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+		if tt.ok && got.String() != strings.ToLower(strings.TrimSpace(tt.in)) {
+			t.Errorf("Rate.String() = %q, want %q", got.String(), strings.TrimSpace(tt.in))
+		}
+	}
+}
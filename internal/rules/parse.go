@@ -0,0 +1,162 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/sys/unix"
+)
+
+// ParseNetwork parses a CIDR or a single address, which becomes a host
+// network. CIDRs with host bits set are rejected as likely typos.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", s)
+	}
+	if !ip.Equal(n.IP) {
+		return nil, fmt.Errorf("CIDR %q has host bits set, did you mean %s?", s, n)
+	}
+	return n, nil
+}
+
+// ParseSHA256 validates a hex SHA-256 digest and returns it in lowercase
+func ParseSHA256(s string) (string, error) {
+	h := strings.ToLower(strings.TrimSpace(s))
+	if len(h) != 64 || strings.Trim(h, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid SHA-256 %q", s)
+	}
+	return h, nil
+}
+
+const (
+	// EuropeanUnion is the country code matching all member states of the
+	// European Union, as reserved in ISO 3166-1
+	EuropeanUnion = "EU"
+	// UnknownCountry matches addresses whose country is not known
+	UnknownCountry = "unknown"
+)
+
+// continents are the codes used by the country database
+var continents = map[string]string{
+	"AF": "africa",
+	"AN": "antarctica",
+	"AS": "asia",
+	"EU": "europe",
+	"NA": "north america",
+	"OC": "oceania",
+	"SA": "south america",
+}
+
+// ParseCountry validates a two letter country code, "EU" or "unknown" and
+// returns it in the form rules use
+func ParseCountry(s string) (string, error) {
+	code := strings.TrimSpace(s)
+	if strings.EqualFold(code, UnknownCountry) {
+		return UnknownCountry, nil
+	}
+	if len(code) != 2 || !isLetters(code) {
+		return "", fmt.Errorf("invalid country %q, expected a two letter ISO code, EU or unknown", s)
+	}
+	return strings.ToUpper(code), nil
+}
+
+// ParseContinent converts a continent code ("EU") or name ("europe") into
+// its code
+func ParseContinent(s string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for code, n := range continents {
+		if n == name || strings.ToLower(code) == name {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("unknown continent %q, expected AF, AN, AS, EU, NA, OC or SA", s)
+}
+
+// ParseScope validates a scope, one of "localhost", "lan" and "internet"
+// or the label of an overlay network, and lowercases it
+func ParseScope(s string) (string, error) {
+	scope := strings.ToLower(strings.TrimSpace(s))
+	if scope == "" || strings.ContainsFunc(scope, unicode.IsSpace) {
+		return "", fmt.Errorf("invalid scope %q", s)
+	}
+	return scope, nil
+}
+
+func isLetters(s string) bool {
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParsePortRange parses a port ("443") or an inclusive range ("8000-8100")
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	lo, err1 := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	hi, err2 := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err1 != nil || err2 != nil || lo > hi {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{From: uint16(lo), To: uint16(hi)}, nil
+}
+
+func (p PortRange) String() string {
+	if p.From == p.To {
+		return strconv.Itoa(int(p.From))
+	}
+	return fmt.Sprintf("%d-%d", p.From, p.To)
+}
+
+var protocolNumbers = map[string]uint8{
+	"icmp":   unix.IPPROTO_ICMP,
+	"tcp":    unix.IPPROTO_TCP,
+	"udp":    unix.IPPROTO_UDP,
+	"icmpv6": unix.IPPROTO_ICMPV6,
+	"sctp":   unix.IPPROTO_SCTP,
+	"gre":    unix.IPPROTO_GRE,
+	"esp":    unix.IPPROTO_ESP,
+	"ah":     unix.IPPROTO_AH,
+}
+
+// ParseProtocol accepts a protocol name such as "tcp" or its number
+func ParseProtocol(s string) (uint8, error) {
+	if p, ok := protocolNumbers[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return p, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown protocol %q", s)
+	}
+	return uint8(n), nil
+}
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	}
+	return "any"
+}
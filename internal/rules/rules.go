@@ -0,0 +1,562 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Verdict is the decision a rule set reaches for a connection
+type Verdict int
+
+const (
+	Accept Verdict = iota + 1
+	Block
+	Drop
+	AcceptAlways
+	BlockAlways
+	DropAlways
+	// Prompt parks the connection until a user decides on it
+	Prompt
+)
+
+var verdictNames = map[Verdict]string{
+	Accept:       "accept",
+	Block:        "block",
+	Drop:         "drop",
+	AcceptAlways: "accept-always",
+	BlockAlways:  "block-always",
+	DropAlways:   "drop-always",
+	Prompt:       "prompt",
+}
+
+func (v Verdict) String() string {
+	if name, ok := verdictNames[v]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseVerdict converts a verdict name such as "block-always" into a Verdict
+func ParseVerdict(s string) (Verdict, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for v, n := range verdictNames {
+		if n == name {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown verdict %q", s)
+}
+
+// HashPolicy decides what a rule with pinned executable hashes does when the
+// process runs a different binary
+type HashPolicy int
+
+const (
+	// HashBlock blocks the connection
+	HashBlock HashPolicy = iota + 1
+	// HashPrompt asks the user
+	HashPrompt
+	// HashAllow applies the rule anyway; the mismatch is only logged
+	HashAllow
+)
+
+var hashPolicyNames = map[HashPolicy]string{
+	HashBlock:  "block",
+	HashPrompt: "prompt",
+	HashAllow:  "allow",
+}
+
+func (p HashPolicy) String() string {
+	if name, ok := hashPolicyNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseHashPolicy converts "block", "prompt" or "allow" into a HashPolicy
+func ParseHashPolicy(s string) (HashPolicy, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for p, n := range hashPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash mismatch policy %q", s)
+}
+
+// GeoIPPolicy decides how conditions on the country, continent or ASN of
+// the remote address evaluate while the database they need is not loaded
+type GeoIPPolicy int
+
+const (
+	// GeoIPUnknown treats the address like one the database has no answer
+	// for: only UnknownCountry matches, continents and ASNs do not
+	GeoIPUnknown GeoIPPolicy = iota + 1
+	// GeoIPMatch lets the conditions match
+	GeoIPMatch
+	// GeoIPNoMatch lets the conditions fail, so the rule does not apply
+	GeoIPNoMatch
+)
+
+var geoIPPolicyNames = map[GeoIPPolicy]string{
+	GeoIPUnknown: "unknown",
+	GeoIPMatch:   "match",
+	GeoIPNoMatch: "no-match",
+}
+
+func (p GeoIPPolicy) String() string {
+	if name, ok := geoIPPolicyNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseGeoIPPolicy converts "unknown", "match" or "no-match" into a
+// GeoIPPolicy
+func ParseGeoIPPolicy(s string) (GeoIPPolicy, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for p, n := range geoIPPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown geoip policy %q", s)
+}
+
+// Direction restricts a rule to inbound or outbound connections
+type Direction int
+
+const (
+	AnyDirection Direction = iota
+	Inbound
+	Outbound
+)
+
+// ParseDirection converts "in", "out" or "any" into a Direction
+func ParseDirection(s string) (Direction, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "any":
+		return AnyDirection, nil
+	case "in", "inbound":
+		return Inbound, nil
+	case "out", "outbound":
+		return Outbound, nil
+	}
+	return 0, fmt.Errorf("unknown direction %q", s)
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (p PortRange) contains(port uint16) bool {
+	return port >= p.From && port <= p.To
+}
+
+// Conn describes the connection a rule set is evaluated against
+type Conn struct {
+	SrcIP       net.IP
+	SrcPort     uint16
+	DstIP       net.IP
+	DstPort     uint16
+	Protocol    uint8
+	Inbound     bool
+	PID         int
+	UID         int // -1 when the owner is unknown
+	GID         int // -1 when unknown
+	User        string
+	ProcessName string
+	ProcessPath string
+	Cmdline     []string
+	ExeHash     func() (string, error) // SHA-256 of the executable, computed on first use; nil when unknown
+	Started     time.Time              // start time of the process, guards against PID reuse
+	Parents     []Program              // ancestors of the process, nearest first
+	Unit        string                 // systemd unit of the process
+	Container   string                 // container ID of the process
+	Attribution string                 // backend that identified the process
+	Domain      string                 // name the remote address was resolved from
+	OwnDomain   bool                   // Domain was resolved by the process itself, not by another one
+	FilterList  string                 // filter list that blocks Domain, if any
+	FilterEntry string                 // entry of FilterList that matched
+	IPLists     []string               // IP lists containing the remote address
+	Country     string                 // ISO 3166-1 code, empty when unknown
+	Continent   string                 // two letter continent code, empty when unknown
+	EU          bool                   // Country is a member of the European Union
+	City        string                 // only known with a city database
+	ASN         uint
+	Scope       string // localhost, lan or internet
+	Label       string // overlay network holding the remote address
+	// LocationUnavailable and ASNUnavailable are set when the database for
+	// Country and Continent or for ASN was not loaded
+	LocationUnavailable bool
+	ASNUnavailable      bool
+}
+
+// Program names a process by its command name and executable path
+type Program struct {
+	Name string
+	Path string
+}
+
+// Remote returns the address of the peer, which is the source for inbound
+// connections and the destination otherwise
+func (c *Conn) Remote() (net.IP, uint16) {
+	if c.Inbound {
+		return c.SrcIP, c.SrcPort
+	}
+	return c.DstIP, c.DstPort
+}
+
+// Match holds the conditions of a rule. Empty fields match anything, and
+// all non-empty fields must match for the rule to apply.
+type Match struct {
+	// Processes are process names or executable paths; entries containing a
+	// slash are matched against the path. Shell globs are allowed. Parents
+	// match the same way against any ancestor of the process.
+	Processes []string
+	Parents   []string
+	UIDs      []int
+	// Users, Units and Containers are shell globs on the user name, the
+	// systemd unit and the container ID
+	Users      []string
+	Units      []string
+	Containers []string
+	// SHA256 pins the executable to one of these lowercase hex hashes. It
+	// is checked after everything else matched; see Rule.OnHashMismatch.
+	SHA256       []string
+	Destinations []*net.IPNet
+	// Domains are lowercase names the process resolved the remote address
+	// from. "*.example.com" matches the subdomains, not example.com itself.
+	Domains   []string
+	Ports     []PortRange
+	Protocols []uint8
+	// Countries are ISO 3166-1 codes. "EU" stands for the member states of
+	// the European Union and UnknownCountry for addresses the country
+	// database has no answer for.
+	Countries  []string
+	Continents []string // continent codes, see ParseContinent
+	ASNs       []uint
+	// Scopes are "localhost", "lan", "internet" or labels of overlay
+	// networks; see geoip.ScopeOf
+	Scopes []string
+	// IPLists are names of IP lists, one of which must contain the remote
+	// address
+	IPLists   []string
+	Direction Direction
+}
+
+// Rule pairs a Match with the verdict applied when it matches
+type Rule struct {
+	Name    string
+	Match   Match
+	Verdict Verdict
+	// Except exempts connections it matches from the rule, leaving them to
+	// the rules that follow. Pinned hashes are not checked in it.
+	Except *Match
+	// OnHashMismatch applies when the match has pinned hashes and the
+	// executable has none of them. The zero value blocks.
+	OnHashMismatch HashPolicy
+	// OnGeoIPUnavailable applies to the country, continent and ASN
+	// conditions while their database is not loaded. The zero value is
+	// GeoIPUnknown.
+	OnGeoIPUnavailable GeoIPPolicy
+	// Limit caps the connections the rule accepts; nil leaves them
+	// unlimited
+	Limit *Limit
+}
+
+// UsesGeoIP reports whether the rule has conditions on GeoIP data
+func (r *Rule) UsesGeoIP() bool {
+	return r.Match.usesGeoIP() || (r.Except != nil && r.Except.usesGeoIP())
+}
+
+func (m *Match) usesGeoIP() bool {
+	return len(m.Countries) > 0 || len(m.Continents) > 0 || len(m.ASNs) > 0
+}
+
+// HashMismatch reports whether the rule pins executable hashes and the
+// process of c runs a binary with a different or unknown hash
+func (r *Rule) HashMismatch(c *Conn) bool {
+	if len(r.Match.SHA256) == 0 {
+		return false
+	}
+	if c.ExeHash == nil {
+		return true
+	}
+	hash, err := c.ExeHash()
+	if err != nil {
+		return true
+	}
+	return !contains(r.Match.SHA256, hash)
+}
+
+func (r *Rule) matches(c *Conn) bool {
+	geoip := r.OnGeoIPUnavailable
+	if geoip == 0 {
+		geoip = GeoIPUnknown
+	}
+	if !r.Match.matches(c, geoip) {
+		return false
+	}
+	return r.Except == nil || !r.Except.matches(c, geoip)
+}
+
+func (m *Match) matches(c *Conn, geoip GeoIPPolicy) bool {
+	switch m.Direction {
+	case Inbound:
+		if !c.Inbound {
+			return false
+		}
+	case Outbound:
+		if c.Inbound {
+			return false
+		}
+	}
+
+	if len(m.Processes) > 0 && !matchProgram(m.Processes, Program{Name: c.ProcessName, Path: c.ProcessPath}) {
+		return false
+	}
+	if len(m.Parents) > 0 && !matchParents(m.Parents, c.Parents) {
+		return false
+	}
+	if len(m.UIDs) > 0 && !contains(m.UIDs, c.UID) {
+		return false
+	}
+	if len(m.Users) > 0 && !matchGlob(m.Users, c.User) {
+		return false
+	}
+	if len(m.Units) > 0 && !matchGlob(m.Units, c.Unit) {
+		return false
+	}
+	if len(m.Containers) > 0 && !matchGlob(m.Containers, c.Container) {
+		return false
+	}
+	if len(m.Protocols) > 0 && !contains(m.Protocols, c.Protocol) {
+		return false
+	}
+
+	remoteIP, remotePort := c.Remote()
+	if len(m.Destinations) > 0 && !matchNetwork(m.Destinations, remoteIP) {
+		return false
+	}
+	if len(m.Domains) > 0 && !matchGlob(m.Domains, c.Domain) {
+		return false
+	}
+	if len(m.Ports) > 0 && !matchPort(m.Ports, remotePort) {
+		return false
+	}
+	if len(m.Countries) > 0 || len(m.Continents) > 0 {
+		if c.LocationUnavailable && geoip != GeoIPUnknown {
+			if geoip == GeoIPNoMatch {
+				return false
+			}
+		} else if (len(m.Countries) > 0 && !matchCountry(m.Countries, c)) ||
+			(len(m.Continents) > 0 && !contains(m.Continents, c.Continent)) {
+			return false
+		}
+	}
+	if len(m.ASNs) > 0 {
+		if c.ASNUnavailable && geoip != GeoIPUnknown {
+			if geoip == GeoIPNoMatch {
+				return false
+			}
+		} else if !contains(m.ASNs, c.ASN) {
+			return false
+		}
+	}
+	if len(m.Scopes) > 0 && !contains(m.Scopes, c.Scope) && (c.Label == "" || !contains(m.Scopes, c.Label)) {
+		return false
+	}
+	if len(m.IPLists) > 0 && !matchAny(m.IPLists, c.IPLists) {
+		return false
+	}
+	return true
+}
+
+func matchAny(want, have []string) bool {
+	for _, s := range have {
+		if contains(want, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchProgram(patterns []string, p Program) bool {
+	for _, pattern := range patterns {
+		target := p.Name
+		if strings.Contains(pattern, "/") {
+			target = p.Path
+		}
+		if target == "" {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchParents(patterns []string, parents []Program) bool {
+	for _, p := range parents {
+		if matchProgram(patterns, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(patterns []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNetwork(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCountry(countries []string, c *Conn) bool {
+	if c.Country == "" {
+		return contains(countries, UnknownCountry)
+	}
+	for _, country := range countries {
+		if strings.EqualFold(country, c.Country) || (country == EuropeanUnion && c.EU) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains[T comparable](list []T, v T) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleSet is an ordered, immutable list of rules with a default verdict.
+// The first matching rule decides the verdict.
+type RuleSet struct {
+	rules   []*Rule
+	verdict Verdict
+}
+
+// NewRuleSet creates a RuleSet that falls back to def when no rule matches
+func NewRuleSet(def Verdict, rules ...*Rule) *RuleSet {
+	return &RuleSet{
+		rules:   rules,
+		verdict: def,
+	}
+}
+
+// Rules returns the rules in evaluation order
+func (rs *RuleSet) Rules() []*Rule {
+	return rs.rules
+}
+
+// Default returns the verdict used when no rule matches
+func (rs *RuleSet) Default() Verdict {
+	return rs.verdict
+}
+
+// Prepend returns a copy of the rule set with rules evaluated before the
+// existing ones
+func (rs *RuleSet) Prepend(rules ...*Rule) *RuleSet {
+	merged := make([]*Rule, 0, len(rules)+len(rs.rules))
+	merged = append(merged, rules...)
+	merged = append(merged, rs.rules...)
+	return NewRuleSet(rs.verdict, merged...)
+}
+
+// Insert returns a copy of the rule set with rule at position index.
+// Positions past the end append the rule.
+func (rs *RuleSet) Insert(index int, rule *Rule) *RuleSet {
+	if index < 0 || index > len(rs.rules) {
+		index = len(rs.rules)
+	}
+	merged := make([]*Rule, 0, len(rs.rules)+1)
+	merged = append(merged, rs.rules[:index]...)
+	merged = append(merged, rule)
+	merged = append(merged, rs.rules[index:]...)
+	return NewRuleSet(rs.verdict, merged...)
+}
+
+// Remove returns a copy of the rule set without the rule called name and
+// whether such a rule existed
+func (rs *RuleSet) Remove(name string) (*RuleSet, bool) {
+	kept := make([]*Rule, 0, len(rs.rules))
+	for _, rule := range rs.rules {
+		if rule.Name != name {
+			kept = append(kept, rule)
+		}
+	}
+	if len(kept) == len(rs.rules) {
+		return rs, false
+	}
+	return NewRuleSet(rs.verdict, kept...), true
+}
+
+// Lookup returns the rule called name, or nil
+func (rs *RuleSet) Lookup(name string) *Rule {
+	for _, rule := range rs.rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Evaluate returns the verdict for c and the rule that produced it, or nil
+// when the default verdict was used. A matching rule whose pinned hash does
+// not match decides according to its OnHashMismatch policy.
+func (rs *RuleSet) Evaluate(c *Conn) (Verdict, *Rule) {
+	for _, rule := range rs.rules {
+		if !rule.matches(c) {
+			continue
+		}
+		if rule.HashMismatch(c) {
+			switch rule.OnHashMismatch {
+			case HashAllow:
+				// The rule applies, callers log the mismatch
+			case HashPrompt:
+				return Prompt, rule
+			default:
+				return Block, rule
+			}
+		}
+		return rule.Verdict, rule
+	}
+	return rs.verdict, nil
+}
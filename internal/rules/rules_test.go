@@ -0,0 +1,286 @@
+package rules
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// outbound returns a TCP connection from curl to 198.51.100.7:443
+func outbound() *Conn {
+	return &Conn{
+		SrcIP:       net.ParseIP("192.0.2.1"),
+		SrcPort:     40000,
+		DstIP:       net.ParseIP("198.51.100.7"),
+		DstPort:     443,
+		Protocol:    unix.IPPROTO_TCP,
+		UID:         1000,
+		User:        "alice",
+		ProcessName: "curl",
+		ProcessPath: "/usr/bin/curl",
+		Parents:     []Program{{Name: "bash", Path: "/usr/bin/bash"}, {Name: "sshd", Path: "/usr/sbin/sshd"}},
+		Unit:        "user@1000.service",
+		Domain:      "api.example.com",
+		Country:     "NL",
+		Continent:   "EU",
+		EU:          true,
+		ASN:         64500,
+		Scope:       "internet",
+		IPLists:     []string{"spamhaus"},
+	}
+}
+
+// inbound returns an SSH connection from 203.0.113.9 to sshd
+func inbound() *Conn {
+	return &Conn{
+		SrcIP:       net.ParseIP("203.0.113.9"),
+		SrcPort:     51000,
+		DstIP:       net.ParseIP("192.0.2.1"),
+		DstPort:     22,
+		Protocol:    unix.IPPROTO_TCP,
+		Inbound:     true,
+		ProcessName: "sshd",
+		ProcessPath: "/usr/sbin/sshd",
+		Scope:       "internet",
+	}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		match Match
+		conn  *Conn
+		want  bool
+	}{
+		{"empty", Match{}, outbound(), true},
+		{"outbound", Match{Direction: Outbound}, outbound(), true},
+		{"outbound on inbound", Match{Direction: Outbound}, inbound(), false},
+		{"inbound", Match{Direction: Inbound}, inbound(), true},
+		{"inbound on outbound", Match{Direction: Inbound}, outbound(), false},
+		{"process name", Match{Processes: []string{"wget", "curl"}}, outbound(), true},
+		{"process glob", Match{Processes: []string{"cu*"}}, outbound(), true},
+		{"process path", Match{Processes: []string{"/usr/bin/curl"}}, outbound(), true},
+		{"process path glob", Match{Processes: []string{"/usr/bin/*"}}, outbound(), true},
+		{"path glob stops at slashes", Match{Processes: []string{"/usr/*"}}, outbound(), false},
+		{"name is not a path", Match{Processes: []string{"/curl"}}, outbound(), false},
+		{"other process", Match{Processes: []string{"firefox"}}, outbound(), false},
+		{"parent", Match{Parents: []string{"/usr/sbin/sshd"}}, outbound(), true},
+		{"no such parent", Match{Parents: []string{"systemd"}}, outbound(), false},
+		{"uid", Match{UIDs: []int{0, 1000}}, outbound(), true},
+		{"other uid", Match{UIDs: []int{0}}, outbound(), false},
+		{"user glob", Match{Users: []string{"al*"}}, outbound(), true},
+		{"unknown user", Match{Users: []string{"*"}}, inbound(), false},
+		{"unit", Match{Units: []string{"user@*.service"}}, outbound(), true},
+		{"protocol", Match{Protocols: []uint8{unix.IPPROTO_UDP}}, outbound(), false},
+		{"destination", Match{Destinations: []*net.IPNet{mustCIDR(t, "198.51.100.0/24")}}, outbound(), true},
+		{"other destination", Match{Destinations: []*net.IPNet{mustCIDR(t, "198.51.101.0/24")}}, outbound(), false},
+		{"ipv6 destination", Match{Destinations: []*net.IPNet{mustCIDR(t, "2001:db8::/32")}}, outbound(), false},
+		{"inbound source", Match{Destinations: []*net.IPNet{mustCIDR(t, "203.0.113.0/24")}}, inbound(), true},
+		{"inbound local address", Match{Destinations: []*net.IPNet{mustCIDR(t, "192.0.2.0/24")}}, inbound(), false},
+		{"domain", Match{Domains: []string{"api.example.com"}}, outbound(), true},
+		{"subdomains", Match{Domains: []string{"*.example.com"}}, outbound(), true},
+		{"subdomains exclude the parent", Match{Domains: []string{"*.api.example.com"}}, outbound(), false},
+		{"no domain", Match{Domains: []string{"*"}}, inbound(), false},
+		{"port", Match{Ports: []PortRange{{443, 443}}}, outbound(), true},
+		{"port range", Match{Ports: []PortRange{{80, 80}, {400, 500}}}, outbound(), true},
+		{"range bounds", Match{Ports: []PortRange{{444, 500}}}, outbound(), false},
+		{"inbound remote port", Match{Ports: []PortRange{{22, 22}}}, inbound(), false},
+		{"country", Match{Countries: []string{"nl"}}, outbound(), true},
+		{"european union", Match{Countries: []string{EuropeanUnion}}, outbound(), true},
+		{"unknown country", Match{Countries: []string{UnknownCountry}}, inbound(), true},
+		{"continent", Match{Continents: []string{"NA"}}, outbound(), false},
+		{"asn", Match{ASNs: []uint{64500}}, outbound(), true},
+		{"scope", Match{Scopes: []string{"lan", "internet"}}, outbound(), true},
+		{"ip list", Match{IPLists: []string{"spamhaus"}}, outbound(), true},
+		{"other ip list", Match{IPLists: []string{"tor"}}, outbound(), false},
+		{"all conditions", Match{Processes: []string{"curl"}, Ports: []PortRange{{443, 443}}, Direction: Outbound}, outbound(), true},
+		{"one failing condition", Match{Processes: []string{"curl"}, Ports: []PortRange{{80, 80}}}, outbound(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match.matches(tt.conn, GeoIPUnknown); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchGeoIPUnavailable(t *testing.T) {
+	conn := outbound()
+	conn.Country, conn.Continent, conn.EU, conn.ASN = "", "", false, 0
+	conn.LocationUnavailable, conn.ASNUnavailable = true, true
+
+	tests := []struct {
+		match  Match
+		policy GeoIPPolicy
+		want   bool
+	}{
+		{Match{Countries: []string{"NL"}}, GeoIPUnknown, false},
+		{Match{Countries: []string{UnknownCountry}}, GeoIPUnknown, true},
+		{Match{Countries: []string{"NL"}}, GeoIPMatch, true},
+		{Match{Countries: []string{UnknownCountry}}, GeoIPNoMatch, false},
+		{Match{Continents: []string{"EU"}}, GeoIPMatch, true},
+		{Match{ASNs: []uint{64500}}, GeoIPUnknown, false},
+		{Match{ASNs: []uint{64500}}, GeoIPMatch, true},
+		{Match{ASNs: []uint{64500}}, GeoIPNoMatch, false},
+	}
+	for _, tt := range tests {
+		if got := tt.match.matches(conn, tt.policy); got != tt.want {
+			t.Errorf("%+v under %s: matches() = %v, want %v", tt.match, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	rs := NewRuleSet(Drop,
+		&Rule{Name: "ssh", Match: Match{Direction: Inbound, Processes: []string{"sshd"}}, Verdict: AcceptAlways},
+		&Rule{
+			Name:    "curl",
+			Match:   Match{Processes: []string{"curl"}},
+			Verdict: Accept,
+			Except:  &Match{Domains: []string{"*.tracker.example"}},
+		},
+		&Rule{Name: "web", Match: Match{Ports: []PortRange{{80, 80}, {443, 443}}}, Verdict: Block},
+		&Rule{Name: "dns", Match: Match{Protocols: []uint8{unix.IPPROTO_UDP}, Ports: []PortRange{{53, 53}}}, Verdict: Accept},
+	)
+
+	tracked := outbound()
+	tracked.Domain = "ads.tracker.example"
+	other := outbound()
+	other.ProcessName, other.ProcessPath = "wget", "/usr/bin/wget"
+	dns := outbound()
+	dns.ProcessName, dns.ProcessPath, dns.DstPort = "dig", "/usr/bin/dig", 53
+	dns.Protocol = unix.IPPROTO_UDP
+	dnsOverTCP := outbound()
+	dnsOverTCP.ProcessName, dnsOverTCP.ProcessPath, dnsOverTCP.DstPort = "dig", "/usr/bin/dig", 53
+
+	tests := []struct {
+		name    string
+		conn    *Conn
+		verdict Verdict
+		rule    string // "" for the default verdict
+	}{
+		{"first match wins", outbound(), Accept, "curl"},
+		{"inbound", inbound(), AcceptAlways, "ssh"},
+		{"except falls through", tracked, Block, "web"},
+		{"later rule", other, Block, "web"},
+		{"protocol", dns, Accept, "dns"},
+		{"default", dnsOverTCP, Drop, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict, rule := rs.Evaluate(tt.conn)
+			name := ""
+			if rule != nil {
+				name = rule.Name
+			}
+			if verdict != tt.verdict || name != tt.rule {
+				t.Errorf("Evaluate() = %s by %q, want %s by %q", verdict, name, tt.verdict, tt.rule)
+			}
+		})
+	}
+}
+
+func TestEvaluateHashMismatch(t *testing.T) {
+	const pinned = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	hash := func(h string, err error) func() (string, error) {
+		return func() (string, error) { return h, err }
+	}
+
+	tests := []struct {
+		name    string
+		policy  HashPolicy
+		exeHash func() (string, error)
+		verdict Verdict
+	}{
+		{"pinned hash", HashBlock, hash(pinned, nil), AcceptAlways},
+		{"pinned hash under prompt", HashPrompt, hash(pinned, nil), AcceptAlways},
+		{"block by default", 0, hash("0000", nil), Block},
+		{"block", HashBlock, hash("0000", nil), Block},
+		{"prompt", HashPrompt, hash("0000", nil), Prompt},
+		{"allow", HashAllow, hash("0000", nil), AcceptAlways},
+		{"unknown hash", HashBlock, nil, Block},
+		{"hashing failed", HashPrompt, hash("", errors.New("permission denied")), Prompt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &Rule{
+				Name:           "curl",
+				Match:          Match{Processes: []string{"curl"}, SHA256: []string{pinned}},
+				Verdict:        AcceptAlways,
+				OnHashMismatch: tt.policy,
+			}
+			rs := NewRuleSet(Accept, rule, &Rule{Name: "rest", Verdict: Drop})
+			conn := outbound()
+			conn.ExeHash = tt.exeHash
+
+			// A mismatch decides on the rule, it does not fall through
+			verdict, got := rs.Evaluate(conn)
+			if verdict != tt.verdict || got != rule {
+				t.Errorf("Evaluate() = %s by %v, want %s by the pinned rule", verdict, got, tt.verdict)
+			}
+		})
+	}
+}
+
+// names returns the names of the rules of rs in order
+func names(rs *RuleSet) string {
+	var s []string
+	for _, rule := range rs.Rules() {
+		s = append(s, rule.Name)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestRuleSetEdits(t *testing.T) {
+	rs := NewRuleSet(Block, &Rule{Name: "a"}, &Rule{Name: "b"}, &Rule{Name: "c"})
+
+	tests := []struct {
+		name string
+		got  *RuleSet
+		want string
+	}{
+		{"prepend", rs.Prepend(&Rule{Name: "x"}, &Rule{Name: "y"}), "x y a b c"},
+		{"prepend nothing", rs.Prepend(), "a b c"},
+		{"insert first", rs.Insert(0, &Rule{Name: "x"}), "x a b c"},
+		{"insert between", rs.Insert(2, &Rule{Name: "x"}), "a b x c"},
+		{"insert at the end", rs.Insert(3, &Rule{Name: "x"}), "a b c x"},
+		{"insert past the end", rs.Insert(10, &Rule{Name: "x"}), "a b c x"},
+		{"insert negative", rs.Insert(-1, &Rule{Name: "x"}), "a b c x"},
+	}
+	for _, tt := range tests {
+		if got := names(tt.got); got != tt.want {
+			t.Errorf("%s: rules = %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.got.Default() != Block {
+			t.Errorf("%s: default = %s, want block", tt.name, tt.got.Default())
+		}
+	}
+
+	removed, ok := rs.Remove("b")
+	if !ok || names(removed) != "a c" {
+		t.Errorf("Remove(b) = %q, %v, want \"a c\"", names(removed), ok)
+	}
+	if same, ok := rs.Remove("missing"); ok || same != rs {
+		t.Errorf("Remove(missing) = %q, %v, want the rule set unchanged", names(same), ok)
+	}
+	if rs.Lookup("c") == nil || rs.Lookup("missing") != nil {
+		t.Error("Lookup found the wrong rules")
+	}
+	// The edits return copies
+	if got := names(rs); got != "a b c" {
+		t.Errorf("original rules = %q, want \"a b c\"", got)
+	}
+}
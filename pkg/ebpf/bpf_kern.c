@@ -1,46 +1,221 @@
-#include "bpf_helpers.h"
-#include "bpf_endian.h"
-#include <linux/if_ether.h>
-#include <linux/ip.h>
-#include <linux/ipv6.h>
-#include <linux/tcp.h>
-#include <linux/udp.h>
-
-struct connection_info {
+//go:build ignore
+
+#include <linux/types.h>
+#include <linux/bpf.h>
+#include <linux/ptrace.h>
+#include <linux/in.h>
+#include <linux/in6.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_endian.h>
+
+#define AF_INET 2
+#define AF_INET6 10
+
+// Kernel structures, reduced to the fields used here. The loader relocates
+// the offsets against the running kernel's BTF.
+struct sock_common {
+    __be32 skc_daddr;
+    __be32 skc_rcv_saddr;
+    __be16 skc_dport;
+    __u16 skc_num;
+    unsigned short skc_family;
+    struct in6_addr skc_v6_daddr;
+    struct in6_addr skc_v6_rcv_saddr;
+} __attribute__((preserve_access_index));
+
+struct sock {
+    struct sock_common __sk_common;
+} __attribute__((preserve_access_index));
+
+struct msghdr {
+    void *msg_name;
+} __attribute__((preserve_access_index));
+
+// A connection seen from the local end. IPv4 addresses are stored
+// IPv4-mapped, ports in host byte order.
+struct conn_key {
+    __u8 saddr[16];
+    __u8 daddr[16];
+    __u16 sport;
+    __u16 dport;
+    __u16 protocol;
+};
+
+// The task that opened the connection
+struct conn_info {
     __u32 pid;
+    __u32 tid;
     __u32 uid;
-    char comm[16];
-    __u64 start_time;
+    __u32 gid;
+    __u8 comm[16];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct conn_key);
+    __type(value, struct conn_info);
+} connections SEC(".maps");
+
+struct udp_args {
+    struct sock *sk;
+    struct msghdr *msg;
 };
 
+// Arguments of udp_sendmsg calls in flight, keyed by pid_tgid. The socket is
+// only bound to a local port once the call returns.
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
-    __uint(max_entries, 10000);
+    __uint(max_entries, 4096);
     __type(key, __u64);
-    __type(value, struct connection_info);
-} connections SEC(".maps");
+    __type(value, struct udp_args);
+} udp_sends SEC(".maps");
+
+static __always_inline void map_v4(__u8 *dst, __be32 addr)
+{
+    __builtin_memset(dst, 0, 10);
+    dst[10] = 0xff;
+    dst[11] = 0xff;
+    __builtin_memcpy(dst + 12, &addr, 4);
+}
+
+static __always_inline int read_sock(struct sock *sk, struct conn_key *key)
+{
+    __u16 family = BPF_CORE_READ(sk, __sk_common.skc_family);
+
+    if (family == AF_INET) {
+        map_v4(key->saddr, BPF_CORE_READ(sk, __sk_common.skc_rcv_saddr));
+        map_v4(key->daddr, BPF_CORE_READ(sk, __sk_common.skc_daddr));
+    } else if (family == AF_INET6) {
+        BPF_CORE_READ_INTO(&key->saddr, sk, __sk_common.skc_v6_rcv_saddr);
+        BPF_CORE_READ_INTO(&key->daddr, sk, __sk_common.skc_v6_daddr);
+    } else {
+        return -1;
+    }
+    key->sport = BPF_CORE_READ(sk, __sk_common.skc_num);
+    key->dport = bpf_ntohs(BPF_CORE_READ(sk, __sk_common.skc_dport));
+    return 0;
+}
+
+static __always_inline void record(struct conn_key *key)
+{
+    struct conn_info info = {};
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    __u64 uid_gid = bpf_get_current_uid_gid();
+
+    info.pid = pid_tgid >> 32;
+    info.tid = (__u32)pid_tgid;
+    info.uid = (__u32)uid_gid;
+    info.gid = uid_gid >> 32;
+    bpf_get_current_comm(&info.comm, sizeof(info.comm));
+
+    bpf_map_update_elem(&connections, key, &info, BPF_ANY);
+}
 
 SEC("kprobe/tcp_connect")
-int bpf_tcp_connect(struct pt_regs *ctx) {
-    struct connection_info conn = {};
+int BPF_KPROBE(trace_tcp_connect, struct sock *sk)
+{
+    struct conn_key key;
+
+    __builtin_memset(&key, 0, sizeof(key));
+    if (read_sock(sk, &key) < 0)
+        return 0;
+    key.protocol = IPPROTO_TCP;
+    record(&key);
+    return 0;
+}
+
+SEC("kretprobe/inet_csk_accept")
+int BPF_KRETPROBE(trace_inet_csk_accept, struct sock *sk)
+{
+    struct conn_key key;
+
+    if (!sk)
+        return 0;
+    __builtin_memset(&key, 0, sizeof(key));
+    if (read_sock(sk, &key) < 0)
+        return 0;
+    key.protocol = IPPROTO_TCP;
+    record(&key);
+    return 0;
+}
+
+static __always_inline int udp_enter(struct sock *sk, struct msghdr *msg)
+{
     __u64 pid_tgid = bpf_get_current_pid_tgid();
-    __u32 pid = pid_tgid >> 32;
-    
-    // Get process info
-    conn.pid = pid;
-    conn.uid = bpf_get_current_uid_gid();
-    bpf_get_current_comm(&conn.comm, sizeof(conn.comm));
-    conn.start_time = bpf_ktime_get_ns();
-    
-    bpf_map_update_elem(&connections, &pid_tgid, &conn, BPF_ANY);
+    struct udp_args args = {.sk = sk, .msg = msg};
+
+    bpf_map_update_elem(&udp_sends, &pid_tgid, &args, BPF_ANY);
     return 0;
 }
 
-SEC("kprobe/tcp_close")
-int bpf_tcp_close(struct pt_regs *ctx) {
+static __always_inline int udp_exit(int ret)
+{
     __u64 pid_tgid = bpf_get_current_pid_tgid();
-    bpf_map_delete_elem(&connections, &pid_tgid);
+    struct udp_args *args;
+    struct conn_key key;
+    void *name;
+
+    args = bpf_map_lookup_elem(&udp_sends, &pid_tgid);
+    if (!args)
+        return 0;
+    bpf_map_delete_elem(&udp_sends, &pid_tgid);
+    if (ret < 0)
+        return 0;
+
+    __builtin_memset(&key, 0, sizeof(key));
+    if (read_sock(args->sk, &key) < 0)
+        return 0;
+    key.protocol = IPPROTO_UDP;
+
+    // Unconnected sockets name the destination in the message
+    name = BPF_CORE_READ(args->msg, msg_name);
+    if (name) {
+        __u16 family = 0;
+
+        bpf_probe_read_kernel(&family, sizeof(family), name);
+        if (family == AF_INET) {
+            struct sockaddr_in sin = {};
+
+            bpf_probe_read_kernel(&sin, sizeof(sin), name);
+            map_v4(key.daddr, sin.sin_addr.s_addr);
+            key.dport = bpf_ntohs(sin.sin_port);
+        } else if (family == AF_INET6) {
+            struct sockaddr_in6 sin6 = {};
+
+            bpf_probe_read_kernel(&sin6, sizeof(sin6), name);
+            __builtin_memcpy(key.daddr, &sin6.sin6_addr, 16);
+            key.dport = bpf_ntohs(sin6.sin6_port);
+        }
+    }
+    record(&key);
     return 0;
 }
 
+SEC("kprobe/udp_sendmsg")
+int BPF_KPROBE(trace_udp_sendmsg, struct sock *sk, struct msghdr *msg)
+{
+    return udp_enter(sk, msg);
+}
+
+SEC("kretprobe/udp_sendmsg")
+int BPF_KRETPROBE(trace_udp_sendmsg_ret, int ret)
+{
+    return udp_exit(ret);
+}
+
+SEC("kprobe/udpv6_sendmsg")
+int BPF_KPROBE(trace_udpv6_sendmsg, struct sock *sk, struct msghdr *msg)
+{
+    return udp_enter(sk, msg);
+}
+
+SEC("kretprobe/udpv6_sendmsg")
+int BPF_KRETPROBE(trace_udpv6_sendmsg_ret, int ret)
+{
+    return udp_exit(ret);
+}
+
 char LICENSE[] SEC("license") = "GPL";
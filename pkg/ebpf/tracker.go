@@ -0,0 +1,137 @@
+// Package ebpf attributes connections to the processes that opened them using
+// kernel probes
+package ebpf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc $BPF_CLANG -cflags $BPF_CFLAGS -target amd64,arm64 -type conn_key -type conn_info bpf bpf_kern.c
+
+// ErrNotFound is returned when no probe has seen a connection
+var ErrNotFound = errors.New("connection not tracked")
+
+// Tuple identifies a connection from its local end
+type Tuple struct {
+	Protocol   uint8
+	LocalIP    net.IP
+	LocalPort  uint16
+	RemoteIP   net.IP
+	RemotePort uint16
+}
+
+// ConnectionInfo describes the task that opened a connection
+type ConnectionInfo struct {
+	PID  uint32 // thread group ID
+	TID  uint32
+	UID  uint32
+	GID  uint32
+	Comm [16]byte
+}
+
+// Name returns the command name of the task
+func (i *ConnectionInfo) Name() string {
+	name, _, _ := bytes.Cut(i.Comm[:], []byte{0})
+	return string(name)
+}
+
+// ConnectionTracker records new TCP and UDP connections in a kernel map
+type ConnectionTracker struct {
+	objs  bpfObjects
+	links []link.Link
+}
+
+// NewConnectionTracker loads the probes and attaches them to the kernel. It
+// fails when the kernel has no BTF or the process lacks the privileges to
+// load BPF programs.
+func NewConnectionTracker() (*ConnectionTracker, error) {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("failed to remove memlock limit: %w", err)
+	}
+
+	t := &ConnectionTracker{}
+	if err := loadBpfObjects(&t.objs, nil); err != nil {
+		return nil, fmt.Errorf("failed to load BPF objects: %w", err)
+	}
+
+	probes := []struct {
+		symbol string
+		prog   *ebpf.Program
+		ret    bool
+	}{
+		{"tcp_connect", t.objs.TraceTcpConnect, false},
+		{"inet_csk_accept", t.objs.TraceInetCskAccept, true},
+		{"udp_sendmsg", t.objs.TraceUdpSendmsg, false},
+		{"udp_sendmsg", t.objs.TraceUdpSendmsgRet, true},
+		{"udpv6_sendmsg", t.objs.TraceUdpv6Sendmsg, false},
+		{"udpv6_sendmsg", t.objs.TraceUdpv6SendmsgRet, true},
+	}
+	for _, p := range probes {
+		attach := link.Kprobe
+		if p.ret {
+			attach = link.Kretprobe
+		}
+		l, err := attach(p.symbol, p.prog, nil)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to attach probe to %s: %w", p.symbol, err)
+		}
+		t.links = append(t.links, l)
+	}
+
+	return t, nil
+}
+
+// Close detaches the probes and frees the maps
+func (t *ConnectionTracker) Close() error {
+	for _, l := range t.links {
+		l.Close()
+	}
+	t.links = nil
+	return t.objs.Close()
+}
+
+// Lookup returns the task that opened the connection. Unconnected UDP
+// sockets are recorded without a local address, so those are tried when the
+// exact tuple is unknown.
+func (t *ConnectionTracker) Lookup(tuple Tuple) (*ConnectionInfo, error) {
+	key := bpfConnKey{
+		Sport:    tuple.LocalPort,
+		Dport:    tuple.RemotePort,
+		Protocol: uint16(tuple.Protocol),
+	}
+	copy(key.Saddr[:], tuple.LocalIP.To16())
+	copy(key.Daddr[:], tuple.RemoteIP.To16())
+
+	var value bpfConnInfo
+	err := t.objs.Connections.Lookup(&key, &value)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		unspecified := net.IPv6unspecified
+		if tuple.LocalIP.To4() != nil {
+			unspecified = net.IPv4zero
+		}
+		copy(key.Saddr[:], unspecified.To16())
+		err = t.objs.Connections.Lookup(&key, &value)
+	}
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConnectionInfo{
+		PID:  value.Pid,
+		TID:  value.Tid,
+		UID:  value.Uid,
+		GID:  value.Gid,
+		Comm: value.Comm,
+	}, nil
+}